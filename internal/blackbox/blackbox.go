@@ -0,0 +1,450 @@
+package blackbox
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// SystemdPath is where the ring is kept in service mode.
+	SystemdPath = "/var/lib/morgue/blackbox.ring"
+
+	magic = "MORGUEBB"
+	// headerSize holds the magic, the open flag, the ring positions and when
+	// an unclean ring was last recovered.
+	headerSize = 64
+	// recordHeaderSize holds the length and time of a record.
+	recordHeaderSize = 12
+	// MinSize leaves room for at least a few seconds of samples.
+	MinSize = 64 * 1024
+	// DefaultSyncInterval bounds the samples lost when the host goes down,
+	// while sparing flash storage a sync every sample.
+	DefaultSyncInterval = 15 * time.Second
+
+	flagOpen = 1
+)
+
+var byteOrder = binary.LittleEndian
+
+// DefaultPath returns where the ring is kept when morgue runs as the current
+// user.
+func DefaultPath() (string, error) {
+	dirname, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dirname, ".morgue", "blackbox.ring"), nil
+}
+
+// Recorder keeps the most recent samples in a fixed size ring file mapped
+// into memory. The kernel writes the mapped pages back if morgue is killed.
+// The samples written since the last sync are synced every SyncInterval and
+// before every dump, so the host going down loses at most one interval.
+type Recorder interface {
+	// Write adds one sample of points in line protocol, dropping the oldest
+	// samples to make room.
+	Write(lines []string) error
+	// Dump writes the samples of the last window to path, oldest first.
+	Dump(path, reason string) error
+	// Close unmaps the ring. A cleanly closed ring isn't recovered on the
+	// next start.
+	Close(clean bool) error
+}
+
+type RecorderParams struct {
+	Path string
+	// Size is the size of the ring file in bytes.
+	Size int64
+	// Window limits dumps to the samples taken this long before them.
+	Window time.Duration
+	// Recovered is kept in the ring, see Recovered.
+	Recovered time.Time
+	// SyncInterval defaults to DefaultSyncInterval.
+	SyncInterval time.Duration
+}
+
+type recorder struct {
+	window       time.Duration
+	syncInterval time.Duration
+	pageSize     int
+
+	lock sync.Mutex
+	file *os.File
+	data []byte
+	// lastSync, syncedHead and unsynced track what Write added since the
+	// last sync, starting at syncedHead.
+	lastSync   time.Time
+	syncedHead uint64
+	unsynced   uint64
+}
+
+// NewRecorder creates the ring at Path, replacing any previous one. Call
+// Recover first to keep the samples of a run that didn't stop cleanly.
+func NewRecorder(params RecorderParams) (Recorder, error) {
+	if params.Size < MinSize {
+		return nil, errors.Errorf("black box size must be at least %d bytes", MinSize)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(params.Path), 0700); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(params.Path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := file.Truncate(params.Size); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	data, err := unix.Mmap(int(file.Fd()), 0, int(params.Size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		file.Close()
+		return nil, errors.Wrap(err, "unable to map black box")
+	}
+
+	copy(data, magic)
+	r := &recorder{
+		window:       params.Window,
+		syncInterval: params.SyncInterval,
+		pageSize:     os.Getpagesize(),
+		file:         file,
+		data:         data,
+		lastSync:     time.Now(),
+	}
+	if r.syncInterval <= 0 {
+		r.syncInterval = DefaultSyncInterval
+	}
+	r.setFlags(flagOpen)
+	if !params.Recovered.IsZero() {
+		r.setRecovered(params.Recovered)
+	}
+
+	return r, r.sync()
+}
+
+// Recovered returns when the ring at path was last recovered, as passed to
+// NewRecorder, so restarts in a loop don't upload every short lived ring.
+// It is zero when there is no ring or it never was.
+func Recovered(path string) (time.Time, error) {
+	r, err := load(path)
+	if err != nil || r == nil {
+		return time.Time{}, err
+	}
+
+	return r.recovered(), nil
+}
+
+// Unclean reports whether the ring at path was left open by a run that
+// didn't stop cleanly.
+func Unclean(path string) (bool, error) {
+	r, err := load(path)
+	if err != nil || r == nil {
+		return false, err
+	}
+
+	return r.flags()&flagOpen != 0, nil
+}
+
+// Recover writes the samples of the ring at ringPath to path, leading up to
+// the last one rather than to now.
+func Recover(ringPath, path string, window time.Duration) error {
+	r, err := load(ringPath)
+	if err != nil {
+		return err
+	}
+	if r == nil {
+		return errors.Errorf("no black box found at %s", ringPath)
+	}
+	r.window = window
+
+	return r.dump(path, "unclean stop", r.newest())
+}
+
+// load reads the ring at path, nil when there is none.
+func load(path string) (*recorder, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < headerSize || string(data[:len(magic)]) != magic {
+		return nil, nil
+	}
+
+	return &recorder{data: data}, nil
+}
+
+func (r *recorder) Write(lines []string) error {
+	if len(lines) == 0 {
+		return nil
+	}
+
+	payload := []byte{}
+	for _, line := range lines {
+		payload = append(payload, line...)
+		payload = append(payload, '\n')
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.data == nil {
+		return errors.New("black box is closed")
+	}
+
+	size := uint64(recordHeaderSize + len(payload))
+	if size > r.capacity() {
+		return errors.Errorf("sample of %d bytes doesn't fit into the black box", size)
+	}
+
+	head, tail, used := r.positions()
+	for r.capacity()-used < size {
+		length := uint64(byteOrder.Uint32(r.read(tail, 4)))
+		tail = (tail + recordHeaderSize + length) % r.capacity()
+		used -= recordHeaderSize + length
+	}
+
+	record := make([]byte, size)
+	byteOrder.PutUint32(record[0:4], uint32(len(payload)))
+	byteOrder.PutUint64(record[4:12], uint64(time.Now().UnixNano()))
+	copy(record[recordHeaderSize:], payload)
+	r.write(head, record)
+	r.setPositions((head+size)%r.capacity(), tail, used+size)
+	r.unsynced += size
+
+	if time.Since(r.lastSync) < r.syncInterval {
+		return nil
+	}
+
+	return r.flush()
+}
+
+func (r *recorder) Dump(path, reason string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.data == nil {
+		return errors.New("black box is closed")
+	}
+
+	if err := r.flush(); err != nil {
+		return err
+	}
+
+	return r.dump(path, reason, time.Now())
+}
+
+func (r *recorder) Close(clean bool) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.data == nil {
+		return nil
+	}
+
+	if err := r.flush(); err != nil {
+		return err
+	}
+
+	if clean {
+		r.setFlags(0)
+		if err := r.syncRange(0, headerSize); err != nil {
+			return err
+		}
+	}
+
+	err := unix.Munmap(r.data)
+	r.data = nil
+	if errClose := r.file.Close(); err == nil {
+		err = errClose
+	}
+
+	return err
+}
+
+// dump writes the records taken within the window before end to path.
+func (r *recorder) dump(path, reason string, end time.Time) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(file)
+	fmt.Fprintf(w, "# morgue black box, reason: %s\n", reason)
+
+	err = r.records(func(t time.Time, payload []byte) error {
+		if r.window > 0 && t.Before(end.Add(-r.window)) {
+			return nil
+		}
+		_, err := w.Write(payload)
+		return err
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if errClose := file.Close(); err == nil {
+		err = errClose
+	}
+
+	return err
+}
+
+// records calls fn for every record, oldest first. A record cut short by a
+// crash ends the walk.
+func (r *recorder) records(fn func(time.Time, []byte) error) error {
+	_, tail, used := r.positions()
+	if used > r.capacity() {
+		return nil
+	}
+
+	for used >= recordHeaderSize {
+		header := r.read(tail, recordHeaderSize)
+		length := uint64(byteOrder.Uint32(header[0:4]))
+		if recordHeaderSize+length > used {
+			return nil
+		}
+
+		t := time.Unix(0, int64(byteOrder.Uint64(header[4:12])))
+		if err := fn(t, r.read(tail+recordHeaderSize, length)); err != nil {
+			return err
+		}
+
+		tail = (tail + recordHeaderSize + length) % r.capacity()
+		used -= recordHeaderSize + length
+	}
+
+	return nil
+}
+
+// newest returns the time of the last record.
+func (r *recorder) newest() time.Time {
+	newest := time.Time{}
+	_ = r.records(func(t time.Time, _ []byte) error {
+		newest = t
+		return nil
+	})
+
+	return newest
+}
+
+func (r *recorder) capacity() uint64 {
+	return uint64(len(r.data) - headerSize)
+}
+
+// read returns n bytes of the ring from pos, unwrapping them when they
+// continue at its start.
+func (r *recorder) read(pos, n uint64) []byte {
+	out := make([]byte, n)
+	ring := r.data[headerSize:]
+	pos %= r.capacity()
+	copied := copy(out, ring[pos:])
+	copy(out[copied:], ring)
+
+	return out
+}
+
+func (r *recorder) write(pos uint64, b []byte) {
+	ring := r.data[headerSize:]
+	copied := copy(ring[pos:], b)
+	copy(ring, b[copied:])
+}
+
+func (r *recorder) flags() uint32 {
+	return byteOrder.Uint32(r.data[8:12])
+}
+
+func (r *recorder) setFlags(flags uint32) {
+	byteOrder.PutUint32(r.data[8:12], flags)
+}
+
+func (r *recorder) positions() (head, tail, used uint64) {
+	return byteOrder.Uint64(r.data[16:24]), byteOrder.Uint64(r.data[24:32]), byteOrder.Uint64(r.data[32:40])
+}
+
+func (r *recorder) setPositions(head, tail, used uint64) {
+	byteOrder.PutUint64(r.data[16:24], head)
+	byteOrder.PutUint64(r.data[24:32], tail)
+	byteOrder.PutUint64(r.data[32:40], used)
+}
+
+func (r *recorder) recovered() time.Time {
+	recovered := byteOrder.Uint64(r.data[40:48])
+	if recovered == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, int64(recovered))
+}
+
+func (r *recorder) setRecovered(t time.Time) {
+	byteOrder.PutUint64(r.data[40:48], uint64(t.UnixNano()))
+}
+
+func (r *recorder) sync() error {
+	return unix.Msync(r.data, unix.MS_SYNC)
+}
+
+// flush syncs the records written since the last sync, then the header
+// pointing at them, so only the pages written to are synced.
+func (r *recorder) flush() error {
+	head, _, _ := r.positions()
+	start, n := r.syncedHead, r.unsynced
+
+	var err error
+	switch {
+	case n == 0:
+	case n >= r.capacity():
+		err = r.syncRange(headerSize, r.capacity())
+	case start+n <= r.capacity():
+		err = r.syncRange(headerSize+start, n)
+	default:
+		err = r.syncRange(headerSize+start, r.capacity()-start)
+		if err == nil {
+			err = r.syncRange(headerSize, start+n-r.capacity())
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	r.syncedHead = head
+	r.unsynced = 0
+	r.lastSync = time.Now()
+
+	return r.syncRange(0, headerSize)
+}
+
+// syncRange syncs the pages holding n bytes of the mapping from offset.
+func (r *recorder) syncRange(offset, n uint64) error {
+	pageSize := uint64(r.pageSize)
+	start := offset / pageSize * pageSize
+	end := (offset + n + pageSize - 1) / pageSize * pageSize
+	if end > uint64(len(r.data)) {
+		end = uint64(len(r.data))
+	}
+
+	return unix.Msync(r.data[start:end], unix.MS_SYNC)
+}
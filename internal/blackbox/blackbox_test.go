@@ -0,0 +1,247 @@
+package blackbox
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestRecorder(t *testing.T, params RecorderParams) Recorder {
+	t.Helper()
+
+	if params.Path == "" {
+		params.Path = filepath.Join(t.TempDir(), "blackbox.ring")
+	}
+	if params.Size == 0 {
+		params.Size = MinSize
+	}
+
+	r, err := NewRecorder(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return r
+}
+
+// dumped returns the sample lines of a dump, without its header.
+func dumped(t *testing.T, r Recorder) []string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "dump.lp")
+	if err := r.Dump(path, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if !strings.HasPrefix(lines[0], "# morgue black box, reason: test") {
+		t.Fatalf("dump starts with %q, want the header", lines[0])
+	}
+
+	return lines[1:]
+}
+
+func sample(i int) string {
+	return fmt.Sprintf("cpu,host=a usage=%d %s", i, strings.Repeat("x", 1000))
+}
+
+func TestNewRecorderTooSmall(t *testing.T) {
+	_, err := NewRecorder(RecorderParams{
+		Path: filepath.Join(t.TempDir(), "blackbox.ring"),
+		Size: MinSize - 1,
+	})
+	if err == nil {
+		t.Error("NewRecorder succeeded with a ring below MinSize, want an error")
+	}
+}
+
+func TestWriteWrapsAround(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples int
+	}{
+		{"empty", 0},
+		{"one", 1},
+		{"below capacity", 20},
+		{"wrapped once", 100},
+		{"wrapped many times", 1000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// a nanosecond syncs every sample, the default none of them
+			for _, interval := range []time.Duration{time.Nanosecond, DefaultSyncInterval} {
+				testWriteWrapsAround(t, tt.samples, interval)
+			}
+		})
+	}
+}
+
+func testWriteWrapsAround(t *testing.T, samples int, interval time.Duration) {
+	t.Helper()
+
+	r := newTestRecorder(t, RecorderParams{SyncInterval: interval})
+	defer r.Close(true)
+
+	for i := 0; i < samples; i++ {
+		if err := r.Write([]string{sample(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lines := dumped(t, r)
+	if samples == 0 {
+		if len(lines) != 0 {
+			t.Errorf("dump of an empty ring has %d lines, want none", len(lines))
+		}
+		return
+	}
+
+	// the newest samples are kept, oldest first and without gaps
+	first := samples - len(lines)
+	if first < 0 {
+		t.Fatalf("dump has %d lines, want at most %d", len(lines), samples)
+	}
+	for i, line := range lines {
+		if line != sample(first+i) {
+			t.Fatalf("line %d is %.30q, want sample %d", i, line, first+i)
+		}
+	}
+	if samples <= 20 && first != 0 {
+		t.Errorf("dump dropped %d samples that fit into the ring", first)
+	}
+	if samples > 100 && len(lines) < 50 {
+		t.Errorf("dump kept %d samples of a full ring, want it mostly used", len(lines))
+	}
+}
+
+func TestWriteTooLarge(t *testing.T) {
+	r := newTestRecorder(t, RecorderParams{})
+	defer r.Close(true)
+
+	if err := r.Write([]string{strings.Repeat("x", MinSize)}); err == nil {
+		t.Error("Write of a sample larger than the ring succeeded, want an error")
+	}
+}
+
+func TestDumpWindow(t *testing.T) {
+	r := newTestRecorder(t, RecorderParams{Window: time.Hour})
+	defer r.Close(true)
+
+	if err := r.Write([]string{"cpu usage=1", "mem used=2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := dumped(t, r)
+	if len(lines) != 2 || lines[0] != "cpu usage=1" || lines[1] != "mem used=2" {
+		t.Errorf("dump within the window is %q, want both lines", lines)
+	}
+
+	r = newTestRecorder(t, RecorderParams{Window: time.Nanosecond})
+	defer r.Close(true)
+
+	if err := r.Write([]string{"cpu usage=1"}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+
+	if lines := dumped(t, r); len(lines) != 0 {
+		t.Errorf("dump past the window is %q, want it empty", lines)
+	}
+}
+
+func TestUncleanRecover(t *testing.T) {
+	tests := []struct {
+		name    string
+		clean   bool
+		unclean bool
+	}{
+		{"closed cleanly", true, false},
+		{"left open", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "blackbox.ring")
+			r := newTestRecorder(t, RecorderParams{Path: path, Window: time.Minute})
+			if err := r.Write([]string{"cpu usage=1"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Close(tt.clean); err != nil {
+				t.Fatal(err)
+			}
+
+			unclean, err := Unclean(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if unclean != tt.unclean {
+				t.Errorf("Unclean() = %v, want %v", unclean, tt.unclean)
+			}
+
+			// recovering dumps up to the last sample rather than to now
+			dump := filepath.Join(t.TempDir(), "recovered.lp")
+			if err := Recover(path, dump, time.Minute); err != nil {
+				t.Fatal(err)
+			}
+			data, err := ioutil.ReadFile(dump)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasSuffix(string(data), "cpu usage=1\n") {
+				t.Errorf("recovered dump is %q, want the sample", data)
+			}
+		})
+	}
+}
+
+func TestUncleanMissing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blackbox.ring")
+
+	unclean, err := Unclean(path)
+	if err != nil || unclean {
+		t.Errorf("Unclean() of a missing ring = %v, %v, want false", unclean, err)
+	}
+
+	if err := Recover(path, filepath.Join(t.TempDir(), "dump.lp"), time.Minute); err == nil {
+		t.Error("Recover of a missing ring succeeded, want an error")
+	}
+}
+
+func TestRecovered(t *testing.T) {
+	recovered := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name      string
+		recovered time.Time
+	}{
+		{"never recovered", time.Time{}},
+		{"recovered", recovered},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "blackbox.ring")
+			r := newTestRecorder(t, RecorderParams{Path: path, Recovered: tt.recovered})
+			if err := r.Close(false); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := Recovered(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Equal(tt.recovered) {
+				t.Errorf("Recovered() = %v, want %v", got, tt.recovered)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package collector
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	InputCPU       = "cpu"
+	InputDisk      = "disk"
+	InputDiskIO    = "diskio"
+	InputKernel    = "kernel"
+	InputProcesses = "processes"
+	InputSwap      = "swap"
+	InputSystem    = "system"
+)
+
+// Inputs lists the telegraf inputs the collector replaces. It collects the
+// same measurements and fields, so dashboards work with either.
+var Inputs = []string{InputCPU, InputDisk, InputDiskIO, InputKernel, InputProcesses, InputSwap, InputSystem}
+
+// procRoot and sysRoot are where the inputs read the kernel's statistics.
+var (
+	procRoot = "/proc"
+	sysRoot  = "/sys"
+)
+
+// ignoredFilesystems are left out of the disk input, as they are by the
+// default telegraf config.
+var ignoredFilesystems = map[string]bool{
+	"tmpfs":    true,
+	"devtmpfs": true,
+	"devfs":    true,
+	"iso9660":  true,
+	"overlay":  true,
+	"aufs":     true,
+	"squashfs": true,
+}
+
+// Writer stores gathered points, a TSDB or the black box.
+type Writer interface {
+	Write(lines []string) error
+}
+
+type Collector interface {
+	Run(context.Context)
+}
+
+type CollectorParams struct {
+	Interval time.Duration
+	// DisabledInputs are not collected.
+	DisabledInputs []string
+	// Tags are added to every point. The host tag is added unless
+	// OmitHostname is set.
+	Tags         map[string]string
+	Hostname     string
+	OmitHostname bool
+	Output       Writer
+	Logger       zap.Logger
+}
+
+// input gathers the points of one measurement. Inputs that report rates
+// keep the previous sample between calls.
+type input interface {
+	gather(tags map[string]string, now time.Time) ([]string, error)
+}
+
+type collector struct {
+	interval time.Duration
+	inputs   map[string]input
+	tags     map[string]string
+	output   Writer
+	logger   zap.Logger
+}
+
+// NewCollector returns a collector that gathers system metrics natively from
+// /proc and /sys, without telegraf.
+func NewCollector(params CollectorParams) Collector {
+	inputs := map[string]input{
+		InputCPU:       &cpuInput{},
+		InputDisk:      diskInput{},
+		InputDiskIO:    diskIOInput{},
+		InputKernel:    kernelInput{},
+		InputProcesses: processesInput{},
+		InputSwap:      swapInput{},
+		InputSystem:    systemInput{},
+	}
+	for _, name := range params.DisabledInputs {
+		delete(inputs, name)
+	}
+
+	tags := map[string]string{}
+	for key, value := range params.Tags {
+		tags[key] = value
+	}
+	if !params.OmitHostname {
+		hostname := params.Hostname
+		if hostname == "" {
+			hostname, _ = os.Hostname()
+		}
+		tags["host"] = hostname
+	}
+
+	return &collector{
+		interval: params.Interval,
+		inputs:   inputs,
+		tags:     tags,
+		output:   params.Output,
+		logger:   params.Logger,
+	}
+}
+
+// Run gathers every interval, aligned to it like telegraf's round_interval,
+// until ctx is done.
+func (c *collector) Run(ctx context.Context) {
+	for {
+		now := time.Now()
+		c.gather(now)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(now.Truncate(c.interval).Add(c.interval).Sub(time.Now())):
+		}
+	}
+}
+
+func (c *collector) gather(now time.Time) {
+	lines := []string{}
+	for name, in := range c.inputs {
+		gathered, err := in.gather(c.tags, now)
+		if err != nil {
+			c.logger.Sugar().Warnw("unable to collect metrics", "input", name, "error", err)
+			continue
+		}
+		lines = append(lines, gathered...)
+	}
+
+	if len(lines) == 0 {
+		return
+	}
+
+	if err := c.output.Write(lines); err != nil {
+		c.logger.Warn(err.Error())
+	}
+}
+
+// withTags returns a copy of base with tags added.
+func withTags(base map[string]string, tags map[string]string) map[string]string {
+	merged := make(map[string]string, len(base)+len(tags))
+	for key, value := range base {
+		merged[key] = value
+	}
+	for key, value := range tags {
+		merged[key] = value
+	}
+
+	return merged
+}
@@ -0,0 +1,499 @@
+package collector
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/zawachte/morgue/pkg/influx"
+)
+
+// cpuTimes are the jiffies of one cpu line of /proc/stat.
+type cpuTimes struct {
+	user, nice, system, idle, iowait, irq, softirq, steal, guest, guestNice float64
+}
+
+// total leaves out guest time, which user and nice already count.
+func (t cpuTimes) total() float64 {
+	return t.user + t.nice + t.system + t.idle + t.iowait + t.irq + t.softirq + t.steal
+}
+
+// cpuInput reports the share of time spent in each state since the last
+// gather, so the first gather reports nothing.
+type cpuInput struct {
+	previous map[string]cpuTimes
+}
+
+func (c *cpuInput) gather(tags map[string]string, now time.Time) ([]string, error) {
+	lines, err := readLines(filepath.Join(procRoot, "stat"))
+	if err != nil {
+		return nil, err
+	}
+
+	current := map[string]cpuTimes{}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 11 || !strings.HasPrefix(fields[0], "cpu") {
+			continue
+		}
+
+		values := make([]float64, 10)
+		for i := range values {
+			values[i], _ = strconv.ParseFloat(fields[i+1], 64)
+		}
+
+		name := fields[0]
+		if name == "cpu" {
+			name = "cpu-total"
+		}
+		current[name] = cpuTimes{values[0], values[1], values[2], values[3], values[4], values[5], values[6], values[7], values[8], values[9]}
+	}
+
+	points := []string{}
+	for name, times := range current {
+		previous, ok := c.previous[name]
+		if !ok {
+			continue
+		}
+
+		total := times.total() - previous.total()
+		if total <= 0 {
+			continue
+		}
+
+		usage := func(current, previous float64) float64 {
+			return 100 * (current - previous) / total
+		}
+
+		points = append(points, point(InputCPU, withTags(tags, map[string]string{"cpu": name}), map[string]interface{}{
+			"usage_user":       usage(times.user, previous.user),
+			"usage_nice":       usage(times.nice, previous.nice),
+			"usage_system":     usage(times.system, previous.system),
+			"usage_idle":       usage(times.idle, previous.idle),
+			"usage_iowait":     usage(times.iowait, previous.iowait),
+			"usage_irq":        usage(times.irq, previous.irq),
+			"usage_softirq":    usage(times.softirq, previous.softirq),
+			"usage_steal":      usage(times.steal, previous.steal),
+			"usage_guest":      usage(times.guest, previous.guest),
+			"usage_guest_nice": usage(times.guestNice, previous.guestNice),
+		}, now))
+	}
+	c.previous = current
+
+	return points, nil
+}
+
+type diskInput struct{}
+
+func (diskInput) gather(tags map[string]string, now time.Time) ([]string, error) {
+	lines, err := readLines(filepath.Join(procRoot, "self", "mounts"))
+	if err != nil {
+		return nil, err
+	}
+
+	virtual, err := virtualFilesystems()
+	if err != nil {
+		return nil, err
+	}
+
+	points := []string{}
+	seen := map[string]bool{}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+
+		device, path, fstype := fields[0], unescapeMount(fields[1]), fields[2]
+		if ignoredFilesystems[fstype] || virtual[fstype] || seen[path] {
+			continue
+		}
+		seen[path] = true
+
+		var stat syscall.Statfs_t
+		if err := syscall.Statfs(path, &stat); err != nil || stat.Blocks == 0 {
+			continue
+		}
+
+		mode := "rw"
+		for _, option := range strings.Split(fields[3], ",") {
+			if option == "ro" {
+				mode = "ro"
+			}
+		}
+
+		blockSize := uint64(stat.Bsize)
+		total := stat.Blocks * blockSize
+		free := stat.Bavail * blockSize
+		used := (stat.Blocks - stat.Bfree) * blockSize
+		usedPercent := 0.0
+		if used+free > 0 {
+			usedPercent = 100 * float64(used) / float64(used+free)
+		}
+
+		points = append(points, point(InputDisk, withTags(tags, map[string]string{
+			"path":   path,
+			"device": strings.TrimPrefix(device, "/dev/"),
+			"fstype": fstype,
+			"mode":   mode,
+		}), map[string]interface{}{
+			"total":        total,
+			"free":         free,
+			"used":         used,
+			"used_percent": usedPercent,
+			"inodes_total": stat.Files,
+			"inodes_free":  stat.Ffree,
+			"inodes_used":  stat.Files - stat.Ffree,
+		}, now))
+	}
+
+	return points, nil
+}
+
+// virtualFilesystems returns the filesystem types /proc/filesystems marks as
+// not backed by a device, like proc and cgroup.
+func virtualFilesystems() (map[string]bool, error) {
+	lines, err := readLines(filepath.Join(procRoot, "filesystems"))
+	if err != nil {
+		return nil, err
+	}
+
+	virtual := map[string]bool{}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "nodev" {
+			virtual[fields[1]] = true
+		}
+	}
+
+	return virtual, nil
+}
+
+// unescapeMount undoes the octal escapes of spaces and tabs in mount points.
+func unescapeMount(path string) string {
+	return strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`).Replace(path)
+}
+
+type diskIOInput struct{}
+
+// sectorSize is the unit of the sector counts in /proc/diskstats, whatever
+// the size of the device's sectors.
+const sectorSize = 512
+
+func (diskIOInput) gather(tags map[string]string, now time.Time) ([]string, error) {
+	lines, err := readLines(filepath.Join(procRoot, "diskstats"))
+	if err != nil {
+		return nil, err
+	}
+
+	points := []string{}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 14 {
+			continue
+		}
+
+		values := make([]uint64, 11)
+		for i := range values {
+			values[i], _ = strconv.ParseUint(fields[i+3], 10, 64)
+		}
+
+		points = append(points, point(InputDiskIO, withTags(tags, map[string]string{"name": fields[2]}), map[string]interface{}{
+			"reads":            values[0],
+			"merged_reads":     values[1],
+			"read_bytes":       values[2] * sectorSize,
+			"read_time":        values[3],
+			"writes":           values[4],
+			"merged_writes":    values[5],
+			"write_bytes":      values[6] * sectorSize,
+			"write_time":       values[7],
+			"iops_in_progress": values[8],
+			"io_time":          values[9],
+			"weighted_io_time": values[10],
+		}, now))
+	}
+
+	return points, nil
+}
+
+type kernelInput struct{}
+
+func (kernelInput) gather(tags map[string]string, now time.Time) ([]string, error) {
+	lines, err := readLines(filepath.Join(procRoot, "stat"))
+	if err != nil {
+		return nil, err
+	}
+
+	names := map[string]string{
+		"intr":      "interrupts",
+		"ctxt":      "context_switches",
+		"btime":     "boot_time",
+		"processes": "processes_forked",
+	}
+
+	fields := map[string]interface{}{}
+	for _, line := range lines {
+		values := strings.Fields(line)
+		if len(values) < 2 {
+			continue
+		}
+
+		if name, ok := names[values[0]]; ok {
+			value, err := strconv.ParseUint(values[1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse %s in /proc/stat: %w", values[0], err)
+			}
+			fields[name] = value
+		}
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(procRoot, "sys", "kernel", "random", "entropy_avail"))
+	if err == nil {
+		if entropy, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64); err == nil {
+			fields["entropy_avail"] = entropy
+		}
+	}
+
+	return []string{point(InputKernel, tags, fields, now)}, nil
+}
+
+type processesInput struct{}
+
+// processStates maps the state letters of /proc/<pid>/stat to fields.
+var processStates = map[string]string{
+	"R": "running",
+	"S": "sleeping",
+	"D": "blocked",
+	"Z": "zombies",
+	"X": "dead",
+	"T": "stopped",
+	"t": "stopped",
+	"I": "idle",
+	"W": "paging",
+}
+
+func (processesInput) gather(tags map[string]string, now time.Time) ([]string, error) {
+	entries, err := ioutil.ReadDir(procRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := map[string]interface{}{}
+	counts := map[string]int64{}
+	for _, state := range processStates {
+		counts[state] = 0
+	}
+	var total, threads int64
+
+	for _, entry := range entries {
+		if _, err := strconv.Atoi(entry.Name()); err != nil {
+			continue
+		}
+
+		// processes may exit while they are counted
+		data, err := ioutil.ReadFile(filepath.Join(procRoot, entry.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+
+		// the command name may hold spaces and parentheses, the fields
+		// start after the last closing one
+		stat := string(data)
+		end := strings.LastIndex(stat, ")")
+		if end < 0 {
+			continue
+		}
+		values := strings.Fields(stat[end+1:])
+		if len(values) < 18 {
+			continue
+		}
+
+		total++
+		if state, ok := processStates[values[0]]; ok {
+			counts[state]++
+		} else {
+			counts["unknown"]++
+		}
+
+		numThreads, _ := strconv.ParseInt(values[17], 10, 64)
+		threads += numThreads
+	}
+
+	for state, count := range counts {
+		fields[state] = count
+	}
+	fields["total"] = total
+	fields["total_threads"] = threads
+
+	return []string{point(InputProcesses, tags, fields, now)}, nil
+}
+
+type swapInput struct{}
+
+func (swapInput) gather(tags map[string]string, now time.Time) ([]string, error) {
+	meminfo, err := readKeyValues(filepath.Join(procRoot, "meminfo"))
+	if err != nil {
+		return nil, err
+	}
+
+	vmstat, err := readKeyValues(filepath.Join(procRoot, "vmstat"))
+	if err != nil {
+		return nil, err
+	}
+
+	// meminfo counts in kB, vmstat in pages
+	total := meminfo["SwapTotal"] * 1024
+	free := meminfo["SwapFree"] * 1024
+	used := total - free
+	usedPercent := 0.0
+	if total > 0 {
+		usedPercent = 100 * float64(used) / float64(total)
+	}
+	pageSize := uint64(os.Getpagesize())
+
+	return []string{point(InputSwap, tags, map[string]interface{}{
+		"total":        total,
+		"free":         free,
+		"used":         used,
+		"used_percent": usedPercent,
+		"in":           vmstat["pswpin"] * pageSize,
+		"out":          vmstat["pswpout"] * pageSize,
+	}, now)}, nil
+}
+
+type systemInput struct{}
+
+func (systemInput) gather(tags map[string]string, now time.Time) ([]string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(procRoot, "loadavg"))
+	if err != nil {
+		return nil, err
+	}
+
+	loads := strings.Fields(string(data))
+	if len(loads) < 3 {
+		return nil, fmt.Errorf("unexpected /proc/loadavg %q", strings.TrimSpace(string(data)))
+	}
+
+	fields := map[string]interface{}{
+		"n_cpus": onlineCPUs(),
+	}
+	for i, name := range []string{"load1", "load5", "load15"} {
+		load, err := strconv.ParseFloat(loads[i], 64)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse /proc/loadavg: %w", err)
+		}
+		fields[name] = load
+	}
+
+	data, err = ioutil.ReadFile(filepath.Join(procRoot, "uptime"))
+	if err != nil {
+		return nil, err
+	}
+
+	uptime := strings.Fields(string(data))
+	if len(uptime) > 0 {
+		seconds, err := strconv.ParseFloat(uptime[0], 64)
+		if err == nil {
+			fields["uptime"] = uint64(seconds)
+		}
+	}
+
+	return []string{point(InputSystem, tags, fields, now)}, nil
+}
+
+// onlineCPUs counts the cpus in /sys/devices/system/cpu/online, which reads
+// like "0-3,6". The cpus this process may use are counted when it can't be
+// read.
+func onlineCPUs() int {
+	data, err := ioutil.ReadFile(filepath.Join(sysRoot, "devices", "system", "cpu", "online"))
+	if err != nil {
+		return runtime.NumCPU()
+	}
+
+	count := 0
+	for _, part := range strings.Split(strings.TrimSpace(string(data)), ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return runtime.NumCPU()
+		}
+
+		last := first
+		if len(bounds) == 2 {
+			last, err = strconv.Atoi(bounds[1])
+			if err != nil {
+				return runtime.NumCPU()
+			}
+		}
+		count += last - first + 1
+	}
+
+	return count
+}
+
+func readLines(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	lines := []string{}
+	scanner := bufio.NewScanner(file)
+	// the intr line of /proc/stat grows with the number of interrupts
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+
+	return lines, scanner.Err()
+}
+
+// point encodes a point with its unsigned fields as integers, like telegraf
+// writes them to influxdb by default, so queries see one field type
+// whichever of the two collected a series.
+func point(measurement string, tags map[string]string, fields map[string]interface{}, t time.Time) string {
+	for key, value := range fields {
+		if v, ok := value.(uint64); ok {
+			if v > math.MaxInt64 {
+				v = math.MaxInt64
+			}
+			fields[key] = int64(v)
+		}
+	}
+
+	return influx.Line(measurement, tags, fields, t)
+}
+
+// readKeyValues parses files like /proc/meminfo and /proc/vmstat into the
+// first number following each key.
+func readKeyValues(path string) (map[string]uint64, error) {
+	lines, err := readLines(path)
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]uint64{}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		value, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		values[strings.TrimSuffix(fields[0], ":")] = value
+	}
+
+	return values, nil
+}
@@ -0,0 +1,67 @@
+package collector
+
+import (
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPoint(t *testing.T) {
+	at := time.Unix(0, 1500000000000000000)
+
+	tests := []struct {
+		name   string
+		fields map[string]interface{}
+		want   string
+	}{
+		{
+			name:   "unsigned written as integer",
+			fields: map[string]interface{}{"free": uint64(1024)},
+			want:   "disk,host=a free=1024i 1500000000000000000",
+		},
+		{
+			name:   "unsigned above int64 is capped",
+			fields: map[string]interface{}{"free": uint64(math.MaxUint64)},
+			want:   "disk,host=a free=9223372036854775807i 1500000000000000000",
+		},
+		{
+			name:   "other types are kept",
+			fields: map[string]interface{}{"used_percent": 12.5, "n": 3, "ok": true, "name": "x"},
+			want:   `disk,host=a n=3i,name="x",ok=true,used_percent=12.5 1500000000000000000`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := point("disk", map[string]string{"host": "a"}, tt.fields, at)
+			if got != tt.want {
+				t.Errorf("point() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadKeyValues(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "meminfo")
+	content := "MemTotal:       16318028 kB\nMemFree:         1234 kB\nbroken\nHugePages_Total:       0\nNotANumber: x kB\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := readKeyValues(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]uint64{
+		"MemTotal":        16318028,
+		"MemFree":         1234,
+		"HugePages_Total": 0,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("readKeyValues() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,1035 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	"github.com/zawachte/morgue/internal/blackbox"
+	"github.com/zawachte/morgue/internal/collector"
+	"github.com/zawachte/morgue/internal/kernelevents"
+	"github.com/zawachte/morgue/internal/schedule"
+	"github.com/zawachte/morgue/internal/storagedriver"
+	"github.com/zawachte/morgue/internal/tsdb"
+	"github.com/zawachte/morgue/pkg/hostidentity"
+	"github.com/zawachte/morgue/pkg/influx"
+	"github.com/zawachte/morgue/pkg/telegraf"
+	"gopkg.in/yaml.v3"
+)
+
+const envPrefix = "MORGUE_"
+
+// Duration wraps time.Duration so it can be written as "1h" in config files.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// Number is a float that can also be written as an integer in TOML files.
+type Number float64
+
+func (n *Number) UnmarshalTOML(value interface{}) error {
+	switch v := value.(type) {
+	case int64:
+		*n = Number(v)
+	case float64:
+		*n = Number(v)
+	default:
+		return fmt.Errorf("expected a number but got %v", value)
+	}
+
+	return nil
+}
+
+// Config mirrors the morgue command line flags. Flags and MORGUE_* environment
+// variables take precedence over values read from a config file.
+type Config struct {
+	// TSDB is the database morgue collects into, influxdb2, victoriametrics
+	// or lite.
+	TSDB            string `toml:"tsdb" yaml:"tsdb"`
+	ServiceMode     bool   `toml:"service_mode" yaml:"service_mode"`
+	Reset           bool   `toml:"reset" yaml:"reset"`
+	UnixSocket      string `toml:"unix_socket" yaml:"unix_socket"`
+	CredentialsFile string `toml:"credentials_file" yaml:"credentials_file"`
+	// GlobalTags are added to every metric, on top of the detected host
+	// identity unless DetectHostIdentity is off.
+	GlobalTags         map[string]string `toml:"global_tags" yaml:"global_tags"`
+	DetectHostIdentity bool              `toml:"detect_host_identity" yaml:"detect_host_identity"`
+
+	InfluxD         InfluxDConfig         `toml:"influxd" yaml:"influxd"`
+	VictoriaMetrics VictoriaMetricsConfig `toml:"victoriametrics" yaml:"victoriametrics"`
+	Lite            LiteConfig            `toml:"lite" yaml:"lite"`
+	Telegraf        TelegrafConfig        `toml:"telegraf" yaml:"telegraf"`
+	Backup          BackupConfig          `toml:"backup" yaml:"backup"`
+	Storage         StorageConfig         `toml:"storage" yaml:"storage"`
+	Prometheus      PrometheusConfig      `toml:"prometheus" yaml:"prometheus"`
+	Logs            LogsConfig            `toml:"logs" yaml:"logs"`
+	Buckets         []BucketConfig        `toml:"buckets" yaml:"buckets"`
+
+	KernelEvents KernelEventsConfig `toml:"kernel_events" yaml:"kernel_events"`
+	BlackBox     BlackBoxConfig     `toml:"black_box" yaml:"black_box"`
+	Recovery     RecoveryConfig     `toml:"recovery" yaml:"recovery"`
+	Triggers     TriggersConfig     `toml:"triggers" yaml:"triggers"`
+}
+
+// TriggersConfig starts emergency backups on resource pressure. A zero
+// threshold disables its trigger.
+type TriggersConfig struct {
+	CheckInterval Duration `toml:"check_interval" yaml:"check_interval"`
+	// Cooldown is the minimum time between two triggered backups.
+	Cooldown Duration `toml:"cooldown" yaml:"cooldown"`
+	// CPUPressure, MemoryPressure and IOPressure are thresholds for the
+	// "some" avg10 percentage in /proc/pressure.
+	CPUPressure     Number   `toml:"cpu_pressure" yaml:"cpu_pressure"`
+	MemoryPressure  Number   `toml:"memory_pressure" yaml:"memory_pressure"`
+	IOPressure      Number   `toml:"io_pressure" yaml:"io_pressure"`
+	DiskPath        string   `toml:"disk_path" yaml:"disk_path"`
+	DiskUsedPercent Number   `toml:"disk_used_percent" yaml:"disk_used_percent"`
+	LoadPerCPU      Number   `toml:"load_per_cpu" yaml:"load_per_cpu"`
+	LoadDuration    Duration `toml:"load_duration" yaml:"load_duration"`
+	// Flux maps a name to a query against the local influxd that triggers a
+	// backup when it returns any rows.
+	Flux map[string]string `toml:"flux" yaml:"flux"`
+}
+
+// RecoveryConfig uploads a copy of the local data first thing on start when
+// the previous run didn't stop cleanly, found by a marker file it removes on
+// shutdown.
+type RecoveryConfig struct {
+	Enabled bool `toml:"enabled" yaml:"enabled"`
+	// MarkerPath defaults to /var/lib/morgue/morgue.pid in service mode and
+	// ~/.morgue/morgue.pid otherwise. It must survive a reboot.
+	MarkerPath string `toml:"marker_path" yaml:"marker_path"`
+}
+
+// BlackBoxConfig keeps the last minutes of samples at a high resolution in
+// a ring file. It is uploaded as its own archive on shutdown, when a backup
+// is triggered and on the next start after an unclean stop.
+type BlackBoxConfig struct {
+	Enabled bool `toml:"enabled" yaml:"enabled"`
+	// Path defaults to /var/lib/morgue/blackbox.ring in service mode and
+	// ~/.morgue/blackbox.ring otherwise.
+	Path string `toml:"path" yaml:"path"`
+	// SizeBytes caps the ring, the oldest samples make room for new ones.
+	SizeBytes int64    `toml:"size_bytes" yaml:"size_bytes"`
+	Interval  Duration `toml:"interval" yaml:"interval"`
+	// Window is how far back an upload reaches.
+	Window         Duration `toml:"window" yaml:"window"`
+	DisabledInputs []string `toml:"disabled_inputs" yaml:"disabled_inputs"`
+}
+
+// KernelEventsConfig controls the recorder for OOM kills, lockups, panics and
+// machine check errors.
+type KernelEventsConfig struct {
+	Enabled bool `toml:"enabled" yaml:"enabled"`
+	// Source is /dev/kmsg or a file kernel messages are appended to.
+	Source string `toml:"source" yaml:"source"`
+	// BackupOnSevere starts a backup as soon as a severe event is seen.
+	BackupOnSevere bool `toml:"backup_on_severe" yaml:"backup_on_severe"`
+}
+
+// LogsConfig enables collecting logs into their own bucket, backed up
+// together with the metrics.
+type LogsConfig struct {
+	// Source is journald or syslog, empty disables log collection.
+	Source       string   `toml:"source" yaml:"source"`
+	SyslogServer string   `toml:"syslog_server" yaml:"syslog_server"`
+	Bucket       string   `toml:"bucket" yaml:"bucket"`
+	Retention    Duration `toml:"retention" yaml:"retention"`
+}
+
+// BucketConfig is a bucket morgue creates besides the metrics and logs
+// buckets. Entries named after those only change how they are backed up,
+// their retention stays set by influxd.retention and logs.retention.
+type BucketConfig struct {
+	Name      string   `toml:"name" yaml:"name"`
+	Retention Duration `toml:"retention" yaml:"retention"`
+	// Backup is include or exclude.
+	Backup string `toml:"backup" yaml:"backup"`
+	// BackupFrequency backs the bucket up into its own archives on this
+	// interval instead of with the scheduled backup.
+	BackupFrequency Duration `toml:"backup_frequency" yaml:"backup_frequency"`
+}
+
+// PrometheusConfig selects the prometheus endpoints telegraf scrapes.
+type PrometheusConfig struct {
+	// ScrapeSelf adds morgue's own /metrics endpoint.
+	ScrapeSelf              bool     `toml:"scrape_self" yaml:"scrape_self"`
+	Urls                    []string `toml:"urls" yaml:"urls"`
+	TargetsFile             string   `toml:"targets_file" yaml:"targets_file"`
+	KubernetesPods          bool     `toml:"kubernetes_pods" yaml:"kubernetes_pods"`
+	KubernetesNodeIP        string   `toml:"kubernetes_node_ip" yaml:"kubernetes_node_ip"`
+	KubernetesLabelSelector string   `toml:"kubernetes_label_selector" yaml:"kubernetes_label_selector"`
+}
+
+type InfluxDConfig struct {
+	// Mode is managed, to run and onboard influxd, or external, to back up
+	// an existing instance.
+	Mode      string   `toml:"mode" yaml:"mode"`
+	Location  string   `toml:"location" yaml:"location"`
+	Retention Duration `toml:"retention" yaml:"retention"`
+
+	External ExternalInfluxDConfig `toml:"external" yaml:"external"`
+}
+
+type VictoriaMetricsConfig struct {
+	Location string `toml:"location" yaml:"location"`
+	// DataPath defaults to where the packages or an embedded
+	// victoria-metrics store their data.
+	DataPath  string   `toml:"data_path" yaml:"data_path"`
+	Retention Duration `toml:"retention" yaml:"retention"`
+}
+
+// LiteConfig configures the store of lite mode, which collects metrics
+// without influxd or telegraf and appends them to local line protocol
+// segments.
+type LiteConfig struct {
+	// DataPath defaults to /var/lib/morgue/lite in service mode and
+	// ~/.morgue/lite otherwise.
+	DataPath        string   `toml:"data_path" yaml:"data_path"`
+	Retention       Duration `toml:"retention" yaml:"retention"`
+	SegmentDuration Duration `toml:"segment_duration" yaml:"segment_duration"`
+}
+
+// ExternalInfluxDConfig points morgue at an existing influxd. morgue never
+// onboards it or changes its buckets.
+type ExternalInfluxDConfig struct {
+	URL string `toml:"url" yaml:"url"`
+	// Token must be an operator token, influxd requires one for backups.
+	// TokenFile is read instead when set.
+	Token     string `toml:"token" yaml:"token"`
+	TokenFile string `toml:"token_file" yaml:"token_file"`
+	Org       string `toml:"org" yaml:"org"`
+	// Buckets are backed up, telegraf writes to the first one.
+	Buckets []string `toml:"buckets" yaml:"buckets"`
+	// ManageTelegraf still runs telegraf, writing to the external influxd.
+	ManageTelegraf bool `toml:"manage_telegraf" yaml:"manage_telegraf"`
+}
+
+type TelegrafConfig struct {
+	Location        string      `toml:"location" yaml:"location"`
+	ScrapeFrequency Duration    `toml:"scrape_frequency" yaml:"scrape_frequency"`
+	Agent           AgentConfig `toml:"agent" yaml:"agent"`
+	// DisabledInputs removes inputs from the defaults morgue collects.
+	DisabledInputs []string `toml:"disabled_inputs" yaml:"disabled_inputs"`
+	// Inputs, Processors and Aggregators are passed to telegraf as is, keyed
+	// by plugin name.
+	Inputs      map[string]interface{} `toml:"inputs" yaml:"inputs"`
+	Processors  map[string]interface{} `toml:"processors" yaml:"processors"`
+	Aggregators map[string]interface{} `toml:"aggregators" yaml:"aggregators"`
+}
+
+// AgentConfig holds the telegraf agent settings. The collection interval is
+// set by telegraf.scrape_frequency.
+type AgentConfig struct {
+	RoundInterval     bool     `toml:"round_interval" yaml:"round_interval"`
+	MetricBatchSize   int      `toml:"metric_batch_size" yaml:"metric_batch_size"`
+	MetricBufferLimit int      `toml:"metric_buffer_limit" yaml:"metric_buffer_limit"`
+	CollectionJitter  Duration `toml:"collection_jitter" yaml:"collection_jitter"`
+	FlushInterval     Duration `toml:"flush_interval" yaml:"flush_interval"`
+	FlushJitter       Duration `toml:"flush_jitter" yaml:"flush_jitter"`
+	Precision         Duration `toml:"precision" yaml:"precision"`
+	Hostname          string   `toml:"hostname" yaml:"hostname"`
+	OmitHostname      bool     `toml:"omit_hostname" yaml:"omit_hostname"`
+}
+
+type BackupConfig struct {
+	Frequency Duration `toml:"frequency" yaml:"frequency"`
+	Path      string   `toml:"path" yaml:"path"`
+	// Schedule is a cron expression that replaces Frequency when set.
+	Schedule string `toml:"schedule" yaml:"schedule"`
+	// Align runs Frequency based backups on wall-clock multiples of it.
+	Align bool `toml:"align" yaml:"align"`
+	// Splay delays every backup by a random duration below it.
+	Splay Duration `toml:"splay" yaml:"splay"`
+	// MaintenanceWindows are daily HH:MM-HH:MM ranges in local time during
+	// which backups are postponed until the window ends.
+	MaintenanceWindows []string `toml:"maintenance_windows" yaml:"maintenance_windows"`
+	// ReservePercent of the filesystem holding Path is kept free while a
+	// backup is staged.
+	ReservePercent Number `toml:"reserve_percent" yaml:"reserve_percent"`
+	// LowSpace is degrade or skip: what to do when staging a backup would
+	// eat into the reserve.
+	LowSpace string `toml:"low_space" yaml:"low_space"`
+	// Streaming pipes the backup straight into the upload instead of
+	// staging it and a tar copy of it on disk.
+	Streaming bool `toml:"streaming" yaml:"streaming"`
+	// Compression is none or gzip, only for streamed backups.
+	Compression string `toml:"compression" yaml:"compression"`
+	// EncryptCommand is run with sh -c to encrypt streamed backups from its
+	// stdin to its stdout.
+	EncryptCommand string `toml:"encrypt_command" yaml:"encrypt_command"`
+}
+
+type StorageConfig struct {
+	Driver string `toml:"driver" yaml:"driver"`
+	// KeyPrefixTags names the global tags whose values, in order, prefix the
+	// object key of every backup.
+	KeyPrefixTags []string    `toml:"key_prefix_tags" yaml:"key_prefix_tags"`
+	AWS           AWSConfig   `toml:"aws" yaml:"aws"`
+	Local         LocalConfig `toml:"local" yaml:"local"`
+	// Targets replace Driver and AWS with a list of destinations every
+	// backup is uploaded to.
+	Targets []StorageTargetConfig `toml:"targets" yaml:"targets"`
+	// Success is all, any or quorum: how many of the targets that don't
+	// ignore failures must accept a backup for it to succeed.
+	Success   string          `toml:"success" yaml:"success"`
+	Bandwidth BandwidthConfig `toml:"bandwidth" yaml:"bandwidth"`
+	Metered   MeteredConfig   `toml:"metered" yaml:"metered"`
+}
+
+// BandwidthConfig limits the upload bandwidth shared by all targets, 0 is
+// unlimited.
+type BandwidthConfig struct {
+	BytesPerSecond int64 `toml:"bytes_per_second" yaml:"bytes_per_second"`
+	// Windows override BytesPerSecond during daily HH:MM-HH:MM ranges in
+	// local time, the first matching window wins.
+	Windows []BandwidthWindowConfig `toml:"windows" yaml:"windows"`
+}
+
+type BandwidthWindowConfig struct {
+	Window         string `toml:"window" yaml:"window"`
+	BytesPerSecond int64  `toml:"bytes_per_second" yaml:"bytes_per_second"`
+}
+
+// MeteredConfig defers uploads while the link is expensive.
+type MeteredConfig struct {
+	NetworkManager bool `toml:"network_manager" yaml:"network_manager"`
+	// CheckCommand is run with sh -c, exiting with status 0 means the link
+	// is expensive.
+	CheckCommand  string   `toml:"check_command" yaml:"check_command"`
+	CheckInterval Duration `toml:"check_interval" yaml:"check_interval"`
+}
+
+type StorageTargetConfig struct {
+	Name   string `toml:"name" yaml:"name"`
+	Driver string `toml:"driver" yaml:"driver"`
+	// Retention deletes this target's backups older than it, 0 keeps them
+	// forever.
+	Retention Duration `toml:"retention" yaml:"retention"`
+	Retries   int      `toml:"retries" yaml:"retries"`
+	// OnFailure is fail or ignore, ignored targets don't count towards
+	// Success.
+	OnFailure string      `toml:"on_failure" yaml:"on_failure"`
+	AWS       AWSConfig   `toml:"aws" yaml:"aws"`
+	Local     LocalConfig `toml:"local" yaml:"local"`
+}
+
+// LocalConfig keeps backups in a directory, with one subdirectory per host
+// named after the key prefix.
+type LocalConfig struct {
+	// Path defaults to the archive directory below backup.path.
+	Path string `toml:"path" yaml:"path"`
+	// RequireMount only writes to Path while something is mounted on it,
+	// for USB drives and NFS shares.
+	RequireMount bool `toml:"require_mount" yaml:"require_mount"`
+}
+
+type AWSConfig struct {
+	Region string `toml:"region" yaml:"region"`
+	Bucket string `toml:"bucket" yaml:"bucket"`
+}
+
+// defaults returns the values of settings that have no flag.
+func defaults() Config {
+	agent := telegraf.DefaultAgentConfig()
+
+	return Config{
+		DetectHostIdentity: true,
+		VictoriaMetrics: VictoriaMetricsConfig{
+			Location:  "/usr/local/bin/victoria-metrics-prod",
+			Retention: Duration(30 * 24 * time.Hour),
+		},
+		Lite: LiteConfig{
+			Retention:       Duration(24 * time.Hour),
+			SegmentDuration: Duration(time.Hour),
+		},
+		InfluxD: InfluxDConfig{
+			Mode: "managed",
+			External: ExternalInfluxDConfig{
+				ManageTelegraf: true,
+			},
+		},
+		Backup: BackupConfig{
+			ReservePercent: 10,
+			LowSpace:       "degrade",
+			Compression:    "none",
+		},
+		Prometheus: PrometheusConfig{
+			ScrapeSelf: true,
+		},
+		KernelEvents: KernelEventsConfig{
+			Enabled:        true,
+			Source:         kernelevents.DefaultSource,
+			BackupOnSevere: true,
+		},
+		Recovery: RecoveryConfig{
+			Enabled: true,
+		},
+		BlackBox: BlackBoxConfig{
+			SizeBytes: 16 * 1024 * 1024,
+			Interval:  Duration(time.Second),
+			Window:    Duration(10 * time.Minute),
+		},
+		Triggers: TriggersConfig{
+			CheckInterval: Duration(10 * time.Second),
+			Cooldown:      Duration(15 * time.Minute),
+			DiskPath:      "/",
+			LoadDuration:  Duration(5 * time.Minute),
+		},
+		Logs: LogsConfig{
+			SyslogServer: "udp://127.0.0.1:6514",
+			Bucket:       influx.LogsBucketName,
+			Retention:    Duration(24 * time.Hour),
+		},
+		Storage: StorageConfig{
+			KeyPrefixTags: []string{"site", "cluster", hostidentity.TagNode},
+			Success:       storagedriver.SuccessAll,
+			Metered: MeteredConfig{
+				CheckInterval: Duration(time.Minute),
+			},
+		},
+		Telegraf: TelegrafConfig{
+			Agent: AgentConfig{
+				RoundInterval:     agent.RoundInterval,
+				MetricBatchSize:   agent.MetricBatchSize,
+				MetricBufferLimit: agent.MetricBufferLimit,
+				CollectionJitter:  Duration(agent.CollectionJitter),
+				FlushInterval:     Duration(agent.FlushInterval),
+				FlushJitter:       Duration(agent.FlushJitter),
+				Precision:         Duration(agent.Precision),
+				Hostname:          agent.Hostname,
+				OmitHostname:      agent.OmitHostname,
+			},
+		},
+	}
+}
+
+// Load decodes the file at path into cfg, leaving fields the file doesn't set
+// untouched. The format is picked from the file extension.
+func Load(path string, cfg *Config) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		md, err := toml.Decode(string(data), cfg)
+		if err != nil {
+			return errors.Wrapf(err, "unable to parse %s", path)
+		}
+
+		for _, key := range md.Undecoded() {
+			if !isPassthroughKey(key) {
+				return fmt.Errorf("%s: unknown key %q", path, key.String())
+			}
+		}
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(cfg); err != nil {
+			return errors.Wrapf(err, "unable to parse %s", path)
+		}
+	default:
+		return fmt.Errorf("%s: unsupported config format, use .toml or .yaml", path)
+	}
+
+	return nil
+}
+
+// Apply merges the config file at path into cfg. cfg must already be bound to
+// fs and fs parsed; flags set on the command line win, then MORGUE_* env vars,
+// then the file, then the flag defaults. Apply can be called again to reload
+// the file. If the result is invalid cfg is left as it was.
+func Apply(fs *pflag.FlagSet, path string, cfg *Config) error {
+	previous := *cfg
+
+	err := apply(fs, path, cfg)
+	if err != nil {
+		*cfg = previous
+		return err
+	}
+
+	return nil
+}
+
+func apply(fs *pflag.FlagSet, path string, cfg *Config) error {
+	changed := map[string]string{}
+	fs.Visit(func(f *pflag.Flag) {
+		changed[f.Name] = f.Value.String()
+	})
+
+	// start over from the defaults so keys removed from the file on a
+	// reload don't keep their old values
+	*cfg = defaults()
+	fs.VisitAll(func(f *pflag.Flag) {
+		if _, ok := changed[f.Name]; !ok {
+			_ = f.Value.Set(f.DefValue)
+		}
+	})
+
+	if path != "" {
+		if err := Load(path, cfg); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	fs.VisitAll(func(f *pflag.Flag) {
+		if err != nil {
+			return
+		}
+
+		if value, ok := changed[f.Name]; ok {
+			err = fs.Set(f.Name, value)
+			return
+		}
+
+		env := envName(f.Name)
+		if value, ok := os.LookupEnv(env); ok {
+			if setErr := fs.Set(f.Name, value); setErr != nil {
+				err = errors.Wrapf(setErr, "invalid value for %s", env)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	return cfg.Validate()
+}
+
+// Validate checks the config for values morgue can't run with. Errors name
+// the offending config key.
+func (c *Config) Validate() error {
+	if c.InfluxD.Retention < 0 {
+		return errors.New("influxd.retention: must not be negative")
+	}
+
+	switch c.TSDB {
+	case tsdb.BackendInfluxDB2:
+	case tsdb.BackendVictoriaMetrics:
+		if err := c.validateVictoriaMetrics(); err != nil {
+			return err
+		}
+	case tsdb.BackendLite:
+		if err := c.validateLite(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("tsdb: unknown database %q, must be one of [influxdb2, victoriametrics, lite]", c.TSDB)
+	}
+
+	switch c.InfluxD.Mode {
+	case "managed":
+	case "external":
+		if err := c.validateExternal(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("influxd.mode: unknown mode %q, must be one of [managed, external]", c.InfluxD.Mode)
+	}
+
+	if c.Backup.Frequency <= 0 {
+		return errors.New("backup.frequency: must be greater than zero")
+	}
+
+	if c.Backup.Schedule != "" {
+		if _, err := schedule.ParseCron(c.Backup.Schedule); err != nil {
+			return errors.Wrap(err, "backup.schedule")
+		}
+	}
+
+	if c.Backup.Splay < 0 {
+		return errors.New("backup.splay: must not be negative")
+	}
+
+	for i, window := range c.Backup.MaintenanceWindows {
+		if _, err := schedule.ParseWindow(window); err != nil {
+			return errors.Wrapf(err, "backup.maintenance_windows[%d]", i)
+		}
+	}
+
+	if c.Telegraf.ScrapeFrequency <= 0 {
+		return errors.New("telegraf.scrape_frequency: must be greater than zero")
+	}
+
+	if c.Telegraf.Agent.FlushInterval <= 0 {
+		return errors.New("telegraf.agent.flush_interval: must be greater than zero")
+	}
+
+	if c.Telegraf.Agent.CollectionJitter < 0 {
+		return errors.New("telegraf.agent.collection_jitter: must not be negative")
+	}
+
+	if c.Telegraf.Agent.FlushJitter < 0 {
+		return errors.New("telegraf.agent.flush_jitter: must not be negative")
+	}
+
+	if c.Telegraf.Agent.Precision < 0 {
+		return errors.New("telegraf.agent.precision: must not be negative")
+	}
+
+	if c.Telegraf.Agent.MetricBatchSize <= 0 {
+		return errors.New("telegraf.agent.metric_batch_size: must be greater than zero")
+	}
+
+	if c.Telegraf.Agent.MetricBufferLimit < c.Telegraf.Agent.MetricBatchSize {
+		return errors.New("telegraf.agent.metric_buffer_limit: must be at least telegraf.agent.metric_batch_size")
+	}
+
+	for section, plugins := range map[string]map[string]interface{}{
+		"telegraf.inputs":      c.Telegraf.Inputs,
+		"telegraf.processors":  c.Telegraf.Processors,
+		"telegraf.aggregators": c.Telegraf.Aggregators,
+	} {
+		for name, plugin := range plugins {
+			if !isPluginTable(plugin) {
+				return fmt.Errorf("%s.%s: must be a table or a list of tables", section, name)
+			}
+		}
+	}
+
+	for key, value := range c.GlobalTags {
+		if key == "" {
+			return errors.New("global_tags: tag names must not be empty")
+		}
+		if value == "" {
+			return fmt.Errorf("global_tags.%s: must not be empty", key)
+		}
+	}
+
+	for i, rawURL := range c.Prometheus.Urls {
+		u, err := url.Parse(rawURL)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("prometheus.urls[%d]: %q is not a valid url", i, rawURL)
+		}
+	}
+
+	if c.Prometheus.TargetsFile != "" {
+		if _, err := os.Stat(c.Prometheus.TargetsFile); err != nil {
+			return errors.Wrap(err, "prometheus.targets_file")
+		}
+	}
+
+	switch c.Logs.Source {
+	case "", telegraf.LogSourceJournald:
+	case telegraf.LogSourceSyslog:
+		if c.Logs.SyslogServer == "" {
+			return errors.New("logs.syslog_server: required when logs.source is syslog")
+		}
+	default:
+		return fmt.Errorf("logs.source: unknown source %q, must be one of [journald, syslog]", c.Logs.Source)
+	}
+
+	if c.Logs.Source != "" {
+		if c.Logs.Bucket == "" || c.Logs.Bucket == influx.DefaultBucketName {
+			return fmt.Errorf("logs.bucket: must be set and differ from %q", influx.DefaultBucketName)
+		}
+
+		if c.Logs.Retention != 0 && c.Logs.Retention < Duration(time.Hour) {
+			return errors.New("logs.retention: must be at least 1h, or 0 to keep logs forever")
+		}
+	}
+
+	seen := map[string]bool{}
+	for i, bucket := range c.Buckets {
+		key := fmt.Sprintf("buckets[%d]", i)
+		if bucket.Name == "" {
+			return fmt.Errorf("%s.name: must not be empty", key)
+		}
+		if strings.ContainsAny(bucket.Name, "/\"") {
+			return fmt.Errorf("%s.name: %q must not contain / or \"", key, bucket.Name)
+		}
+		if strings.HasPrefix(bucket.Name, "_") {
+			return fmt.Errorf("%s.name: %q is reserved by influxd", key, bucket.Name)
+		}
+		if seen[bucket.Name] {
+			return fmt.Errorf("%s.name: bucket %q is listed twice", key, bucket.Name)
+		}
+		seen[bucket.Name] = true
+
+		builtin := bucket.Name == influx.DefaultBucketName || (c.Logs.Source != "" && bucket.Name == c.Logs.Bucket)
+		if builtin && bucket.Retention != 0 {
+			return fmt.Errorf("%s.retention: the retention of %q is set by influxd.retention or logs.retention", key, bucket.Name)
+		}
+		if bucket.Retention != 0 && bucket.Retention < Duration(time.Hour) {
+			return fmt.Errorf("%s.retention: must be at least 1h, or 0 to keep data forever", key)
+		}
+
+		switch bucket.Backup {
+		case "", "include", "exclude":
+		default:
+			return fmt.Errorf("%s.backup: unknown value %q, must be one of [include, exclude]", key, bucket.Backup)
+		}
+
+		if bucket.BackupFrequency < 0 {
+			return fmt.Errorf("%s.backup_frequency: must not be negative", key)
+		}
+		if bucket.BackupFrequency != 0 && bucket.Backup == "exclude" {
+			return fmt.Errorf("%s.backup_frequency: can't be set for an excluded bucket", key)
+		}
+	}
+
+	if c.KernelEvents.Enabled && c.KernelEvents.Source == "" {
+		return errors.New("kernel_events.source: required when kernel_events.enabled is true")
+	}
+
+	if c.BlackBox.Enabled {
+		if err := c.validateBlackBox(); err != nil {
+			return err
+		}
+	}
+
+	if c.Triggers.CheckInterval <= 0 {
+		return errors.New("triggers.check_interval: must be greater than zero")
+	}
+
+	if c.Triggers.Cooldown < 0 {
+		return errors.New("triggers.cooldown: must not be negative")
+	}
+
+	for key, value := range map[string]Number{
+		"triggers.cpu_pressure":      c.Triggers.CPUPressure,
+		"triggers.memory_pressure":   c.Triggers.MemoryPressure,
+		"triggers.io_pressure":       c.Triggers.IOPressure,
+		"triggers.disk_used_percent": c.Triggers.DiskUsedPercent,
+	} {
+		if value < 0 || value > 100 {
+			return fmt.Errorf("%s: must be a percentage between 0 and 100", key)
+		}
+	}
+
+	if c.Triggers.DiskUsedPercent > 0 && c.Triggers.DiskPath == "" {
+		return errors.New("triggers.disk_path: required when triggers.disk_used_percent is set")
+	}
+
+	if c.Triggers.LoadPerCPU < 0 {
+		return errors.New("triggers.load_per_cpu: must not be negative")
+	}
+
+	for name, query := range c.Triggers.Flux {
+		if strings.TrimSpace(query) == "" {
+			return fmt.Errorf("triggers.flux.%s: query must not be empty", name)
+		}
+	}
+
+	if c.Backup.Path == "" {
+		return errors.New("backup.path: must not be empty")
+	}
+
+	if c.Backup.ReservePercent < 0 || c.Backup.ReservePercent >= 100 {
+		return errors.New("backup.reserve_percent: must be a percentage between 0 and 100")
+	}
+
+	switch c.Backup.LowSpace {
+	case "degrade", "skip":
+	default:
+		return fmt.Errorf("backup.low_space: unknown action %q, must be one of [degrade, skip]", c.Backup.LowSpace)
+	}
+
+	switch c.Backup.Compression {
+	case "none":
+	case "gzip":
+		if !c.Backup.Streaming {
+			return errors.New("backup.compression: requires backup.streaming")
+		}
+	default:
+		return fmt.Errorf("backup.compression: unknown compression %q, must be one of [none, gzip]", c.Backup.Compression)
+	}
+
+	if c.Backup.EncryptCommand != "" && !c.Backup.Streaming {
+		return errors.New("backup.encrypt_command: requires backup.streaming")
+	}
+
+	switch c.Storage.Success {
+	case storagedriver.SuccessAll, storagedriver.SuccessAny, storagedriver.SuccessQuorum:
+	default:
+		return fmt.Errorf("storage.success: unknown policy %q, must be one of [all, any, quorum]", c.Storage.Success)
+	}
+
+	if c.Storage.Bandwidth.BytesPerSecond < 0 {
+		return errors.New("storage.bandwidth.bytes_per_second: must not be negative")
+	}
+
+	for i, window := range c.Storage.Bandwidth.Windows {
+		if _, err := schedule.ParseWindow(window.Window); err != nil {
+			return errors.Wrapf(err, "storage.bandwidth.windows[%d].window", i)
+		}
+		if window.BytesPerSecond < 0 {
+			return fmt.Errorf("storage.bandwidth.windows[%d].bytes_per_second: must not be negative", i)
+		}
+	}
+
+	if c.Storage.Metered.CheckInterval <= 0 {
+		return errors.New("storage.metered.check_interval: must be greater than zero")
+	}
+
+	if len(c.Storage.Targets) == 0 {
+		return validateDriver("storage", c.Storage.Driver, c.Storage.AWS, c.Storage.Local)
+	}
+
+	names := map[string]bool{}
+	for i, target := range c.Storage.Targets {
+		key := fmt.Sprintf("storage.targets[%d]", i)
+
+		if target.Name == "" {
+			return fmt.Errorf("%s.name: must not be empty", key)
+		}
+		if names[target.Name] {
+			return fmt.Errorf("%s.name: duplicate target %q", key, target.Name)
+		}
+		names[target.Name] = true
+
+		if err := validateDriver(key, target.Driver, target.AWS, target.Local); err != nil {
+			return err
+		}
+
+		if target.Retention < 0 {
+			return fmt.Errorf("%s.retention: must not be negative", key)
+		}
+
+		if target.Retries < 0 {
+			return fmt.Errorf("%s.retries: must not be negative", key)
+		}
+
+		switch target.OnFailure {
+		case "", "fail", "ignore":
+		default:
+			return fmt.Errorf("%s.on_failure: unknown policy %q, must be one of [fail, ignore]", key, target.OnFailure)
+		}
+	}
+
+	return nil
+}
+
+// validateVictoriaMetrics rejects the settings only influxdb2 supports.
+func (c *Config) validateVictoriaMetrics() error {
+	if c.VictoriaMetrics.Location == "" && !c.ServiceMode {
+		return errors.New("victoriametrics.location: required unless service_mode is set")
+	}
+
+	if c.VictoriaMetrics.Retention < Duration(24*time.Hour) {
+		return errors.New("victoriametrics.retention: must be at least 24h")
+	}
+
+	if c.InfluxD.Mode != "managed" {
+		return errors.New("influxd.mode: external mode needs tsdb influxdb2")
+	}
+
+	if c.Logs.Source != "" {
+		return errors.New("logs.source: log collection needs tsdb influxdb2")
+	}
+
+	if len(c.Buckets) > 0 {
+		return errors.New("buckets: buckets need tsdb influxdb2")
+	}
+
+	if c.Backup.Streaming {
+		return errors.New("backup.streaming: streaming backups need tsdb influxdb2")
+	}
+
+	return nil
+}
+
+func (c *Config) validateBlackBox() error {
+	if c.BlackBox.SizeBytes < blackbox.MinSize {
+		return fmt.Errorf("black_box.size_bytes: must be at least %d", blackbox.MinSize)
+	}
+
+	if c.BlackBox.Interval <= 0 {
+		return errors.New("black_box.interval: must be greater than zero")
+	}
+
+	if c.BlackBox.Window < c.BlackBox.Interval {
+		return errors.New("black_box.window: must be at least black_box.interval")
+	}
+
+	for i, name := range c.BlackBox.DisabledInputs {
+		known := false
+		for _, input := range collector.Inputs {
+			known = known || input == name
+		}
+		if !known {
+			return fmt.Errorf("black_box.disabled_inputs[%d]: unknown input %q, must be one of [%s]", i, name, strings.Join(collector.Inputs, ", "))
+		}
+	}
+
+	return nil
+}
+
+// validateLite rejects the settings that need a database or telegraf.
+func (c *Config) validateLite() error {
+	if c.Lite.SegmentDuration < Duration(time.Minute) {
+		return errors.New("lite.segment_duration: must be at least 1m")
+	}
+
+	if c.Lite.Retention < c.Lite.SegmentDuration {
+		return errors.New("lite.retention: must be at least lite.segment_duration")
+	}
+
+	if c.InfluxD.Mode != "managed" {
+		return errors.New("influxd.mode: external mode needs tsdb influxdb2")
+	}
+
+	if c.Logs.Source != "" {
+		return errors.New("logs.source: log collection needs tsdb influxdb2")
+	}
+
+	if len(c.Buckets) > 0 {
+		return errors.New("buckets: buckets need tsdb influxdb2")
+	}
+
+	if c.Backup.Streaming {
+		return errors.New("backup.streaming: streaming backups need tsdb influxdb2")
+	}
+
+	if len(c.Triggers.Flux) > 0 {
+		return errors.New("triggers.flux: query triggers need a database, lite mode can't run queries")
+	}
+
+	if len(c.Prometheus.Urls) > 0 || c.Prometheus.TargetsFile != "" || c.Prometheus.KubernetesPods {
+		return errors.New("prometheus: scraping prometheus endpoints needs telegraf, which lite mode doesn't run")
+	}
+
+	for section, plugins := range map[string]map[string]interface{}{
+		"telegraf.inputs":      c.Telegraf.Inputs,
+		"telegraf.processors":  c.Telegraf.Processors,
+		"telegraf.aggregators": c.Telegraf.Aggregators,
+	} {
+		if len(plugins) > 0 {
+			return fmt.Errorf("%s: telegraf plugins need a tsdb other than lite", section)
+		}
+	}
+
+	return nil
+}
+
+func (c *Config) validateExternal() error {
+	external := c.InfluxD.External
+
+	u, err := url.Parse(external.URL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("influxd.external.url: %q is not a valid url", external.URL)
+	}
+
+	if external.Token == "" && external.TokenFile == "" {
+		return errors.New("influxd.external.token: token or token_file is required in external mode")
+	}
+
+	if external.Org == "" {
+		return errors.New("influxd.external.org: required in external mode")
+	}
+
+	if len(external.Buckets) == 0 {
+		return errors.New("influxd.external.buckets: at least one bucket is required in external mode")
+	}
+
+	for i, bucket := range external.Buckets {
+		if bucket == "" {
+			return fmt.Errorf("influxd.external.buckets[%d]: must not be empty", i)
+		}
+	}
+
+	if c.Reset {
+		return errors.New("reset: can't be used in external mode, morgue doesn't own the influxd data")
+	}
+
+	if c.Logs.Source != "" && !external.ManageTelegraf {
+		return errors.New("logs.source: logs are collected by telegraf, set influxd.external.manage_telegraf")
+	}
+
+	for i, bucket := range c.Buckets {
+		if bucket.Retention != 0 {
+			return fmt.Errorf("buckets[%d].retention: morgue doesn't change the buckets of an external influxd", i)
+		}
+	}
+
+	return nil
+}
+
+// validateDriver checks the driver settings found under key.
+func validateDriver(key, driver string, aws AWSConfig, local LocalConfig) error {
+	switch driver {
+	case "local":
+		if local.RequireMount && local.Path == "" {
+			return fmt.Errorf("%s.local.path: required when %s.local.require_mount is true", key, key)
+		}
+	case "aws":
+		if aws.Bucket == "" {
+			return fmt.Errorf("%s.aws.bucket: required when %s.driver is aws", key, key)
+		}
+		if aws.Region == "" {
+			return fmt.Errorf("%s.aws.region: required when %s.driver is aws", key, key)
+		}
+	default:
+		return fmt.Errorf("%s.driver: unknown driver %q, must be one of [local, aws]", key, driver)
+	}
+
+	return nil
+}
+
+// passthroughSections are decoded into untyped maps, so the toml decoder
+// reports every key below them as undecoded.
+var passthroughSections = []string{
+	"telegraf.inputs",
+	"telegraf.processors",
+	"telegraf.aggregators",
+}
+
+func isPassthroughKey(key toml.Key) bool {
+	if len(key) < 2 {
+		return false
+	}
+
+	section := key[0] + "." + key[1]
+	for _, passthrough := range passthroughSections {
+		if section == passthrough {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isPluginTable(plugin interface{}) bool {
+	switch p := plugin.(type) {
+	case map[string]interface{}:
+		return true
+	case []map[string]interface{}:
+		return true
+	case []interface{}:
+		for _, instance := range p {
+			if _, ok := instance.(map[string]interface{}); !ok {
+				return false
+			}
+		}
+		return true
+	}
+
+	return false
+}
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
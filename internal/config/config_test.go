@@ -0,0 +1,208 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// newFlagSet binds the flags Apply merges in to cfg, like main does.
+func newFlagSet(cfg *Config) *pflag.FlagSet {
+	fs := pflag.NewFlagSet("morgue", pflag.ContinueOnError)
+	fs.StringVar(&cfg.TSDB, "tsdb", "influxdb2", "")
+	fs.DurationVar((*time.Duration)(&cfg.InfluxD.Retention), "retention", 6*time.Hour, "")
+	fs.DurationVar((*time.Duration)(&cfg.Backup.Frequency), "backup-frequency", time.Hour, "")
+	fs.DurationVar((*time.Duration)(&cfg.Telegraf.ScrapeFrequency), "metrics-scrape-frequency", 20*time.Second, "")
+	fs.StringVar(&cfg.Backup.Path, "backup-path", ".", "")
+	fs.StringVar(&cfg.Storage.Driver, "storage-driver", "local", "")
+	fs.StringVar(&cfg.Storage.AWS.Region, "aws-region", "us-east-1", "")
+	fs.StringVar(&cfg.Storage.AWS.Bucket, "aws-s3-bucket", "", "")
+
+	return fs
+}
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "morgue.toml")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// validConfig returns the config of morgue started without a file or flags.
+func validConfig(t *testing.T) Config {
+	t.Helper()
+
+	cfg := Config{}
+	fs := newFlagSet(&cfg)
+	if err := fs.Parse(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := Apply(fs, "", &cfg); err != nil {
+		t.Fatalf("default config is invalid: %v", err)
+	}
+
+	return cfg
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(*Config)
+		wantErr string
+	}{
+		{"defaults", func(*Config) {}, ""},
+		{"unknown tsdb", func(c *Config) { c.TSDB = "prometheus" }, "tsdb: unknown database"},
+		{"zero frequency", func(c *Config) { c.Backup.Frequency = 0 }, "backup.frequency"},
+		{"cron schedule", func(c *Config) { c.Backup.Schedule = "0 3 * * 1-5" }, ""},
+		{"invalid cron schedule", func(c *Config) { c.Backup.Schedule = "0 25 * * *" }, "backup.schedule"},
+		{"cron schedule never fires", func(c *Config) { c.Backup.Schedule = "0 0 30 2 *" }, "backup.schedule"},
+		{"maintenance window", func(c *Config) { c.Backup.MaintenanceWindows = []string{"22:00-02:00"} }, ""},
+		{"invalid maintenance window", func(c *Config) { c.Backup.MaintenanceWindows = []string{"22:00"} }, "backup.maintenance_windows[0]"},
+		{"negative splay", func(c *Config) { c.Backup.Splay = -1 }, "backup.splay"},
+		{"empty backup path", func(c *Config) { c.Backup.Path = "" }, "backup.path"},
+		{"gzip without streaming", func(c *Config) { c.Backup.Compression = "gzip" }, "backup.compression: requires backup.streaming"},
+		{"unknown low space action", func(c *Config) { c.Backup.LowSpace = "panic" }, "backup.low_space"},
+		{"empty global tag", func(c *Config) { c.GlobalTags = map[string]string{"site": ""} }, "global_tags.site"},
+		{"reserved bucket name", func(c *Config) { c.Buckets = []BucketConfig{{Name: "_monitoring"}} }, "buckets[0].name"},
+		{"invalid bandwidth window", func(c *Config) {
+			c.Storage.Bandwidth.Windows = []BandwidthWindowConfig{{Window: "8-17"}}
+		}, "storage.bandwidth.windows[0].window"},
+		{"duplicate target", func(c *Config) {
+			c.Storage.Targets = []StorageTargetConfig{
+				{Name: "usb", Driver: "local"},
+				{Name: "usb", Driver: "local"},
+			}
+		}, "storage.targets[1].name"},
+		{"trigger above 100 percent", func(c *Config) { c.Triggers.CPUPressure = 101 }, "triggers.cpu_pressure"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := validConfig(t)
+			tt.change(&cfg)
+
+			err := cfg.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Validate() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Validate() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestApplyPrecedence(t *testing.T) {
+	tests := []struct {
+		name string
+		flag string
+		env  string
+		file string
+		want time.Duration
+	}{
+		{"default", "", "", "", time.Hour},
+		{"file", "", "", "2h", 2 * time.Hour},
+		{"env over file", "", "3h", "2h", 3 * time.Hour},
+		{"flag over env", "4h", "3h", "2h", 4 * time.Hour},
+		{"flag over file", "4h", "", "2h", 4 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Config{}
+			fs := newFlagSet(&cfg)
+
+			args := []string{}
+			if tt.flag != "" {
+				args = append(args, "--backup-frequency="+tt.flag)
+			}
+			if err := fs.Parse(args); err != nil {
+				t.Fatal(err)
+			}
+			if tt.env != "" {
+				t.Setenv("MORGUE_BACKUP_FREQUENCY", tt.env)
+			}
+			path := ""
+			if tt.file != "" {
+				path = writeConfig(t, "[backup]\nfrequency = \""+tt.file+"\"\n")
+			}
+
+			if err := Apply(fs, path, &cfg); err != nil {
+				t.Fatal(err)
+			}
+			if got := time.Duration(cfg.Backup.Frequency); got != tt.want {
+				t.Errorf("backup frequency is %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyInvalidEnv(t *testing.T) {
+	cfg := Config{}
+	fs := newFlagSet(&cfg)
+	if err := fs.Parse(nil); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("MORGUE_BACKUP_FREQUENCY", "hourly")
+
+	err := Apply(fs, "", &cfg)
+	if err == nil || !strings.Contains(err.Error(), "MORGUE_BACKUP_FREQUENCY") {
+		t.Errorf("Apply() = %v, want an error naming the env var", err)
+	}
+}
+
+func TestApplyReload(t *testing.T) {
+	cfg := Config{}
+	fs := newFlagSet(&cfg)
+	if err := fs.Parse(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	path := writeConfig(t, "[backup]\nfrequency = \"2h\"\nsplay = \"5m\"\n")
+	if err := Apply(fs, path, &cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	// an invalid file keeps the running config
+	if err := ioutil.WriteFile(path, []byte("[backup]\nfrequency = \"0s\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := Apply(fs, path, &cfg); err == nil {
+		t.Fatal("Apply of an invalid file succeeded, want an error")
+	}
+	if cfg.Backup.Frequency != Duration(2*time.Hour) || cfg.Backup.Splay != Duration(5*time.Minute) {
+		t.Errorf("config after a rejected reload is %v/%v, want 2h/5m", cfg.Backup.Frequency, cfg.Backup.Splay)
+	}
+
+	// keys removed from the file go back to their defaults
+	if err := ioutil.WriteFile(path, []byte("[backup]\nfrequency = \"3h\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := Apply(fs, path, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Backup.Frequency != Duration(3*time.Hour) || cfg.Backup.Splay != 0 {
+		t.Errorf("config after a reload is %v/%v, want 3h/0s", cfg.Backup.Frequency, cfg.Backup.Splay)
+	}
+}
+
+func TestLoadUnknownKey(t *testing.T) {
+	path := writeConfig(t, "[backup]\nfrequncy = \"2h\"\n")
+
+	cfg := Config{}
+	err := Load(path, &cfg)
+	if err == nil || !strings.Contains(err.Error(), "backup.frequncy") {
+		t.Errorf("Load() = %v, want an error naming the unknown key", err)
+	}
+}
@@ -0,0 +1,105 @@
+// Package control serves the control API of a running morgue on a unix
+// socket, for what can't wait for a restart or a SIGHUP.
+package control
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// RotateCredentialsPath replaces the influxd token morgue uses, on POST.
+const RotateCredentialsPath = "/credentials/rotate"
+
+// Controller is what the control API acts on, runner.Runner implements it.
+type Controller interface {
+	RotateCredentials() error
+}
+
+// Server accepts control requests on a unix socket only its owner can use.
+type Server interface {
+	// Serve blocks until ctx is done, then removes the socket.
+	Serve(ctx context.Context) error
+}
+
+type ServerParams struct {
+	// Path is the unix socket to listen on, a stale one is replaced.
+	Path       string
+	Controller Controller
+	Logger     zap.Logger
+}
+
+type server struct {
+	path       string
+	controller Controller
+	logger     zap.Logger
+}
+
+func NewServer(params ServerParams) Server {
+	return &server{
+		path:       params.Path,
+		controller: params.Controller,
+		logger:     params.Logger,
+	}
+}
+
+func (s *server) Serve(ctx context.Context) error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+
+	// a socket left by a morgue that was killed would fail the listen
+	if info, err := os.Lstat(s.path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(s.path); err != nil {
+			return errors.Wrap(err, "unable to remove stale control socket")
+		}
+	}
+
+	listener, err := net.Listen("unix", s.path)
+	if err != nil {
+		return errors.Wrap(err, "unable to listen on control socket")
+	}
+	defer os.Remove(s.path)
+
+	if err := os.Chmod(s.path, 0600); err != nil {
+		listener.Close()
+		return errors.Wrap(err, "unable to restrict control socket")
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(RotateCredentialsPath, s.rotateCredentials)
+	httpServer := &http.Server{Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		httpServer.Close()
+	}()
+
+	err = httpServer.Serve(listener)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+
+	return err
+}
+
+func (s *server) rotateCredentials(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := s.controller.RotateCredentials(); err != nil {
+		s.logger.Warn(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,92 @@
+package control
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+type fakeController struct {
+	rotations int
+	err       error
+}
+
+func (c *fakeController) RotateCredentials() error {
+	c.rotations++
+	return c.err
+}
+
+func TestRotateCredentials(t *testing.T) {
+	tests := []struct {
+		name          string
+		method        string
+		err           error
+		wantStatus    int
+		wantRotations int
+		wantBody      string
+	}{
+		{"rotated", http.MethodPost, nil, http.StatusNoContent, 1, ""},
+		{"failed", http.MethodPost, errors.New("influxd is down"), http.StatusInternalServerError, 1, "influxd is down"},
+		{"wrong method", http.MethodGet, nil, http.StatusMethodNotAllowed, 0, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "run", "morgue.sock")
+			controller := &fakeController{err: tt.err}
+			server := NewServer(ServerParams{Path: path, Controller: controller, Logger: *zap.NewNop()})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() {
+				done <- server.Serve(ctx)
+			}()
+			defer func() {
+				cancel()
+				if err := <-done; err != nil {
+					t.Errorf("Serve() = %v, want nil", err)
+				}
+			}()
+
+			client := &http.Client{Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, "unix", path)
+				},
+			}}
+
+			var resp *http.Response
+			var err error
+			for i := 0; i < 100; i++ {
+				req, _ := http.NewRequest(tt.method, "http://morgue"+RotateCredentialsPath, nil)
+				resp, err = client.Do(req)
+				if err == nil {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status is %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if !strings.Contains(string(body), tt.wantBody) {
+				t.Errorf("body is %q, want it to contain %q", body, tt.wantBody)
+			}
+			if controller.rotations != tt.wantRotations {
+				t.Errorf("rotated %d times, want %d", controller.rotations, tt.wantRotations)
+			}
+		})
+	}
+}
@@ -0,0 +1,219 @@
+package credentials
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+)
+
+const (
+	// StatePath is where the credentials are kept in service mode.
+	StatePath = "/var/lib/morgue/credentials.toml"
+
+	// systemdCredentialsEnv is set by systemd when the unit uses LoadCredential=.
+	systemdCredentialsEnv = "CREDENTIALS_DIRECTORY"
+	systemdCredentialName = "morgue"
+	// systemdStateEnv is set by systemd when the unit uses StateDirectory=.
+	systemdStateEnv = "STATE_DIRECTORY"
+	fileName        = "credentials.toml"
+
+	tokenBytes    = 48
+	passwordBytes = 24
+)
+
+// Credentials are the secrets used to talk to the local influxd.
+type Credentials struct {
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+	Token    string `toml:"token"`
+	Org      string `toml:"org"`
+	Bucket   string `toml:"bucket"`
+}
+
+// GenerateSecret returns a url safe string built from n bytes of crypto/rand.
+func GenerateSecret(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// Generate returns fresh credentials for onboarding.
+func Generate(username, org, bucket string) (*Credentials, error) {
+	token, err := GenerateSecret(tokenBytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to generate token")
+	}
+
+	password, err := GenerateSecret(passwordBytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to generate password")
+	}
+
+	return &Credentials{
+		Username: username,
+		Password: password,
+		Token:    token,
+		Org:      org,
+		Bucket:   bucket,
+	}, nil
+}
+
+// SetDefaults fills in any identity fields left empty.
+func (c *Credentials) SetDefaults(username, org, bucket string) {
+	if c.Username == "" {
+		c.Username = username
+	}
+	if c.Org == "" {
+		c.Org = org
+	}
+	if c.Bucket == "" {
+		c.Bucket = bucket
+	}
+}
+
+// SystemdPath returns the path of the credential passed in by systemd, or an
+// empty string when morgue was not started with LoadCredential=.
+func SystemdPath() string {
+	dir := os.Getenv(systemdCredentialsEnv)
+	if dir == "" {
+		return ""
+	}
+
+	return filepath.Join(dir, systemdCredentialName)
+}
+
+// DefaultPath returns where the credentials are kept when no path is
+// configured: the state directory systemd passes in, StatePath in service
+// mode and ~/.morgue otherwise.
+func DefaultPath(serviceMode bool) (string, error) {
+	// systemd may pass several directories separated by colons
+	if dir := strings.Split(os.Getenv(systemdStateEnv), ":")[0]; dir != "" {
+		return filepath.Join(dir, fileName), nil
+	}
+
+	if serviceMode {
+		return StatePath, nil
+	}
+
+	dirname, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dirname, ".morgue", fileName), nil
+}
+
+// Authorizer manages the tokens influxd accepts, influx_cli.Client
+// implements it.
+type Authorizer interface {
+	// CopyAuthorization creates a token with the permissions of token.
+	CopyAuthorization(token string) (string, error)
+	// DeleteAuthorization makes influxd reject token.
+	DeleteAuthorization(token string) error
+}
+
+// Rotate replaces the token of the credentials at path with a new one with
+// the same permissions. The new token is saved before the old one is
+// deleted, so the file always holds a token influxd accepts.
+func Rotate(path string, authorizer Authorizer) (*Credentials, error) {
+	creds, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
+	if creds == nil || creds.Token == "" {
+		return nil, errors.Errorf("no token found in %s", path)
+	}
+
+	oldToken := creds.Token
+	token, err := authorizer.CopyAuthorization(oldToken)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create token")
+	}
+
+	creds.Token = token
+	if err := Save(path, creds); err != nil {
+		if deleteErr := authorizer.DeleteAuthorization(token); deleteErr != nil {
+			err = errors.Wrapf(err, "new token left behind: %s", deleteErr.Error())
+		}
+		return nil, errors.Wrap(err, "unable to save credentials")
+	}
+
+	if err := authorizer.DeleteAuthorization(oldToken); err != nil {
+		return creds, errors.Wrap(err, "new token saved but the old one is still valid")
+	}
+
+	return creds, nil
+}
+
+// Load reads credentials from path. It returns nil credentials and no error
+// when path is empty or the file does not exist.
+func Load(path string) (*Credentials, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	creds := &Credentials{}
+	if _, err := toml.Decode(string(data), creds); err != nil {
+		return nil, errors.Wrapf(err, "unable to parse credentials file %s", path)
+	}
+
+	return creds, nil
+}
+
+// Save atomically writes credentials to path, readable only by the owner.
+func Save(path string, creds *Credentials) error {
+	buf := new(bytes.Buffer)
+	if err := toml.NewEncoder(buf).Encode(creds); err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, ".credentials-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
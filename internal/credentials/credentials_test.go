@@ -0,0 +1,99 @@
+package credentials
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// fakeAuthorizer hands out numbered tokens and tracks which are valid.
+type fakeAuthorizer struct {
+	valid     map[string]bool
+	created   int
+	copyErr   error
+	deleteErr error
+}
+
+func (a *fakeAuthorizer) CopyAuthorization(token string) (string, error) {
+	if a.copyErr != nil {
+		return "", a.copyErr
+	}
+	if !a.valid[token] {
+		return "", errors.New("unknown token")
+	}
+
+	a.created++
+	copied := "token-" + string(rune('0'+a.created))
+	a.valid[copied] = true
+
+	return copied, nil
+}
+
+func (a *fakeAuthorizer) DeleteAuthorization(token string) error {
+	if a.deleteErr != nil {
+		return a.deleteErr
+	}
+
+	delete(a.valid, token)
+	return nil
+}
+
+func TestRotate(t *testing.T) {
+	tests := []struct {
+		name      string
+		copyErr   error
+		deleteErr error
+		wantErr   bool
+		wantToken string
+		wantValid []string
+	}{
+		{"rotated", nil, nil, false, "token-1", []string{"token-1"}},
+		{"copy fails", errors.New("unauthorized"), nil, true, "token-0", []string{"token-0"}},
+		{"revoke fails", nil, errors.New("unavailable"), true, "token-1", []string{"token-0", "token-1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "credentials.toml")
+			err := Save(path, &Credentials{Username: "admin", Token: "token-0", Org: "morgue"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			authorizer := &fakeAuthorizer{
+				valid:     map[string]bool{"token-0": true},
+				copyErr:   tt.copyErr,
+				deleteErr: tt.deleteErr,
+			}
+
+			_, err = Rotate(path, authorizer)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Rotate() = %v, want error %v", err, tt.wantErr)
+			}
+
+			saved, err := Load(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if saved.Token != tt.wantToken || saved.Username != "admin" || saved.Org != "morgue" {
+				t.Errorf("saved credentials are %+v, want token %s and the rest kept", saved, tt.wantToken)
+			}
+			// the saved token always stays valid
+			if !authorizer.valid[saved.Token] {
+				t.Errorf("saved token %s is revoked", saved.Token)
+			}
+			if len(authorizer.valid) != len(tt.wantValid) {
+				t.Errorf("valid tokens are %v, want %v", authorizer.valid, tt.wantValid)
+			}
+		})
+	}
+}
+
+func TestRotateWithoutCredentials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials.toml")
+
+	if _, err := Rotate(path, &fakeAuthorizer{valid: map[string]bool{}}); err == nil {
+		t.Error("Rotate without a credentials file succeeded, want an error")
+	}
+}
@@ -0,0 +1,261 @@
+package kernelevents
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/zawachte/morgue/internal/tsdb"
+	"github.com/zawachte/morgue/pkg/influx"
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultSource = "/dev/kmsg"
+
+	Measurement = "kernel_events"
+
+	KindOOMKill    = "oom_kill"
+	KindHungTask   = "hung_task"
+	KindSoftLockup = "soft_lockup"
+	KindHardLockup = "hard_lockup"
+	KindPanic      = "panic"
+	KindMCE        = "mce"
+)
+
+const (
+	// pollInterval is how long to wait for new lines when the source is a
+	// regular file that has reached its end.
+	pollInterval = time.Second
+	// oomWindow is how long the messages of one OOM kill are taken for the
+	// same event. The kernel logs an oom-kill: line and a Killed process
+	// line for every victim.
+	oomWindow = time.Minute
+)
+
+type Event struct {
+	Kind    string
+	Severe  bool
+	Message string
+	// PID is the process an OOM kill killed, 0 when unknown.
+	PID  int
+	Time time.Time
+}
+
+type matcher struct {
+	kind    string
+	severe  bool
+	pattern *regexp.Regexp
+}
+
+var matchers = []matcher{
+	{KindPanic, true, regexp.MustCompile(`Kernel panic - not syncing`)},
+	{KindOOMKill, true, regexp.MustCompile(`Out of memory: Kill|oom-kill:|Memory cgroup out of memory`)},
+	{KindHardLockup, true, regexp.MustCompile(`Watchdog detected hard LOCKUP`)},
+	{KindSoftLockup, true, regexp.MustCompile(`soft lockup - CPU#\d+ stuck`)},
+	{KindMCE, true, regexp.MustCompile(`mce: \[Hardware Error\]`)},
+	// logged for corrected errors too, so it isn't severe
+	{KindMCE, false, regexp.MustCompile(`Machine check events logged`)},
+	{KindHungTask, false, regexp.MustCompile(`blocked for more than \d+ seconds`)},
+}
+
+// oomVictim finds the killed process in the oom-kill: and Killed process
+// lines.
+var oomVictim = regexp.MustCompile(`(?:,pid=|Kill(?:ed)? process )(\d+)`)
+
+// Match returns the event a kernel log message describes, if any.
+func Match(message string) (Event, bool) {
+	for _, m := range matchers {
+		if m.pattern.MatchString(message) {
+			event := Event{
+				Kind:    m.kind,
+				Severe:  m.severe,
+				Message: message,
+			}
+
+			if m.kind == KindOOMKill {
+				if match := oomVictim.FindStringSubmatch(message); match != nil {
+					event.PID, _ = strconv.Atoi(match[1])
+				}
+			}
+
+			return event, true
+		}
+	}
+
+	return Event{}, false
+}
+
+// oomKills remembers recent OOM victims, so the lines logged for one kill
+// are recorded once.
+type oomKills map[int]time.Time
+
+// seen reports whether pid was killed within oomWindow of now, and
+// remembers it otherwise.
+func (k oomKills) seen(pid int, now time.Time) bool {
+	for victim, killed := range k {
+		if now.Sub(killed) > oomWindow {
+			delete(k, victim)
+		}
+	}
+
+	if _, ok := k[pid]; ok {
+		return true
+	}
+	k[pid] = now
+
+	return false
+}
+
+// parseKmsg strips the "priority,sequence,timestamp,flags;" header /dev/kmsg
+// puts in front of every record. Lines without it are returned as is, so plain
+// log files work as a source too.
+func parseKmsg(line string) string {
+	line = strings.TrimRight(line, "\n")
+
+	semicolon := strings.Index(line, ";")
+	if semicolon < 0 {
+		return line
+	}
+
+	header := strings.Split(line[:semicolon], ",")
+	if len(header) < 3 {
+		return line
+	}
+
+	return line[semicolon+1:]
+}
+
+type Recorder interface {
+	Run(context.Context) error
+}
+
+type RecorderParams struct {
+	// Source is /dev/kmsg or a file that kernel messages are appended to.
+	Source string
+	Tags   map[string]string
+	// DB stores the events in its metrics bucket.
+	DB tsdb.TSDB
+	// OnSevere is called for every severe event after it was written.
+	OnSevere func(Event)
+	Logger   zap.Logger
+}
+
+type recorder struct {
+	source   string
+	tags     map[string]string
+	db       tsdb.TSDB
+	onSevere func(Event)
+	logger   zap.Logger
+	oomKills oomKills
+}
+
+func NewRecorder(params RecorderParams) Recorder {
+	source := params.Source
+	if source == "" {
+		source = DefaultSource
+	}
+
+	return &recorder{
+		source:   source,
+		tags:     params.Tags,
+		db:       params.DB,
+		onSevere: params.OnSevere,
+		logger:   params.Logger,
+		oomKills: oomKills{},
+	}
+}
+
+// Run follows the source from its current end until ctx is done.
+func (r *recorder) Run(ctx context.Context) error {
+	file, err := os.Open(r.source)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	go func() {
+		<-ctx.Done()
+		file.Close()
+	}()
+
+	// only record what happens from now on, /dev/kmsg supports seeking to
+	// the end of its buffer as well
+	if _, err := file.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReaderSize(file, 8192)
+	partial := ""
+	for {
+		line, err := reader.ReadString('\n')
+		if err == nil {
+			r.handle(parseKmsg(partial + line))
+			partial = ""
+		} else if err == io.EOF {
+			// a regular file may end mid line, finish it on the next read
+			partial += line
+		}
+
+		switch {
+		case err == nil:
+		case errors.Is(err, syscall.EPIPE):
+			// records were overwritten before we read them, keep going
+		case err == io.EOF:
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(pollInterval):
+			}
+		default:
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+func (r *recorder) handle(message string) {
+	event, ok := Match(message)
+	if !ok {
+		return
+	}
+	event.Time = time.Now()
+
+	if event.Kind == KindOOMKill && event.PID != 0 && r.oomKills.seen(event.PID, event.Time) {
+		return
+	}
+
+	r.logger.Sugar().Warnw("kernel event", "kind", event.Kind, "message", event.Message)
+
+	tags := map[string]string{}
+	for key, value := range r.tags {
+		tags[key] = value
+	}
+	tags["kind"] = event.Kind
+	tags["severe"] = strconv.FormatBool(event.Severe)
+
+	fields := map[string]interface{}{
+		"message": event.Message,
+	}
+	if event.PID != 0 {
+		fields["pid"] = event.PID
+	}
+
+	err := r.db.Write([]string{influx.Line(Measurement, tags, fields, event.Time)})
+	if err != nil {
+		r.logger.Warn(err.Error())
+	}
+
+	if event.Severe && r.onSevere != nil {
+		r.onSevere(event)
+	}
+}
@@ -0,0 +1,154 @@
+package kernelevents
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		match   bool
+		kind    string
+		severe  bool
+		pid     int
+	}{
+		{
+			name:    "oom-kill line",
+			message: "oom-kill:constraint=CONSTRAINT_NONE,nodemask=(null),cpuset=/,mems_allowed=0,global_oom,task_memcg=/user.slice,task=stress,pid=4242,uid=1000",
+			match:   true,
+			kind:    KindOOMKill,
+			severe:  true,
+			pid:     4242,
+		},
+		{
+			name:    "killed process line",
+			message: "Out of memory: Killed process 4242 (stress) total-vm:8388608kB, anon-rss:8000000kB, file-rss:0kB",
+			match:   true,
+			kind:    KindOOMKill,
+			severe:  true,
+			pid:     4242,
+		},
+		{
+			name:    "older killed process line",
+			message: "Out of memory: Kill process 17 (java) score 900 or sacrifice child",
+			match:   true,
+			kind:    KindOOMKill,
+			severe:  true,
+			pid:     17,
+		},
+		{
+			name:    "memory cgroup",
+			message: "Memory cgroup out of memory: Killed process 99 (nginx) total-vm:1024kB",
+			match:   true,
+			kind:    KindOOMKill,
+			severe:  true,
+			pid:     99,
+		},
+		{
+			name:    "panic",
+			message: "Kernel panic - not syncing: Fatal exception",
+			match:   true,
+			kind:    KindPanic,
+			severe:  true,
+		},
+		{
+			name:    "soft lockup",
+			message: "watchdog: BUG: soft lockup - CPU#3 stuck for 23s! [kworker/3:1:123]",
+			match:   true,
+			kind:    KindSoftLockup,
+			severe:  true,
+		},
+		{
+			name:    "hard lockup",
+			message: "Watchdog detected hard LOCKUP on cpu 2",
+			match:   true,
+			kind:    KindHardLockup,
+			severe:  true,
+		},
+		{
+			name:    "hardware error",
+			message: "mce: [Hardware Error]: Machine check: Processor context corrupt",
+			match:   true,
+			kind:    KindMCE,
+			severe:  true,
+		},
+		{
+			name:    "corrected machine check",
+			message: "mce: 1 Machine check events logged",
+			match:   true,
+			kind:    KindMCE,
+			severe:  false,
+		},
+		{
+			name:    "hung task",
+			message: "INFO: task jbd2/sda1-8:312 blocked for more than 120 seconds.",
+			match:   true,
+			kind:    KindHungTask,
+			severe:  false,
+		},
+		{
+			name:    "unrelated",
+			message: "EXT4-fs (sda1): mounted filesystem with ordered data mode",
+			match:   false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event, ok := Match(tt.message)
+			if ok != tt.match {
+				t.Fatalf("Match() matched = %v, want %v", ok, tt.match)
+			}
+			if !ok {
+				return
+			}
+
+			if event.Kind != tt.kind || event.Severe != tt.severe || event.PID != tt.pid {
+				t.Errorf("Match() = %s severe %v pid %d, want %s severe %v pid %d",
+					event.Kind, event.Severe, event.PID, tt.kind, tt.severe, tt.pid)
+			}
+		})
+	}
+}
+
+func TestParseKmsg(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"6,1234,5678901,-;Out of memory: Killed process 1 (init)\n", "Out of memory: Killed process 1 (init)"},
+		{"plain line from a log file\n", "plain line from a log file"},
+		{"a;b", "a;b"},
+	}
+
+	for _, tt := range tests {
+		if got := parseKmsg(tt.line); got != tt.want {
+			t.Errorf("parseKmsg(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestOOMKillsSeen(t *testing.T) {
+	kills := oomKills{}
+	start := time.Now()
+
+	tests := []struct {
+		name string
+		pid  int
+		at   time.Time
+		seen bool
+	}{
+		{"first line of a kill", 10, start, false},
+		{"second line of the same kill", 10, start.Add(time.Millisecond), true},
+		{"another victim", 11, start.Add(time.Second), false},
+		{"same pid reused much later", 10, start.Add(2 * oomWindow), false},
+	}
+
+	for _, tt := range tests {
+		if got := kills.seen(tt.pid, tt.at); got != tt.seen {
+			t.Errorf("%s: seen() = %v, want %v", tt.name, got, tt.seen)
+		}
+	}
+}
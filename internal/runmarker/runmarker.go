@@ -0,0 +1,236 @@
+package runmarker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// SystemdPath is where the marker is kept in service mode. It must survive
+// a reboot, so it isn't below /run.
+const SystemdPath = "/var/lib/morgue/morgue.pid"
+
+// bootIDPath holds a random id the kernel picks on every boot.
+const bootIDPath = "/proc/sys/kernel/random/boot_id"
+
+// unset stands in for an empty field of the marker.
+const unset = "-"
+
+// DefaultPath returns where the marker is kept when morgue runs as the
+// current user.
+func DefaultPath() (string, error) {
+	dirname, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dirname, ".morgue", "morgue.pid"), nil
+}
+
+// Run describes the morgue that wrote a marker.
+type Run struct {
+	PID     int
+	Started time.Time
+	// BootID is the boot the run started in, empty when unknown.
+	BootID string
+	// Recovered is when the data of an unclean stop was last uploaded. It is
+	// carried over from run to run until one stops cleanly.
+	Recovered time.Time
+}
+
+// BootID returns the id of the current boot, empty when it can't be read.
+func BootID() string {
+	data, err := ioutil.ReadFile(bootIDPath)
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(data))
+}
+
+// Marker is a file holding the pid of the running morgue. It is only
+// removed on a clean shutdown, so finding it on start means the previous run
+// crashed, was killed or lost power. It stays locked while morgue runs, so a
+// second morgue can't take it over.
+type Marker interface {
+	// Unclean reports whether the previous run left the marker behind.
+	Unclean() bool
+	// Previous returns the run that left the marker behind.
+	Previous() Run
+	// RecordRecovery keeps when the data of the previous run was uploaded,
+	// so a run that stops uncleanly soon after doesn't upload it again.
+	RecordRecovery(recovered time.Time) error
+	// Release removes the marker on a clean shutdown.
+	Release() error
+}
+
+type marker struct {
+	path     string
+	unclean  bool
+	previous Run
+
+	// lock guards the file, a recovery may be recorded while morgue stops
+	lock sync.Mutex
+	file *os.File
+	run  Run
+}
+
+// Acquire locks the marker at path and writes the pid of this morgue to it.
+func Acquire(path string) (Marker, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	previous := parseRun(string(data))
+
+	if err := unix.Flock(int(file.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		file.Close()
+		if err == unix.EWOULDBLOCK {
+			return nil, errors.Errorf("morgue is already running with pid %d", previous.PID)
+		}
+		return nil, errors.Wrap(err, "unable to lock run marker")
+	}
+
+	m := &marker{
+		path:     path,
+		file:     file,
+		unclean:  len(data) > 0,
+		previous: previous,
+		run: Run{
+			PID:       os.Getpid(),
+			Started:   time.Now(),
+			BootID:    BootID(),
+			Recovered: previous.Recovered,
+		},
+	}
+
+	if err := m.write(m.run); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (m *marker) Unclean() bool {
+	return m.unclean
+}
+
+func (m *marker) Previous() Run {
+	return m.previous
+}
+
+func (m *marker) RecordRecovery(recovered time.Time) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.file == nil {
+		return errors.New("run marker is released")
+	}
+
+	run := m.run
+	run.Recovered = recovered
+	if err := m.write(run); err != nil {
+		return err
+	}
+	m.run = run
+
+	return nil
+}
+
+func (m *marker) Release() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.file == nil {
+		return nil
+	}
+
+	err := os.Remove(m.path)
+	if err == nil {
+		err = syncDir(filepath.Dir(m.path))
+	}
+	if errClose := m.file.Close(); err == nil {
+		err = errClose
+	}
+	m.file = nil
+
+	return err
+}
+
+// write replaces the content of the marker and syncs it, so it is found
+// after a power loss.
+func (m *marker) write(run Run) error {
+	if err := m.file.Truncate(0); err != nil {
+		return err
+	}
+
+	bootID := run.BootID
+	if bootID == "" {
+		bootID = unset
+	}
+	recovered := unset
+	if !run.Recovered.IsZero() {
+		recovered = run.Recovered.UTC().Format(time.RFC3339)
+	}
+
+	content := fmt.Sprintf("%d %s %s %s\n", run.PID, run.Started.UTC().Format(time.RFC3339), bootID, recovered)
+	if _, err := m.file.WriteAt([]byte(content), 0); err != nil {
+		return err
+	}
+
+	if err := m.file.Sync(); err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(m.path))
+}
+
+// parseRun reads "<pid> <started> <boot id> <recovered>", leaving out what
+// it can't parse. Markers of older versions end after started.
+func parseRun(content string) Run {
+	run := Run{}
+	fields := strings.Fields(content)
+	if len(fields) > 0 {
+		run.PID, _ = strconv.Atoi(fields[0])
+	}
+	if len(fields) > 1 {
+		run.Started, _ = time.Parse(time.RFC3339, fields[1])
+	}
+	if len(fields) > 2 && fields[2] != unset {
+		run.BootID = fields[2]
+	}
+	if len(fields) > 3 && fields[3] != unset {
+		run.Recovered, _ = time.Parse(time.RFC3339, fields[3])
+	}
+
+	return run
+}
+
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
@@ -0,0 +1,117 @@
+package runmarker
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseRun(t *testing.T) {
+	started := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	recovered := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		content string
+		want    Run
+	}{
+		{"empty", "", Run{}},
+		{"pid only", "42\n", Run{PID: 42}},
+		{"older version", "42 2024-03-01T12:00:00Z\n", Run{PID: 42, Started: started}},
+		{"never recovered", "42 2024-03-01T12:00:00Z abc - \n", Run{PID: 42, Started: started, BootID: "abc"}},
+		{"unknown boot", "42 2024-03-01T12:00:00Z - -\n", Run{PID: 42, Started: started}},
+		{"recovered", "42 2024-03-01T12:00:00Z abc 2024-03-01T12:30:00Z\n", Run{PID: 42, Started: started, BootID: "abc", Recovered: recovered}},
+		{"garbage", "pid started", Run{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseRun(tt.content)
+			if got.PID != tt.want.PID || !got.Started.Equal(tt.want.Started) ||
+				got.BootID != tt.want.BootID || !got.Recovered.Equal(tt.want.Recovered) {
+				t.Errorf("parseRun(%q) = %+v, want %+v", tt.content, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAcquire(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "morgue.pid")
+
+	m, err := Acquire(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Unclean() {
+		t.Error("first run is unclean, want clean")
+	}
+	if _, err := Acquire(path); err == nil {
+		t.Error("second Acquire of a held marker succeeded, want an error")
+	}
+	if err := m.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("marker still exists after Release: %v", err)
+	}
+
+	m, err = Acquire(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Release()
+	if m.Unclean() {
+		t.Error("run after a clean shutdown is unclean, want clean")
+	}
+}
+
+func TestAcquireUnclean(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "morgue.pid")
+	recovered := time.Now().Add(-time.Minute).Truncate(time.Second)
+
+	// a run that records a recovery and is then killed leaves the marker
+	m, err := Acquire(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.RecordRecovery(recovered); err != nil {
+		t.Fatal(err)
+	}
+	m.(*marker).file.Close()
+
+	m, err = Acquire(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.Unclean() {
+		t.Error("run after a kill is clean, want unclean")
+	}
+
+	previous := m.Previous()
+	if previous.PID != os.Getpid() {
+		t.Errorf("previous pid is %d, want %d", previous.PID, os.Getpid())
+	}
+	if previous.BootID != BootID() {
+		t.Errorf("previous boot id is %q, want %q", previous.BootID, BootID())
+	}
+	if !previous.Recovered.Equal(recovered) {
+		t.Errorf("previous recovery is %v, want %v", previous.Recovered, recovered)
+	}
+
+	// the recovery is carried over until a run stops cleanly
+	m.(*marker).file.Close()
+	m, err = Acquire(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.Previous().Recovered.Equal(recovered) {
+		t.Errorf("carried over recovery is %v, want %v", m.Previous().Recovered, recovered)
+	}
+	if err := m.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.RecordRecovery(time.Now()); err == nil {
+		t.Error("RecordRecovery on a released marker succeeded, want an error")
+	}
+}
@@ -0,0 +1,205 @@
+package runner
+
+import (
+	"context"
+	"path"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/zawachte/morgue/internal/blackbox"
+	"github.com/zawachte/morgue/internal/collector"
+	"github.com/zawachte/morgue/internal/storagedriver"
+	"github.com/zawachte/morgue/pkg/tarutils"
+)
+
+const (
+	// blackBoxName tells black box archives apart from backups.
+	blackBoxName = "blackbox"
+	blackBoxFile = "blackbox.lp"
+	// blackBoxRecoverInterval is the least time between two uploads of a
+	// ring left by an unclean stop, so a crash loop doesn't upload one
+	// every restart.
+	blackBoxRecoverInterval = time.Hour
+)
+
+// BlackBoxParams configure the black box, which keeps the last Window of
+// samples taken every Interval in a ring file of Size bytes. It is uploaded
+// on shutdown, when a backup is triggered and after an unclean stop.
+type BlackBoxParams struct {
+	Path           string
+	Size           int64
+	Interval       time.Duration
+	Window         time.Duration
+	DisabledInputs []string
+}
+
+func blackBoxPath(params RunnerParams) (string, error) {
+	if params.BlackBox.Path != "" {
+		return params.BlackBox.Path, nil
+	}
+
+	if params.ServiceMode {
+		return blackbox.SystemdPath, nil
+	}
+
+	return blackbox.DefaultPath()
+}
+
+// runBlackBox uploads the ring of a run that didn't stop cleanly, then
+// starts recording into a fresh one.
+func (r *runner) runBlackBox(params RunnerParams) error {
+	if params.BlackBox == nil {
+		return nil
+	}
+
+	ringPath, err := blackBoxPath(params)
+	if err != nil {
+		return err
+	}
+
+	unclean, err := blackbox.Unclean(ringPath)
+	if err != nil {
+		r.logger.Warn(errors.Wrap(err, "unable to read the black box of the last run").Error())
+	}
+
+	recovered, err := blackbox.Recovered(ringPath)
+	if err != nil {
+		r.logger.Warn(errors.Wrap(err, "unable to read the black box of the last run").Error())
+	}
+
+	switch {
+	case !unclean:
+	case time.Since(recovered) < blackBoxRecoverInterval:
+		r.logger.Sugar().Warnw("not uploading the black box of a run that didn't stop cleanly, one was uploaded recently", "uploaded", recovered)
+	default:
+		r.logger.Info("uploading the black box of a run that didn't stop cleanly")
+		err := r.storeBlackBox(func(path string) error {
+			return blackbox.Recover(ringPath, path, params.BlackBox.Window)
+		})
+		if err != nil {
+			r.logger.Warn(errors.Wrap(err, "unable to upload the black box of the last run").Error())
+		} else {
+			recovered = time.Now()
+		}
+	}
+
+	box, err := blackbox.NewRecorder(blackbox.RecorderParams{
+		Path:      ringPath,
+		Size:      params.BlackBox.Size,
+		Window:    params.BlackBox.Window,
+		Recovered: recovered,
+	})
+	if err != nil {
+		return errors.Wrap(err, "unable to create the black box")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	r.lock.Lock()
+	r.blackBox = box
+	r.stopBlackBox = cancel
+	r.lock.Unlock()
+
+	c := collector.NewCollector(collector.CollectorParams{
+		Interval:       params.BlackBox.Interval,
+		DisabledInputs: params.BlackBox.DisabledInputs,
+		Tags:           globalTags(params),
+		Hostname:       params.TelegrafAgent.Hostname,
+		OmitHostname:   params.TelegrafAgent.OmitHostname,
+		Output:         box,
+		Logger:         r.logger,
+	})
+	go c.Run(ctx)
+
+	return nil
+}
+
+// uploadBlackBox uploads the samples recorded so far, if the black box is
+// enabled.
+func (r *runner) uploadBlackBox(reason string) error {
+	r.lock.Lock()
+	box := r.blackBox
+	r.lock.Unlock()
+
+	if box == nil {
+		return nil
+	}
+
+	return r.storeBlackBox(func(path string) error {
+		return box.Dump(path, reason)
+	})
+}
+
+// storeBlackBox uploads what dump writes as its own archive, named like a
+// backup with a blackbox suffix.
+func (r *runner) storeBlackBox(dump func(path string) error) error {
+	storageDriver := r.getStorageDriver()
+	directoryName := time.Now().UTC().Format(storagedriver.BackupNameLayout) + "." + blackBoxName
+	backupPath := path.Join(storageDriver.GetLocalStorageLocation(), directoryName)
+
+	defer cleanupBackup(backupPath)
+
+	err := dump(path.Join(backupPath, blackBoxFile))
+	if err != nil {
+		return errors.Wrap(err, "unable to dump the black box")
+	}
+
+	err = tarutils.Tar(backupPath, storageDriver.GetLocalStorageLocation())
+	if err != nil {
+		return err
+	}
+
+	return storageDriver.UploadTar(directoryName + ".tar")
+}
+
+// discardBlackBox stops recording and closes the ring cleanly without
+// uploading it, after a failed start. The exit status already reports the
+// failure, and the next start would otherwise take it for an unclean stop.
+func (r *runner) discardBlackBox() {
+	r.lock.Lock()
+	box := r.blackBox
+	stop := r.stopBlackBox
+	r.blackBox = nil
+	r.lock.Unlock()
+
+	if box == nil {
+		return
+	}
+	stop()
+
+	err := box.Close(true)
+	if err != nil {
+		r.logger.Warn(errors.Wrap(err, "unable to close the black box").Error())
+	}
+}
+
+// shutdownBlackBox stops recording and uploads the black box. The ring is
+// only marked as cleanly closed once it was uploaded, otherwise the next
+// start uploads it again.
+func (r *runner) shutdownBlackBox(ctx context.Context) error {
+	r.lock.Lock()
+	box := r.blackBox
+	stop := r.stopBlackBox
+	r.lock.Unlock()
+
+	if box == nil {
+		return nil
+	}
+	stop()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- r.uploadBlackBox("shutdown")
+	}()
+
+	select {
+	case err := <-done:
+		if closeErr := box.Close(err == nil); err == nil {
+			err = closeErr
+		}
+		return err
+	case <-ctx.Done():
+		box.Close(false)
+		return errors.Wrap(ctx.Err(), "black box upload didn't finish before shutdown")
+	}
+}
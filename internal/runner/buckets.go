@@ -0,0 +1,160 @@
+package runner
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/zawachte/morgue/internal/schedule"
+	"github.com/zawachte/morgue/pkg/influx_cli"
+)
+
+// BucketParams configures a bucket besides the metrics and logs buckets.
+// Entries named after those only change how they are backed up.
+type BucketParams struct {
+	Name          string
+	Retention     time.Duration
+	ExcludeBackup bool
+	// BackupFrequency backs the bucket up into its own archives, 0 backs it
+	// up with the scheduled backup.
+	BackupFrequency time.Duration
+}
+
+// managedBuckets returns every bucket morgue creates, or backs up on an
+// external influxd, starting with the metrics and logs buckets.
+func managedBuckets(params RunnerParams) []BucketParams {
+	buckets := []BucketParams{{
+		Name:      metricsBucket(params),
+		Retention: params.Retention,
+	}}
+	if params.LogsInput.Source != "" {
+		buckets = append(buckets, BucketParams{
+			Name:      params.LogsInput.Bucket,
+			Retention: params.LogsRetention,
+		})
+	}
+
+	configured := params.Buckets
+	if params.External != nil {
+		external := []BucketParams{}
+		for _, name := range params.External.Buckets[1:] {
+			external = append(external, BucketParams{Name: name})
+		}
+		configured = append(external, configured...)
+	}
+
+	for _, bucket := range configured {
+		builtin := false
+		for i := range buckets {
+			if buckets[i].Name == bucket.Name {
+				buckets[i].ExcludeBackup = bucket.ExcludeBackup
+				buckets[i].BackupFrequency = bucket.BackupFrequency
+				builtin = true
+			}
+		}
+
+		if !builtin {
+			buckets = append(buckets, bucket)
+		}
+	}
+
+	return buckets
+}
+
+// ensureBuckets creates the managed buckets and brings their retention in
+// line with the config.
+func ensureBuckets(influxCli influx_cli.Client, params RunnerParams) error {
+	for _, bucket := range managedBuckets(params) {
+		err := influxCli.EnsureBucket(influx_cli.BucketParams{
+			Org:       influxOrg(params),
+			Name:      bucket.Name,
+			Retention: bucket.Retention,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "unable to create bucket %s", bucket.Name)
+		}
+	}
+
+	return nil
+}
+
+// backupJob selects what a backup covers.
+type backupJob struct {
+	// name is added to the archive name, empty for the scheduled backup.
+	name string
+	// buckets are backed up, empty backs up the whole org.
+	buckets []string
+}
+
+// scheduledBackupJob returns the buckets backed up on the backup schedule,
+// false if every bucket is excluded or has its own frequency.
+func scheduledBackupJob(params RunnerParams) (backupJob, bool) {
+	all := managedBuckets(params)
+
+	job := backupJob{}
+	for _, bucket := range all {
+		if bucket.ExcludeBackup || bucket.BackupFrequency != 0 {
+			continue
+		}
+		job.buckets = append(job.buckets, bucket.Name)
+	}
+
+	if len(job.buckets) == 0 {
+		return backupJob{}, false
+	}
+
+	// a whole org backup also keeps buckets created outside of morgue, which
+	// an external influxd isn't ours to back up
+	if params.External == nil && len(job.buckets) > 1 && len(job.buckets) == len(all) {
+		job.buckets = nil
+	}
+
+	return job, true
+}
+
+// runBucketBackups (re)starts a backup loop for every bucket with its own
+// backup frequency.
+func (r *runner) runBucketBackups(params RunnerParams) {
+	r.lock.Lock()
+	if r.stopBucketBackups != nil {
+		r.stopBucketBackups()
+		r.stopBucketBackups = nil
+	}
+	r.lock.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r.lock.Lock()
+	r.stopBucketBackups = cancel
+	r.lock.Unlock()
+
+	for _, bucket := range managedBuckets(params) {
+		if bucket.ExcludeBackup || bucket.BackupFrequency == 0 {
+			continue
+		}
+
+		job := backupJob{
+			name:    bucket.Name,
+			buckets: []string{bucket.Name},
+		}
+		go r.runBucketBackup(ctx, job, schedule.NewInterval(bucket.BackupFrequency, params.BackupAlign))
+	}
+}
+
+func (r *runner) runBucketBackup(ctx context.Context, job backupJob, bucketSchedule schedule.Schedule) {
+	next := bucketSchedule.Next(time.Now())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+		}
+
+		// backupAndStore holds the upload back during a maintenance window
+		err := r.backupAndStore(job)
+		if err != nil {
+			r.logger.Sugar().Warnw(err.Error(), "bucket", job.name)
+		}
+
+		next = bucketSchedule.Next(time.Now())
+	}
+}
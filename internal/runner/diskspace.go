@@ -0,0 +1,100 @@
+package runner
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/zawachte/morgue/pkg/diskspace"
+)
+
+const (
+	// LowSpaceDegrade tars the backup while removing the staged files, so
+	// it only needs room for one copy of the backup.
+	LowSpaceDegrade = "degrade"
+	// LowSpaceSkip skips the backup.
+	LowSpaceSkip = "skip"
+)
+
+type stagingMode int
+
+const (
+	stagingFull stagingMode = iota
+	stagingDegraded
+	stagingSkipped
+)
+
+// sizeMargin pads the estimated backup size for data written since it was
+// measured.
+const sizeMargin = 1.1
+
+var (
+	backupsSkipped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "morgue_backups_skipped_total",
+		Help: "Backups that were skipped, by reason.",
+	}, []string{"reason"})
+
+	backupsDegraded = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "morgue_backups_degraded_total",
+		Help: "Backups staged with less disk space than a full copy needs.",
+	})
+
+	estimatedBackupSize = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "morgue_backup_estimated_size_bytes",
+		Help: "Estimated size of the next backup.",
+	})
+)
+
+// estimateBackupSize returns the size of the last backup of job, or the size
+// of the stored data before the first one.
+func (r *runner) estimateBackupSize(job backupJob) (uint64, error) {
+	r.lock.Lock()
+	size := r.lastBackupSize[job.name]
+	r.lock.Unlock()
+
+	if size == 0 {
+		var err error
+		size, err = r.tsdb.DataSize()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return uint64(float64(size) * sizeMargin), nil
+}
+
+// planStaging checks that the backup fits in location while leaving the
+// reserve free. A full backup is staged twice, once as the backup directory
+// and once as its tar.
+func (r *runner) planStaging(location string, job backupJob, params RunnerParams) stagingMode {
+	estimate, err := r.estimateBackupSize(job)
+	if err != nil {
+		r.logger.Sugar().Warnw("unable to estimate the backup size, skipping the disk space check", "error", err.Error())
+		return stagingFull
+	}
+	estimatedBackupSize.Set(float64(estimate))
+
+	available, total, err := diskspace.Usage(location)
+	if err != nil {
+		r.logger.Sugar().Warnw("unable to read free disk space, skipping the disk space check", "error", err.Error())
+		return stagingFull
+	}
+
+	reserve := uint64(params.DiskReservePercent / 100 * float64(total))
+	fits := func(needed uint64) bool {
+		return available >= needed+reserve
+	}
+
+	switch {
+	case fits(2 * estimate):
+		return stagingFull
+	case params.LowSpaceAction == LowSpaceDegrade && fits(estimate):
+		r.logger.Sugar().Warnw("low disk space, removing staged files while archiving the backup",
+			"path", location, "available", available, "estimated", estimate, "reserve", reserve)
+		backupsDegraded.Inc()
+		return stagingDegraded
+	default:
+		r.logger.Sugar().Warnw("skipping backup, not enough disk space to stage it",
+			"path", location, "available", available, "estimated", estimate, "reserve", reserve)
+		backupsSkipped.WithLabelValues("disk_space").Inc()
+		return stagingSkipped
+	}
+}
@@ -0,0 +1,93 @@
+package runner
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/zawachte/morgue/internal/tsdb"
+	"github.com/zawachte/morgue/pkg/influx"
+	"github.com/zawachte/morgue/pkg/influx_cli"
+)
+
+// ExternalInfluxParams point morgue at an existing influxd. morgue neither
+// runs nor onboards it, and leaves its buckets alone.
+type ExternalInfluxParams struct {
+	URL string
+	// Token is read from TokenFile when that is set.
+	Token     string
+	TokenFile string
+	Org       string
+	// Buckets are backed up, telegraf writes to the first one.
+	Buckets        []string
+	ManageTelegraf bool
+}
+
+// resolveExternal returns a copy of params with the external token read
+// from its file.
+func resolveExternal(params RunnerParams) (RunnerParams, error) {
+	if params.External == nil {
+		return params, nil
+	}
+
+	external := *params.External
+	if external.TokenFile != "" {
+		data, err := ioutil.ReadFile(external.TokenFile)
+		if err != nil {
+			return params, errors.Wrap(err, "unable to read influxd token")
+		}
+		external.Token = strings.TrimSpace(string(data))
+	}
+	params.External = &external
+
+	return params, nil
+}
+
+// sameExternal reports whether two params point at the same influxd.
+func sameExternal(a, b RunnerParams) bool {
+	if a.External == nil || b.External == nil {
+		return a.External == b.External
+	}
+
+	return reflect.DeepEqual(*a.External, *b.External)
+}
+
+func influxOrg(params RunnerParams) string {
+	if params.External != nil {
+		return params.External.Org
+	}
+
+	return influx.DefaultOrgName
+}
+
+// metricsBucket returns the bucket telegraf and the kernel event recorder
+// write to.
+func metricsBucket(params RunnerParams) string {
+	if params.External != nil {
+		return params.External.Buckets[0]
+	}
+
+	return influx.DefaultBucketName
+}
+
+// managesTelegraf reports whether morgue runs telegraf, lite mode collects
+// with the built in collector instead.
+func managesTelegraf(params RunnerParams) bool {
+	if params.TSDB == tsdb.BackendLite {
+		return false
+	}
+
+	return params.External == nil || params.External.ManageTelegraf
+}
+
+// influxClient returns a client for the influxd morgue backs up, with the
+// token the database was set up with.
+func influxClient(db tsdb.TSDB) (influx_cli.Client, error) {
+	influxDB2, ok := db.(tsdb.InfluxDB2)
+	if !ok {
+		return nil, errors.New("only influxdb2 has an influx client")
+	}
+
+	return influxDB2.InfluxClient()
+}
@@ -0,0 +1,69 @@
+package runner
+
+import (
+	"context"
+	"time"
+
+	"github.com/zawachte/morgue/internal/collector"
+	"github.com/zawachte/morgue/internal/tsdb"
+)
+
+// LiteParams configure the store morgue collects into when TSDB is lite.
+type LiteParams struct {
+	DataPath        string
+	Retention       time.Duration
+	SegmentDuration time.Duration
+}
+
+func newLite(params RunnerParams) (tsdb.TSDB, error) {
+	dataPath := params.Lite.DataPath
+	if dataPath == "" {
+		dataPath = tsdb.LiteSystemdDataPath
+		if !params.ServiceMode {
+			var err error
+			dataPath, err = tsdb.LiteDataPath()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return tsdb.NewLite(tsdb.LiteParams{
+		DataPath:        dataPath,
+		Retention:       params.Lite.Retention,
+		SegmentDuration: params.Lite.SegmentDuration,
+		Reset:           params.Reset,
+		Logger:          params.Logger,
+	}), nil
+}
+
+// runCollector (re)starts the built in collector, which replaces telegraf in
+// lite mode. It uses the interval, disabled inputs and hostname of the
+// telegraf agent settings.
+func (r *runner) runCollector(params RunnerParams) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.stopCollector != nil {
+		r.stopCollector()
+		r.stopCollector = nil
+	}
+
+	if params.TSDB != tsdb.BackendLite {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r.stopCollector = cancel
+
+	c := collector.NewCollector(collector.CollectorParams{
+		Interval:       params.TelegrafAgent.Interval,
+		DisabledInputs: params.TelegrafPlugins.DisabledInputs,
+		Tags:           globalTags(params),
+		Hostname:       params.TelegrafAgent.Hostname,
+		OmitHostname:   params.TelegrafAgent.OmitHostname,
+		Output:         r.tsdb,
+		Logger:         r.logger,
+	})
+	go c.Run(ctx)
+}
@@ -0,0 +1,201 @@
+package runner
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/zawachte/morgue/internal/runmarker"
+	"github.com/zawachte/morgue/internal/storagedriver"
+	"github.com/zawachte/morgue/internal/tsdb"
+	"github.com/zawachte/morgue/pkg/tarutils"
+)
+
+const (
+	// recoveryName tags recovery archives in their key.
+	recoveryName  = "post-crash"
+	manifestFile  = "manifest.json"
+	dataDirectory = "data"
+	// recoveryInterval is the least time between two recovery backups within
+	// a boot, so a crash loop doesn't upload the data on every restart.
+	recoveryInterval = time.Hour
+)
+
+// RecoveryParams enable recovery backups. A marker file at MarkerPath tells
+// whether the previous run stopped cleanly.
+type RecoveryParams struct {
+	MarkerPath string
+}
+
+// recoveryManifest describes a recovery archive.
+type recoveryManifest struct {
+	Kind          string            `json:"kind"`
+	PostCrash     bool              `json:"post_crash"`
+	TSDB          string            `json:"tsdb"`
+	Created       time.Time         `json:"created"`
+	PreviousPID   int               `json:"previous_pid,omitempty"`
+	PreviousStart *time.Time        `json:"previous_start,omitempty"`
+	Tags          map[string]string `json:"tags,omitempty"`
+}
+
+func markerPath(params RunnerParams) (string, error) {
+	if params.Recovery.MarkerPath != "" {
+		return params.Recovery.MarkerPath, nil
+	}
+
+	if params.ServiceMode {
+		return runmarker.SystemdPath, nil
+	}
+
+	return runmarker.DefaultPath()
+}
+
+// runRecovery takes the run marker and, when the previous run didn't stop
+// cleanly, stages a copy of the data it left behind before anything can
+// change it. The copy is uploaded in the background, so a link that is
+// metered or slow doesn't hold back the start. Starting a reset is refused
+// while staging fails, the reset would delete the data for good.
+func (r *runner) runRecovery(params RunnerParams) error {
+	if params.Recovery == nil {
+		return nil
+	}
+
+	markerPath, err := markerPath(params)
+	if err != nil {
+		return err
+	}
+
+	marker, err := runmarker.Acquire(markerPath)
+	if err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	r.marker = marker
+	r.lock.Unlock()
+
+	if !marker.Unclean() {
+		return nil
+	}
+
+	previous := marker.Previous()
+
+	// a reset deletes the data for good, so it is always uploaded first
+	if !params.Reset && recentlyRecovered(previous) {
+		r.logger.Sugar().Warnw("previous run didn't stop cleanly, not uploading a recovery backup, one was uploaded recently",
+			"pid", previous.PID, "started", previous.Started, "uploaded", previous.Recovered)
+		return nil
+	}
+
+	r.logger.Sugar().Warnw("previous run didn't stop cleanly, uploading a recovery backup", "pid", previous.PID, "started", previous.Started)
+
+	storageDriver := r.getStorageDriver()
+	directoryName, err := r.stageRecovery(storageDriver, params, previous)
+	if errors.Cause(err) == tsdb.ErrNoLocalData {
+		r.logger.Info("no local data to recover")
+		return nil
+	}
+	if err != nil {
+		err = errors.Wrap(err, "unable to stage recovery backup")
+		if params.Reset {
+			// the marker is left behind, the next start retries staging
+			r.lock.Lock()
+			r.marker = nil
+			r.lock.Unlock()
+			return errors.Wrap(err, "refusing to reset")
+		}
+		r.logger.Warn(err.Error())
+		return nil
+	}
+
+	go r.uploadRecovery(storageDriver, directoryName, marker)
+
+	return nil
+}
+
+// uploadRecovery uploads a staged recovery archive and records it in the
+// marker.
+func (r *runner) uploadRecovery(storageDriver storagedriver.StorageDriver, directoryName string, marker runmarker.Marker) {
+	defer cleanupBackup(path.Join(storageDriver.GetLocalStorageLocation(), directoryName))
+
+	err := storageDriver.UploadTar(directoryName + ".tar")
+	if err != nil {
+		r.logger.Warn(errors.Wrap(err, "unable to upload recovery backup").Error())
+		return
+	}
+	r.logger.Info("uploaded recovery backup")
+
+	err = marker.RecordRecovery(time.Now())
+	if err != nil {
+		r.logger.Warn(errors.Wrap(err, "unable to record the recovery backup").Error())
+	}
+}
+
+// recentlyRecovered reports whether the data of previous was uploaded within
+// the recovery interval of the current boot. After a reboot it is always
+// uploaded, the host may have gone down for the same reason.
+func recentlyRecovered(previous runmarker.Run) bool {
+	if previous.Recovered.IsZero() || previous.BootID == "" || previous.BootID != runmarker.BootID() {
+		return false
+	}
+
+	return time.Since(previous.Recovered) < recoveryInterval
+}
+
+// stageRecovery tars a copy of the data files as they were left, with a
+// manifest, as its own archive and returns its name. It fails rather than
+// skips when there isn't room to stage the copy, so a reset isn't started.
+func (r *runner) stageRecovery(storageDriver storagedriver.StorageDriver, params RunnerParams, previous runmarker.Run) (string, error) {
+	directoryName := time.Now().UTC().Format(storagedriver.BackupNameLayout) + "." + recoveryName
+	backupPath := path.Join(storageDriver.GetLocalStorageLocation(), directoryName)
+
+	mode := r.planStaging(storageDriver.GetLocalStorageLocation(), backupJob{name: recoveryName}, params)
+	if mode == stagingSkipped {
+		return "", errors.New("not enough disk space to stage it")
+	}
+
+	// only the tar is kept for the upload
+	defer os.RemoveAll(backupPath)
+
+	err := r.tsdb.CopyData(path.Join(backupPath, dataDirectory))
+	if err != nil {
+		return "", err
+	}
+
+	manifest := recoveryManifest{
+		Kind:        "recovery",
+		PostCrash:   true,
+		TSDB:        params.TSDB,
+		Created:     time.Now().UTC(),
+		PreviousPID: previous.PID,
+		Tags:        globalTags(params),
+	}
+	if !previous.Started.IsZero() {
+		manifest.PreviousStart = &previous.Started
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	err = ioutil.WriteFile(path.Join(backupPath, manifestFile), data, 0600)
+	if err != nil {
+		return "", err
+	}
+
+	if mode == stagingDegraded {
+		err = tarutils.TarAndRemove(backupPath, storageDriver.GetLocalStorageLocation())
+	} else {
+		err = tarutils.Tar(backupPath, storageDriver.GetLocalStorageLocation())
+	}
+	if err != nil {
+		cleanupBackup(backupPath)
+		return "", err
+	}
+
+	return directoryName, nil
+}
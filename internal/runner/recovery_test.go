@@ -0,0 +1,124 @@
+package runner
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zawachte/morgue/internal/storagedriver"
+	"github.com/zawachte/morgue/internal/tsdb"
+	"go.uber.org/zap"
+)
+
+// dataTSDB stands in for a database whose data files are a single file.
+type dataTSDB struct {
+	tsdb.TSDB
+}
+
+func (dataTSDB) DataSize() (uint64, error) {
+	return 4, nil
+}
+
+func (dataTSDB) CopyData(path string) error {
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(path, "engine"), []byte("data"), 0600)
+}
+
+// alwaysMetered reports every link as metered.
+type alwaysMetered struct{}
+
+func (alwaysMetered) Metered() (string, error) {
+	return "always metered", nil
+}
+
+func TestRunRecoveryDoesNotWaitForUpload(t *testing.T) {
+	tests := []struct {
+		name  string
+		reset bool
+	}{
+		{"start", false},
+		{"reset", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stagingPath := t.TempDir()
+			archivePath := t.TempDir()
+			markerPath := filepath.Join(t.TempDir(), "morgue.pid")
+
+			// a marker left behind by a killed morgue
+			if err := ioutil.WriteFile(markerPath, []byte("1 2024-03-01T12:00:00Z - -\n"), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			local, err := storagedriver.NewStorageDriver(storagedriver.StorageDriverParams{
+				LocalStorageLocation:     stagingPath,
+				LocalStorageDriverParams: storagedriver.LocalStorageDriverParams{ArchivePath: archivePath},
+				Logger:                   *zap.NewNop(),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := &runner{
+				tsdb:   dataTSDB{},
+				logger: *zap.NewNop(),
+				storageDriver: storagedriver.NewFanOutDriver(storagedriver.FanOutParams{
+					LocalStorageLocation: stagingPath,
+					Targets:              []storagedriver.Target{{Name: "local", Driver: local}},
+					MeteredCheck:         alwaysMetered{},
+					MeteredCheckInterval: 10 * time.Millisecond,
+					Logger:               *zap.NewNop(),
+				}),
+				lastBackupSize: map[string]uint64{},
+			}
+			defer r.abortStart()
+
+			done := make(chan error, 1)
+			go func() {
+				done <- r.runRecovery(RunnerParams{
+					Reset:    tt.reset,
+					Recovery: &RecoveryParams{MarkerPath: markerPath},
+				})
+			}()
+
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatalf("runRecovery() = %v, want nil", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("runRecovery waited for the metered link")
+			}
+
+			// the archive is staged, and only the tar is left of it
+			entries, err := ioutil.ReadDir(stagingPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 || !strings.HasSuffix(entries[0].Name(), "."+recoveryName+".tar") {
+				names := []string{}
+				for _, entry := range entries {
+					names = append(names, entry.Name())
+				}
+				t.Errorf("staging path holds %q, want one recovery tar", names)
+			}
+
+			uploaded, err := storagedriver.NewFanOutDriver(storagedriver.FanOutParams{
+				Targets: []storagedriver.Target{{Name: "local", Driver: local}},
+			}).List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(uploaded) != 0 {
+				t.Errorf("%d archives were uploaded over a metered link, want none", len(uploaded))
+			}
+		})
+	}
+}
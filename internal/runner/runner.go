@@ -3,33 +3,82 @@ package runner
 import (
 	"context"
 	"fmt"
-	"math/rand"
 	"os"
 	"path"
-	"strings"
+	"reflect"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
 
+	"github.com/zawachte/morgue/internal/blackbox"
+	"github.com/zawachte/morgue/internal/credentials"
+	"github.com/zawachte/morgue/internal/kernelevents"
+	"github.com/zawachte/morgue/internal/runmarker"
+	"github.com/zawachte/morgue/internal/schedule"
 	"github.com/zawachte/morgue/internal/servicemanager"
 	"github.com/zawachte/morgue/internal/storagedriver"
-	"github.com/zawachte/morgue/pkg/influx"
-	"github.com/zawachte/morgue/pkg/influx_cli"
-	"github.com/zawachte/morgue/pkg/influxd"
+	"github.com/zawachte/morgue/internal/triggers"
+	"github.com/zawachte/morgue/internal/tsdb"
+	"github.com/zawachte/morgue/pkg/diskspace"
+	"github.com/zawachte/morgue/pkg/hostidentity"
 	"github.com/zawachte/morgue/pkg/tarutils"
+	"github.com/zawachte/morgue/pkg/telegraf"
+	"github.com/zawachte/morgue/pkg/victoriametrics"
 	"go.uber.org/zap"
 )
 
 type Runner interface {
 	Run(context.Context) error
+	// Reload applies new params to a running runner. Settings that need
+	// influxd to be restarted are left untouched until morgue restarts.
+	Reload(RunnerParams) error
+	// Shutdown uploads what needs to leave the host before morgue exits.
+	Shutdown(context.Context) error
+	// RotateCredentials replaces the influxd token morgue uses.
+	RotateCredentials() error
 }
 
 type runner struct {
-	retention       time.Duration
-	backupFrequency time.Duration
-	storageDriver   storagedriver.StorageDriver
-	svcManager      servicemanager.ServiceManager
-	logger          zap.Logger
+	svcManager servicemanager.ServiceManager
+	tsdb       tsdb.TSDB
+	logger     zap.Logger
+
+	lock               sync.Mutex
+	params             RunnerParams
+	backupSchedule     schedule.Schedule
+	maintenanceWindows []schedule.Window
+	storageDriver      storagedriver.StorageDriver
+	runningTelegraf    telegraf.TelegrafConfig
+	reloadCh           chan struct{}
+	backupCh           chan string
+	lastTriggered      time.Time
+	stopTriggers       context.CancelFunc
+	stopBucketBackups  context.CancelFunc
+	stopCollector      context.CancelFunc
+	blackBox           blackbox.Recorder
+	stopBlackBox       context.CancelFunc
+	marker             runmarker.Marker
+	lastBackupSize     map[string]uint64
+}
+
+// TriggerParams configures emergency backups on resource pressure. A zero
+// threshold disables its trigger.
+type TriggerParams struct {
+	CheckInterval time.Duration
+	// Cooldown is the minimum time between two triggered backups, including
+	// those started by kernel events.
+	Cooldown        time.Duration
+	CPUPressure     float64
+	MemoryPressure  float64
+	IOPressure      float64
+	DiskPath        string
+	DiskUsedPercent float64
+	LoadPerCPU      float64
+	LoadDuration    time.Duration
+	// Queries maps a name to a query in the language of the database that
+	// triggers a backup when it returns any rows.
+	Queries map[string]string
 }
 
 type AWSParams struct {
@@ -37,32 +86,282 @@ type AWSParams struct {
 	S3BucketName string
 }
 
+// StorageTarget is one destination backups are uploaded to.
+type StorageTarget struct {
+	Name string
+	// AWSParams uploads to s3, nil keeps the backup in LocalPath.
+	AWSParams    *AWSParams
+	LocalPath    string
+	RequireMount bool
+	Retention    time.Duration
+	Retries      int
+	// Optional targets may fail without failing the backup.
+	Optional bool
+}
+
+// VictoriaMetricsParams configure the victoria-metrics morgue runs when TSDB
+// is victoriametrics.
+type VictoriaMetricsParams struct {
+	Location  string
+	DataPath  string
+	Retention time.Duration
+}
+
+// UploadLimitWindow overrides the upload limit during a daily window.
+type UploadLimitWindow struct {
+	Window         string
+	BytesPerSecond int64
+}
+
 type RunnerParams struct {
-	Retention        time.Duration
-	BackupFrequency  time.Duration
-	ServiceMode      bool
-	BackupPath       string
-	InfluxDLocation  string
-	TelegrafLocation string
-	AWSParams        *AWSParams
-	Logger           zap.Logger
+	TSDB                 string
+	Retention            time.Duration
+	BackupFrequency      time.Duration
+	BackupSchedule       string
+	BackupAlign          bool
+	BackupSplay          time.Duration
+	MaintenanceWindows   []string
+	ServiceMode          bool
+	Reset                bool
+	BackupPath           string
+	CredentialsPath      string
+	InfluxDLocation      string
+	VictoriaMetrics      VictoriaMetricsParams
+	Lite                 LiteParams
+	BlackBox             *BlackBoxParams
+	Recovery             *RecoveryParams
+	TelegrafLocation     string
+	TelegrafAgent        telegraf.AgentConfig
+	TelegrafPlugins      telegraf.Plugins
+	PrometheusInput      telegraf.PrometheusInput
+	LogsInput            telegraf.LogsInput
+	LogsRetention        time.Duration
+	External             *ExternalInfluxParams
+	Buckets              []BucketParams
+	KernelEventsSource   string
+	BackupOnKernelEvent  bool
+	Triggers             TriggerParams
+	GlobalTags           map[string]string
+	DetectHostIdentity   bool
+	KeyPrefixTags        []string
+	DiskReservePercent   float64
+	LowSpaceAction       string
+	BackupStreaming      bool
+	BackupCompression    string
+	BackupEncryptCommand string
+	StorageTargets       []StorageTarget
+	StorageSuccess       string
+	UploadBytesPerSecond int64
+	UploadLimitWindows   []UploadLimitWindow
+	DeferOnMetered       bool
+	MeteredCheckCommand  string
+	MeteredCheckInterval time.Duration
+	Logger               zap.Logger
 }
 
-func NewRunner(params RunnerParams) (Runner, error) {
+// globalTags merges the configured tags over the detected host identity.
+func globalTags(params RunnerParams) map[string]string {
+	tags := map[string]string{}
+	if params.DetectHostIdentity {
+		for key, value := range hostidentity.Detect() {
+			tags[key] = value
+		}
+	}
+
+	for key, value := range params.GlobalTags {
+		tags[key] = value
+	}
+
+	return tags
+}
+
+// keyPrefix joins the values of the prefix tags in order, skipping any tag
+// that isn't set.
+func keyPrefix(tags map[string]string, prefixTags []string) string {
+	parts := []string{}
+	for _, tag := range prefixTags {
+		if value, ok := tags[tag]; ok && value != "" {
+			parts = append(parts, value)
+		}
+	}
+
+	return path.Join(parts...)
+}
+
+// newStorageDriver fans every backup out to the configured targets.
+func newStorageDriver(params RunnerParams) (storagedriver.StorageDriver, error) {
+	prefix := keyPrefix(globalTags(params), params.KeyPrefixTags)
+
+	limiterParams := storagedriver.LimiterParams{
+		BytesPerSecond: params.UploadBytesPerSecond,
+	}
+	for _, window := range params.UploadLimitWindows {
+		parsed, err := schedule.ParseWindow(window.Window)
+		if err != nil {
+			return nil, err
+		}
+		limiterParams.Windows = append(limiterParams.Windows, storagedriver.LimitWindow{
+			Window:         parsed,
+			BytesPerSecond: window.BytesPerSecond,
+		})
+	}
+	// the network targets share one limiter since they share the uplink,
+	// copies to local targets don't use it
+	limiter := storagedriver.NewLimiter(limiterParams)
+
+	targets := []storagedriver.Target{}
+	for _, target := range params.StorageTargets {
+		strgDriverParams := storagedriver.StorageDriverParams{
+			LocalStorageLocation: params.BackupPath,
+			KeyPrefix:            prefix,
+			LocalStorageDriverParams: storagedriver.LocalStorageDriverParams{
+				ArchivePath:  target.LocalPath,
+				RequireMount: target.RequireMount,
+			},
+			Logger: params.Logger,
+		}
+
+		if target.AWSParams != nil {
+			strgDriverParams.Limiter = limiter
+			strgDriverParams.S3StorageDriverParams = &storagedriver.S3StorageDriverParams{
+				Bucket: target.AWSParams.S3BucketName,
+				Region: target.AWSParams.Region,
+			}
+		}
+
+		driver, err := storagedriver.NewStorageDriver(strgDriverParams)
+		if err != nil {
+			return nil, errors.Wrapf(err, "storage target %s", target.Name)
+		}
+
+		targets = append(targets, storagedriver.Target{
+			Name:      target.Name,
+			Driver:    driver,
+			Retention: target.Retention,
+			Retries:   target.Retries,
+			Optional:  target.Optional,
+		})
+	}
 
-	strgDriverParams := storagedriver.StorageDriverParams{
+	fanOutParams := storagedriver.FanOutParams{
 		LocalStorageLocation: params.BackupPath,
+		Targets:              targets,
+		Success:              params.StorageSuccess,
+		MeteredCheckInterval: params.MeteredCheckInterval,
 		Logger:               params.Logger,
 	}
 
-	if params.AWSParams != nil {
-		strgDriverParams.S3StorageDriverParams = &storagedriver.S3StorageDriverParams{
-			Bucket: params.AWSParams.S3BucketName,
-			Region: params.AWSParams.Region,
+	if params.DeferOnMetered || params.MeteredCheckCommand != "" {
+		fanOutParams.MeteredCheck = storagedriver.NewMeteredCheck(storagedriver.MeteredCheckParams{
+			NetworkManager: params.DeferOnMetered,
+			Command:        params.MeteredCheckCommand,
+		})
+	}
+
+	return storagedriver.NewFanOutDriver(fanOutParams), nil
+}
+
+func newTSDB(params RunnerParams, svcManager servicemanager.ServiceManager) (tsdb.TSDB, error) {
+	if params.TSDB == tsdb.BackendLite {
+		return newLite(params)
+	}
+
+	if params.TSDB == tsdb.BackendVictoriaMetrics {
+		dataPath := params.VictoriaMetrics.DataPath
+		if dataPath == "" {
+			dataPath = victoriametrics.SystemdDataPath
+			if !params.ServiceMode {
+				var err error
+				dataPath, err = victoriametrics.DataPath()
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		return tsdb.NewVictoriaMetrics(tsdb.VictoriaMetricsParams{
+			ServiceManager: svcManager,
+			Location:       params.VictoriaMetrics.Location,
+			DataPath:       dataPath,
+			Retention:      params.VictoriaMetrics.Retention,
+			Logger:         params.Logger,
+		}), nil
+	}
+
+	credentialsPath := params.CredentialsPath
+	if credentialsPath == "" {
+		var err error
+		credentialsPath, err = credentials.DefaultPath(params.ServiceMode)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	influxParams := tsdb.InfluxDB2Params{
+		ServiceManager:  svcManager,
+		ServiceMode:     params.ServiceMode,
+		CredentialsPath: credentialsPath,
+		Retention:       params.Retention,
+		Logger:          params.Logger,
+	}
+	if params.External != nil {
+		influxParams.External = &tsdb.ExternalInfluxDB2Params{
+			URL:    params.External.URL,
+			Token:  params.External.Token,
+			Org:    params.External.Org,
+			Bucket: params.External.Buckets[0],
+		}
+	}
+
+	return tsdb.NewInfluxDB2(influxParams), nil
+}
+
+// newBackupSchedule runs backups on the cron schedule when one is set and
+// every backup frequency otherwise.
+func newBackupSchedule(params RunnerParams) (schedule.Schedule, error) {
+	backupSchedule := schedule.NewInterval(params.BackupFrequency, params.BackupAlign)
+	if params.BackupSchedule != "" {
+		var err error
+		backupSchedule, err = schedule.ParseCron(params.BackupSchedule)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return schedule.WithSplay(backupSchedule, params.BackupSplay), nil
+}
+
+func newMaintenanceWindows(params RunnerParams) ([]schedule.Window, error) {
+	windows := []schedule.Window{}
+	for _, window := range params.MaintenanceWindows {
+		parsed, err := schedule.ParseWindow(window)
+		if err != nil {
+			return nil, err
 		}
+		windows = append(windows, parsed)
+	}
+
+	return windows, nil
+}
+
+func NewRunner(params RunnerParams) (Runner, error) {
+
+	params, err := resolveExternal(params)
+	if err != nil {
+		return nil, err
+	}
+
+	sd, err := newStorageDriver(params)
+	if err != nil {
+		return nil, err
+	}
+
+	backupSchedule, err := newBackupSchedule(params)
+	if err != nil {
+		return nil, err
 	}
 
-	sd, err := storagedriver.NewStorageDriver(strgDriverParams)
+	windows, err := newMaintenanceWindows(params)
 	if err != nil {
 		return nil, err
 	}
@@ -70,111 +369,588 @@ func NewRunner(params RunnerParams) (Runner, error) {
 	svcm := servicemanager.NewServiceManager(params.ServiceMode, servicemanager.ServiceManagerParams{
 		InfluxDLocation:  params.InfluxDLocation,
 		TelegrafLocation: params.TelegrafLocation,
+		Reset:            params.Reset,
 		Logger:           params.Logger,
 	})
 
+	db, err := newTSDB(params, svcm)
+	if err != nil {
+		return nil, err
+	}
+
 	return &runner{
-		retention:       params.Retention,
-		backupFrequency: params.BackupFrequency,
-		storageDriver:   sd,
-		svcManager:      svcm,
-		logger:          params.Logger,
+		svcManager:         svcm,
+		tsdb:               db,
+		logger:             params.Logger,
+		params:             params,
+		backupSchedule:     backupSchedule,
+		maintenanceWindows: windows,
+		storageDriver:      sd,
+		reloadCh:           make(chan struct{}, 1),
+		backupCh:           make(chan string, 1),
+		lastBackupSize:     map[string]uint64{},
 	}, nil
 }
 
-func (r *runner) setupInflux(token, password string) error {
-	influxCli, err := influx_cli.NewClient()
+func (r *runner) Run(ctx context.Context) (err error) {
+	// a failed start leaves nothing behind the next start would take for an
+	// unclean stop, otherwise a unit restarting it in a loop would upload on
+	// every attempt
+	defer func() {
+		if err != nil {
+			r.abortStart()
+		}
+	}()
+
+	// the data of a run that didn't stop cleanly is uploaded before
+	// anything, a reset included, touches it
+	err = r.runRecovery(r.params)
+	if err != nil {
+		return err
+	}
+
+	// the black box runs next, so it also records a failing start
+	err = r.runBlackBox(r.params)
 	if err != nil {
 		return err
 	}
 
-	params := influx_cli.SetupInfluxParams{
-		Username:  influx.DefaultUsername,
-		Password:  password,
-		AuthToken: token,
-		Org:       influx.DefaultOrgName,
-		Bucket:    influx.DefaultBucketName,
-		Retention: r.retention.String(),
+	err = r.tsdb.Start()
+	if err != nil {
+		return errors.Wrap(err, "unable to run the database")
 	}
 
-	err = influxCli.SetupInflux(params)
+	err = r.tsdb.Ready(ctx)
 	if err != nil {
 		return err
 	}
-	return nil
-}
 
-func (r *runner) Run(ctx context.Context) error {
-	err := r.svcManager.RunInfluxD()
+	err = r.tsdb.Setup()
 	if err != nil {
-		return errors.Wrap(err, "unable to run influx")
+		return errors.Wrap(err, "unable to set up the database")
+	}
+
+	err = r.prepareBuckets(r.params)
+	if err != nil {
+		return err
+	}
+
+	if managesTelegraf(r.params) {
+		telegrafConfig, err := r.prepareTelegraf(r.params)
+		if err != nil {
+			return err
+		}
+
+		r.lock.Lock()
+		r.runningTelegraf = telegrafConfig
+		r.lock.Unlock()
+
+		err = r.svcManager.RunTelegraf(telegrafConfig)
+		if err != nil {
+			return err
+		}
 	}
 
-	influxd.WaitForInfluxDReady()
+	r.runCollector(r.params)
 
-	token := generateToken()
-	password := generateToken()
-	err = r.setupInflux(token, password)
+	err = r.runBackupAndStore()
 	if err != nil {
-		return errors.Wrap(err, "unable to setup influx")
+		return err
+	}
+
+	r.runBucketBackups(r.params)
+
+	if r.params.KernelEventsSource != "" {
+		err = r.runKernelEventRecorder(ctx)
+		if err != nil {
+			return err
+		}
 	}
 
-	err = r.svcManager.RunTelegraf(token)
+	err = r.runTriggers(r.params.Triggers)
 	if err != nil {
 		return err
 	}
 
-	err = r.runBackupAndStore()
+	return nil
+}
+
+func newTriggers(params TriggerParams, db tsdb.TSDB) []triggers.Trigger {
+	enabled := []triggers.Trigger{}
+
+	for resource, threshold := range map[string]float64{
+		triggers.ResourceCPU:    params.CPUPressure,
+		triggers.ResourceMemory: params.MemoryPressure,
+		triggers.ResourceIO:     params.IOPressure,
+	} {
+		if threshold > 0 {
+			enabled = append(enabled, triggers.NewPressureTrigger(resource, threshold))
+		}
+	}
+
+	if params.DiskUsedPercent > 0 {
+		enabled = append(enabled, triggers.NewDiskTrigger(params.DiskPath, params.DiskUsedPercent))
+	}
+
+	if params.LoadPerCPU > 0 {
+		enabled = append(enabled, triggers.NewLoadTrigger(params.LoadPerCPU, params.LoadDuration))
+	}
+
+	for name, query := range params.Queries {
+		enabled = append(enabled, triggers.NewQueryTrigger(name, query, db))
+	}
+
+	return enabled
+}
+
+// runTriggers (re)starts the watcher for the configured triggers.
+func (r *runner) runTriggers(params TriggerParams) error {
+	r.lock.Lock()
+	if r.stopTriggers != nil {
+		r.stopTriggers()
+		r.stopTriggers = nil
+	}
+	r.lock.Unlock()
+
+	enabled := newTriggers(params, r.tsdb)
+	if len(enabled) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r.lock.Lock()
+	r.stopTriggers = cancel
+	r.lock.Unlock()
+
+	watcher := triggers.NewWatcher(triggers.WatcherParams{
+		Triggers:      enabled,
+		CheckInterval: params.CheckInterval,
+		OnFire: func(name, reason string) {
+			r.triggerBackup(fmt.Sprintf("trigger %s: %s", name, reason))
+		},
+		Logger: r.logger,
+	})
+	go watcher.Run(ctx)
+
+	return nil
+}
+
+func (r *runner) runKernelEventRecorder(ctx context.Context) error {
+	params := kernelevents.RecorderParams{
+		Source: r.params.KernelEventsSource,
+		Tags:   globalTags(r.params),
+		DB:     r.tsdb,
+		Logger: r.logger,
+	}
+
+	if r.params.BackupOnKernelEvent {
+		params.OnSevere = func(event kernelevents.Event) {
+			r.triggerBackup(fmt.Sprintf("kernel event %s", event.Kind))
+		}
+	}
+
+	recorder := kernelevents.NewRecorder(params)
+	go func() {
+		err := recorder.Run(ctx)
+		if err != nil {
+			r.logger.Warn(errors.Wrap(err, "kernel event recorder stopped").Error())
+		}
+	}()
+
+	return nil
+}
+
+// triggerBackup asks the backup loop for an out-of-cycle backup. Requests
+// made while one is already pending or within the cooldown of the last one
+// are dropped.
+func (r *runner) triggerBackup(reason string) {
+	r.lock.Lock()
+	cooldown := r.params.Triggers.Cooldown
+	if !r.lastTriggered.IsZero() && time.Since(r.lastTriggered) < cooldown {
+		r.lock.Unlock()
+		r.logger.Sugar().Infow("skipping triggered backup during cooldown", "reason", reason)
+		return
+	}
+	r.lastTriggered = time.Now()
+	r.lock.Unlock()
+
+	go func() {
+		err := r.uploadBlackBox(reason)
+		if err != nil {
+			r.logger.Warn(errors.Wrap(err, "unable to upload the black box").Error())
+		}
+	}()
+
+	select {
+	case r.backupCh <- reason:
+	default:
+	}
+}
+
+// prepareBuckets creates the managed buckets, an external influxd's buckets
+// are left alone.
+func (r *runner) prepareBuckets(params RunnerParams) error {
+	if params.TSDB != tsdb.BackendInfluxDB2 || params.External != nil {
+		return nil
+	}
+
+	influxCli, err := influxClient(r.tsdb)
 	if err != nil {
 		return err
 	}
 
+	return ensureBuckets(influxCli, params)
+}
+
+// prepareTelegraf builds the telegraf config and points it at the database.
+func (r *runner) prepareTelegraf(params RunnerParams) (telegraf.TelegrafConfig, error) {
+	return r.tsdb.Telegraf(telegraf.TelegrafConfig{
+		GlobalTags: globalTags(params),
+		Agent:      params.TelegrafAgent,
+		Plugins:    params.TelegrafPlugins,
+		Prometheus: params.PrometheusInput,
+		Logs:       params.LogsInput,
+	})
+}
+
+// RotateCredentials rotates the token of the influxd morgue onboarded.
+// Telegraf keeps writing with its own token.
+func (r *runner) RotateCredentials() error {
+	influxDB2, ok := r.tsdb.(tsdb.InfluxDB2)
+	if !ok {
+		return errors.New("only influxdb2 has credentials to rotate")
+	}
+
+	err := influxDB2.RotateToken()
+	if err != nil {
+		return errors.Wrap(err, "unable to rotate credentials")
+	}
+	r.logger.Info("rotated the influxd token")
+
 	return nil
 }
 
-func (r *runner) runBackupAndStore() error {
+func (r *runner) Reload(params RunnerParams) error {
+	params, err := resolveExternal(params)
+	if err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	running := r.params
+	r.lock.Unlock()
+
+	if !sameExternal(params, running) {
+		r.logger.Warn("influxd mode and external influxd settings only change on restart")
+		params.External = running.External
+	}
+
+	if keepRestartSettings(&params, running) {
+		r.logger.Warn("database, service mode, binary location, credential, kernel event, black box and recovery settings only change on restart")
+	}
+
+	sd, err := newStorageDriver(params)
+	if err != nil {
+		return errors.Wrap(err, "unable to create storage driver")
+	}
+
+	backupSchedule, err := newBackupSchedule(params)
+	if err != nil {
+		return errors.Wrap(err, "invalid backup schedule")
+	}
+
+	windows, err := newMaintenanceWindows(params)
+	if err != nil {
+		return errors.Wrap(err, "invalid maintenance window")
+	}
 
-	influxCli, err := influx_cli.NewClient()
+	err = r.prepareBuckets(params)
 	if err != nil {
 		return err
 	}
 
+	var telegrafConfig telegraf.TelegrafConfig
+	if managesTelegraf(params) {
+		telegrafConfig, err = r.prepareTelegraf(params)
+		if err != nil {
+			return err
+		}
+	}
+
+	r.lock.Lock()
+	previous := r.params
+	previousSchedule := r.backupSchedule
+	previousWindows := r.maintenanceWindows
+	previousStorageDriver := r.storageDriver
+	previousTelegraf := r.runningTelegraf
+
+	r.params = params
+	r.backupSchedule = backupSchedule
+	r.maintenanceWindows = windows
+	r.storageDriver = sd
+	r.runningTelegraf = telegrafConfig
+	r.lock.Unlock()
+
+	if managesTelegraf(params) {
+		err = r.svcManager.RestartTelegraf(telegrafConfig)
+	}
+	if err != nil {
+		r.lock.Lock()
+		r.params = previous
+		r.backupSchedule = previousSchedule
+		r.maintenanceWindows = previousWindows
+		r.storageDriver = previousStorageDriver
+		r.runningTelegraf = previousTelegraf
+		r.lock.Unlock()
+
+		rollbackErr := r.svcManager.RestartTelegraf(previousTelegraf)
+		if rollbackErr != nil {
+			r.logger.Error(errors.Wrap(rollbackErr, "unable to roll back telegraf").Error())
+		}
+
+		return errors.Wrap(err, "unable to restart telegraf")
+	}
+
+	err = r.runTriggers(params.Triggers)
+	if err != nil {
+		r.logger.Warn(errors.Wrap(err, "unable to restart triggers").Error())
+	}
+
+	r.runBucketBackups(params)
+	r.runCollector(params)
+
+	// wake the backup loop so a new schedule applies right away
+	select {
+	case r.reloadCh <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// keepRestartSettings puts the running values of the settings that only
+// change on restart back into params, so nothing acts on values that aren't
+// running. It reports whether any of them differed.
+func keepRestartSettings(params *RunnerParams, running RunnerParams) bool {
+	changed := params.TSDB != running.TSDB ||
+		params.VictoriaMetrics != running.VictoriaMetrics ||
+		params.Lite != running.Lite ||
+		!reflect.DeepEqual(params.BlackBox, running.BlackBox) ||
+		!reflect.DeepEqual(params.Recovery, running.Recovery) ||
+		params.ServiceMode != running.ServiceMode ||
+		params.Reset != running.Reset ||
+		params.CredentialsPath != running.CredentialsPath ||
+		params.InfluxDLocation != running.InfluxDLocation ||
+		params.KernelEventsSource != running.KernelEventsSource ||
+		params.TelegrafLocation != running.TelegrafLocation
+
+	params.TSDB = running.TSDB
+	params.VictoriaMetrics = running.VictoriaMetrics
+	params.Lite = running.Lite
+	params.BlackBox = running.BlackBox
+	params.Recovery = running.Recovery
+	params.ServiceMode = running.ServiceMode
+	params.Reset = running.Reset
+	params.CredentialsPath = running.CredentialsPath
+	params.InfluxDLocation = running.InfluxDLocation
+	params.KernelEventsSource = running.KernelEventsSource
+	params.TelegrafLocation = running.TelegrafLocation
+
+	return changed
+}
+
+// abortStart undoes what a failed Run started. The marker is released, a
+// failed start didn't leave data behind that needs recovering.
+func (r *runner) abortStart() {
+	r.discardBlackBox()
+
+	r.lock.Lock()
+	marker := r.marker
+	r.marker = nil
+	r.lock.Unlock()
+
+	if marker != nil {
+		if err := marker.Release(); err != nil {
+			r.logger.Warn(errors.Wrap(err, "unable to remove run marker").Error())
+		}
+	}
+}
+
+// Shutdown uploads the black box and removes the run marker, so the next
+// start knows this run stopped cleanly.
+func (r *runner) Shutdown(ctx context.Context) error {
+	err := r.shutdownBlackBox(ctx)
+
+	r.lock.Lock()
+	marker := r.marker
+	r.lock.Unlock()
+
+	if marker != nil {
+		if releaseErr := marker.Release(); err == nil {
+			err = releaseErr
+		}
+	}
+
+	return err
+}
+
+func (r *runner) nextBackup(after time.Time) time.Time {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.backupSchedule.Next(after)
+}
+
+// maintenanceWindowEnd returns when the maintenance window t falls in ends.
+func (r *runner) maintenanceWindowEnd(t time.Time) (time.Time, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, window := range r.maintenanceWindows {
+		if window.Contains(t) {
+			return window.End(t), true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// waitForMaintenanceWindow blocks until no maintenance window is open.
+// Backups are still taken during a window, only their upload waits.
+func (r *runner) waitForMaintenanceWindow() {
+	for {
+		end, ok := r.maintenanceWindowEnd(time.Now())
+		if !ok {
+			return
+		}
+
+		r.logger.Sugar().Infow("deferring upload until the maintenance window ends", "until", end)
+		time.Sleep(time.Until(end))
+	}
+}
+
+func (r *runner) getStorageDriver() storagedriver.StorageDriver {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.storageDriver
+}
+
+func (r *runner) runBackupAndStore() error {
+
+	// backups run one at a time on this goroutine, so a backup never starts
+	// while the previous one is still running. A backup triggered meanwhile
+	// waits in backupCh.
 	go func() {
+		next := r.nextBackup(time.Now())
 		for {
-			time.Sleep(r.backupFrequency)
-			err := r.backupAndStore(influxCli)
-			if err != nil {
-				r.logger.Warn(err.Error())
+			// a schedule that never fires only leaves triggered backups
+			var due <-chan time.Time
+			if next.IsZero() {
+				r.logger.Error("backup schedule never fires, only triggered backups run")
+			} else {
+				due = time.After(time.Until(next))
+			}
+
+			reason := ""
+			select {
+			case <-due:
+			case <-r.reloadCh:
+				next = r.nextBackup(time.Now())
+				continue
+			case reason = <-r.backupCh:
+			}
+
+			if reason != "" {
+				r.logger.Sugar().Infow("running out-of-cycle backup", "reason", reason)
+			}
+
+			r.lock.Lock()
+			job, ok := scheduledBackupJob(r.params)
+			r.lock.Unlock()
+
+			now := time.Now()
+			if ok {
+				err := r.backupAndStore(job)
+				if err != nil {
+					r.logger.Warn(err.Error())
+				}
+			} else {
+				r.logger.Info("skipping scheduled backup, every bucket is excluded or has its own backup frequency")
+			}
+
+			if next.IsZero() || next.After(now) {
+				continue
+			}
+
+			now = time.Now()
+			if missed := r.nextBackup(next); !missed.IsZero() && missed.Before(now) {
+				r.logger.Sugar().Warnw("skipping backups scheduled while the previous one was running", "since", missed)
 			}
+			next = r.nextBackup(now)
 		}
 	}()
 
 	return nil
 }
 
-func (r *runner) backupAndStore(influxClient influx_cli.Client) error {
-	backupFilenamePattern := "20060102T150405Z"
-	directoryName := time.Now().UTC().Format(backupFilenamePattern)
+func (r *runner) backupAndStore(job backupJob) error {
+	r.lock.Lock()
+	params := r.params
+	r.lock.Unlock()
 
-	backupParams := influx_cli.BackupInfluxParams{
-		Org:    influx.DefaultOrgName,
-		Bucket: influx.DefaultBucketName,
-		Path:   path.Join(r.storageDriver.GetLocalStorageLocation(), directoryName),
+	// a streamed backup is uploaded while it is taken, so it can't be held
+	// back and is taken once the maintenance window closed
+	if params.BackupStreaming {
+		r.waitForMaintenanceWindow()
 	}
 
-	defer cleanupBackup(backupParams.Path)
+	directoryName := time.Now().UTC().Format(storagedriver.BackupNameLayout)
+	if job.name != "" {
+		directoryName += "." + job.name
+	}
+	storageDriver := r.getStorageDriver()
+
+	backupPath := path.Join(storageDriver.GetLocalStorageLocation(), directoryName)
+
+	// a streamed backup only stages one of its files at a time, so it skips
+	// the disk space check made for a full copy
+	if params.BackupStreaming {
+		return r.streamBackup(storageDriver, directoryName, job, params)
+	}
 
-	err := influxClient.BackupInflux(backupParams)
+	mode := r.planStaging(storageDriver.GetLocalStorageLocation(), job, params)
+	if mode == stagingSkipped {
+		return nil
+	}
+
+	defer cleanupBackup(backupPath)
+
+	err := r.tsdb.Backup(tsdb.BackupParams{
+		Path:    backupPath,
+		Buckets: job.buckets,
+	})
 	if err != nil {
 		return err
 	}
 
-	err = tarutils.Tar(backupParams.Path, r.storageDriver.GetLocalStorageLocation())
+	size, err := diskspace.DirSize(backupPath)
+	if err == nil {
+		r.lock.Lock()
+		r.lastBackupSize[job.name] = size
+		r.lock.Unlock()
+	}
+
+	if mode == stagingDegraded {
+		err = tarutils.TarAndRemove(backupPath, storageDriver.GetLocalStorageLocation())
+	} else {
+		err = tarutils.Tar(backupPath, storageDriver.GetLocalStorageLocation())
+	}
 	if err != nil {
 		return err
 	}
 
-	err = r.storageDriver.UploadTar(fmt.Sprintf("%s.tar", directoryName))
+	r.waitForMaintenanceWindow()
+
+	err = storageDriver.UploadTar(fmt.Sprintf("%s.tar", directoryName))
 	if err != nil {
 		return err
 	}
@@ -196,17 +972,3 @@ func cleanupBackup(backupPath string) error {
 
 	return nil
 }
-
-func generateToken() string {
-	rand.Seed(time.Now().UnixNano())
-	chars := []rune("ABCDEFGHIJKLMNOPQRSTUVWXYZ" +
-		"abcdefghijklmnopqrstuvwxyz" +
-		"0123456789")
-	length := 8
-	var b strings.Builder
-	for i := 0; i < length; i++ {
-		b.WriteRune(chars[rand.Intn(len(chars))])
-	}
-
-	return b.String()
-}
@@ -0,0 +1,126 @@
+package runner
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+
+	"github.com/pkg/errors"
+	"github.com/zawachte/morgue/internal/storagedriver"
+	"github.com/zawachte/morgue/pkg/influx_cli"
+	"github.com/zawachte/morgue/pkg/tarutils"
+)
+
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+)
+
+// streamKey returns the object key of a streamed backup.
+func streamKey(directoryName string, params RunnerParams) string {
+	key := directoryName + ".tar"
+	if params.BackupCompression == CompressionGzip {
+		key += ".gz"
+	}
+	if params.BackupEncryptCommand != "" {
+		key += ".enc"
+	}
+
+	return key
+}
+
+// streamBackup pipes the backup through tar, compression and encryption
+// straight into the storage driver. Only one file of the backup is staged on
+// disk at a time.
+func (r *runner) streamBackup(storageDriver storagedriver.StorageDriver, directoryName string, job backupJob, params RunnerParams) error {
+	influxClient, err := influxClient(r.tsdb)
+	if err != nil {
+		return err
+	}
+
+	spoolPath := path.Join(storageDriver.GetLocalStorageLocation(), directoryName+".spool")
+	defer os.RemoveAll(spoolPath)
+
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pw.CloseWithError(writeBackupStream(pw, influxClient, influx_cli.StreamBackupParams{
+			Org:       influxOrg(params),
+			Buckets:   job.buckets,
+			Name:      directoryName,
+			SpoolPath: spoolPath,
+		}, params))
+	}()
+
+	err = storageDriver.UploadReader(streamKey(directoryName, params), pr)
+	// stops the backup if the upload gave up before reading all of it
+	pr.CloseWithError(err)
+	<-done
+
+	return err
+}
+
+// writeBackupStream writes the tarred backup to w, compressed and encrypted as
+// configured.
+func writeBackupStream(w io.Writer, influxClient influx_cli.Client, streamParams influx_cli.StreamBackupParams, params RunnerParams) error {
+	var out io.Writer = w
+
+	var encrypt *exec.Cmd
+	var encryptIn io.WriteCloser
+	if params.BackupEncryptCommand != "" {
+		/* #nosec */
+		encrypt = exec.Command("sh", "-c", params.BackupEncryptCommand)
+		encrypt.Stdout = w
+		encrypt.Stderr = os.Stderr
+
+		var err error
+		encryptIn, err = encrypt.StdinPipe()
+		if err != nil {
+			return err
+		}
+
+		if err := encrypt.Start(); err != nil {
+			return errors.Wrap(err, "unable to start encrypt command")
+		}
+		out = encryptIn
+	}
+
+	var compressor *gzip.Writer
+	if params.BackupCompression == CompressionGzip {
+		compressor = gzip.NewWriter(out)
+		out = compressor
+	}
+
+	tarball := tar.NewWriter(out)
+
+	err := tarutils.AddDirectory(tarball, streamParams.Name)
+	if err == nil {
+		streamParams.WriteFile = func(name string, size int64, r io.Reader) error {
+			return tarutils.AddFile(tarball, path.Join(streamParams.Name, name), size, r)
+		}
+		err = influxClient.StreamBackup(streamParams)
+	}
+
+	if err == nil {
+		err = tarball.Close()
+	}
+
+	if err == nil && compressor != nil {
+		err = compressor.Close()
+	}
+
+	if encrypt != nil {
+		encryptIn.Close()
+		// a failed command also breaks the pipe the backup is written to,
+		// so its error is the more useful one
+		if waitErr := encrypt.Wait(); waitErr != nil {
+			err = errors.Wrap(waitErr, "encrypt command failed")
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,273 @@
+package schedule
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule returns the next time a job should run.
+type Schedule interface {
+	Next(after time.Time) time.Time
+}
+
+// NewInterval returns a schedule that runs every interval. When aligned, runs
+// land on wall-clock multiples of the interval, so an hourly schedule runs at
+// the top of every hour.
+func NewInterval(every time.Duration, aligned bool) Schedule {
+	return &interval{
+		every:   every,
+		aligned: aligned,
+	}
+}
+
+type interval struct {
+	every   time.Duration
+	aligned bool
+}
+
+func (i *interval) Next(after time.Time) time.Time {
+	if !i.aligned {
+		return after.Add(i.every)
+	}
+
+	return after.Truncate(i.every).Add(i.every)
+}
+
+// WithSplay delays every run of s by a random duration below splay, so nodes
+// sharing a schedule don't all upload at once.
+func WithSplay(s Schedule, splay time.Duration) Schedule {
+	if splay <= 0 {
+		return s
+	}
+
+	return &splayed{
+		schedule: s,
+		splay:    splay,
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+type splayed struct {
+	schedule Schedule
+	splay    time.Duration
+	rand     *rand.Rand
+}
+
+func (s *splayed) Next(after time.Time) time.Time {
+	return s.schedule.Next(after).Add(time.Duration(s.rand.Int63n(int64(s.splay))))
+}
+
+// cron is a standard five field cron expression: minute, hour, day of month,
+// month and day of week.
+type cron struct {
+	minutes  map[int]bool
+	hours    map[int]bool
+	days     map[int]bool
+	months   map[int]bool
+	weekdays map[int]bool
+	// cron matches either the day of month or the day of week when both are
+	// restricted to less than every day
+	anyDay bool
+}
+
+// ParseCron parses a five field cron expression such as "*/15 * * * *".
+func ParseCron(expr string) (Schedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q must have 5 fields", expr)
+	}
+
+	bounds := []struct {
+		name     string
+		min, max int
+	}{
+		{"minute", 0, 59},
+		{"hour", 0, 23},
+		{"day of month", 1, 31},
+		{"month", 1, 12},
+		{"day of week", 0, 7},
+	}
+
+	sets := make([]map[int]bool, len(fields))
+	for i, field := range fields {
+		set, err := parseField(field, bounds[i].min, bounds[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("cron %s field %q: %w", bounds[i].name, field, err)
+		}
+		sets[i] = set
+	}
+
+	// 7 is sunday as well
+	if sets[4][7] {
+		sets[4][0] = true
+		delete(sets[4], 7)
+	}
+
+	c := &cron{
+		minutes:  sets[0],
+		hours:    sets[1],
+		days:     sets[2],
+		months:   sets[3],
+		weekdays: sets[4],
+		anyDay:   len(sets[2]) < 31 && len(sets[4]) < 7,
+	}
+
+	// like february 30th
+	if c.Next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("cron expression %q never matches a date", expr)
+	}
+
+	return c, nil
+}
+
+func parseField(field string, min, max int) (map[int]bool, error) {
+	set := map[int]bool{}
+
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if slash := strings.Index(part, "/"); slash >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[slash+1:])
+			if err != nil || step <= 0 {
+				return nil, fmt.Errorf("invalid step %q", part[slash+1:])
+			}
+			part = part[:slash]
+		}
+
+		start, end := min, max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if start, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("invalid range %q", part)
+			}
+			if end, err = strconv.Atoi(bounds[1]); err != nil {
+				return nil, fmt.Errorf("invalid range %q", part)
+			}
+		default:
+			value, err := strconv.Atoi(part)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %q", part)
+			}
+			start = value
+			if step == 1 {
+				end = value
+			}
+		}
+
+		if start < min || end > max || start > end {
+			return nil, fmt.Errorf("%q out of range %d-%d", part, min, max)
+		}
+
+		for value := start; value <= end; value += step {
+			set[value] = true
+		}
+	}
+
+	return set, nil
+}
+
+func (c *cron) dayMatches(t time.Time) bool {
+	day := c.days[t.Day()]
+	weekday := c.weekdays[int(t.Weekday())]
+	if c.anyDay {
+		return day || weekday
+	}
+
+	return day && weekday
+}
+
+func (c *cron) Next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+
+	// five years covers every valid expression, including february 29th
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if !c.months[int(t.Month())] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+
+		if !c.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+
+		if !c.hours[t.Hour()] {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+
+		if !c.minutes[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+
+		return t
+	}
+
+	return time.Time{}
+}
+
+// Window is a daily time range, such as 22:00-06:00, in local time. A window
+// whose end is before its start spans midnight.
+type Window struct {
+	start time.Duration
+	end   time.Duration
+}
+
+// ParseWindow parses a "HH:MM-HH:MM" window.
+func ParseWindow(window string) (Window, error) {
+	bounds := strings.Split(window, "-")
+	if len(bounds) != 2 {
+		return Window{}, fmt.Errorf("window %q must look like HH:MM-HH:MM", window)
+	}
+
+	start, err := parseClock(bounds[0])
+	if err != nil {
+		return Window{}, fmt.Errorf("window %q: %w", window, err)
+	}
+
+	end, err := parseClock(bounds[1])
+	if err != nil {
+		return Window{}, fmt.Errorf("window %q: %w", window, err)
+	}
+
+	return Window{start: start, end: end}, nil
+}
+
+func parseClock(clock string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(clock))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", clock)
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Contains reports whether t falls inside the window.
+func (w Window) Contains(t time.Time) bool {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	offset := t.Sub(midnight)
+
+	if w.start <= w.end {
+		return offset >= w.start && offset < w.end
+	}
+
+	return offset >= w.start || offset < w.end
+}
+
+// End returns when the window that contains t closes.
+func (w Window) End(t time.Time) time.Time {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	if w.start > w.end && t.Sub(midnight) >= w.start {
+		midnight = midnight.AddDate(0, 0, 1)
+	}
+
+	return midnight.Add(w.end)
+}
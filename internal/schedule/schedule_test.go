@@ -0,0 +1,169 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func mustTime(t *testing.T, value string) time.Time {
+	t.Helper()
+
+	parsed, err := time.ParseInLocation("2006-01-02 15:04", value, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return parsed
+}
+
+func TestParseCronErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		expr string
+	}{
+		{"too few fields", "* * * *"},
+		{"too many fields", "* * * * * *"},
+		{"minute out of range", "60 * * * *"},
+		{"hour out of range", "0 24 * * *"},
+		{"day out of range", "0 0 0 * *"},
+		{"reversed range", "0 5-1 * * *"},
+		{"zero step", "*/0 * * * *"},
+		{"not a number", "a * * * *"},
+		{"never matches", "0 0 31 2 *"},
+		{"february 30th", "0 0 30 2 *"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseCron(tt.expr); err == nil {
+				t.Errorf("ParseCron(%q) succeeded, want an error", tt.expr)
+			}
+		})
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	tests := []struct {
+		name  string
+		expr  string
+		after string
+		want  string
+	}{
+		{"every minute", "* * * * *", "2022-03-01 10:15", "2022-03-01 10:16"},
+		{"every 15 minutes", "*/15 * * * *", "2022-03-01 10:15", "2022-03-01 10:30"},
+		{"top of the hour", "0 * * * *", "2022-03-01 10:15", "2022-03-01 11:00"},
+		{"every 6 hours", "0 */6 * * *", "2022-03-01 19:00", "2022-03-02 00:00"},
+		{"list", "0 1,13 * * *", "2022-03-01 02:00", "2022-03-01 13:00"},
+		{"range", "30 9-17 * * *", "2022-03-01 17:30", "2022-03-02 09:30"},
+		{"day of month", "0 0 1 * *", "2022-03-01 00:00", "2022-04-01 00:00"},
+		{"month", "0 0 1 6 *", "2022-07-01 00:00", "2023-06-01 00:00"},
+		{"weekday", "0 8 * * 1", "2022-03-01 00:00", "2022-03-07 08:00"},
+		{"sunday as 7", "0 8 * * 7", "2022-03-01 00:00", "2022-03-06 08:00"},
+		{"day of month or weekday", "0 0 15 * 1", "2022-03-01 00:00", "2022-03-07 00:00"},
+		{"stepped day of month is restricted", "0 0 */10 * 1", "2022-03-01 00:00", "2022-03-07 00:00"},
+		{"full day of month range is not restricted", "0 0 1-31 * 1", "2022-03-01 00:00", "2022-03-07 00:00"},
+		{"leap day", "0 0 29 2 *", "2022-03-01 00:00", "2024-02-29 00:00"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cron, err := ParseCron(tt.expr)
+			if err != nil {
+				t.Fatalf("ParseCron(%q): %v", tt.expr, err)
+			}
+
+			got := cron.Next(mustTime(t, tt.after))
+			if want := mustTime(t, tt.want); !got.Equal(want) {
+				t.Errorf("Next(%s) = %s, want %s", tt.after, got, want)
+			}
+		})
+	}
+}
+
+func TestIntervalNext(t *testing.T) {
+	tests := []struct {
+		name    string
+		every   time.Duration
+		aligned bool
+		after   string
+		want    string
+	}{
+		{"unaligned", time.Hour, false, "2022-03-01 10:15", "2022-03-01 11:15"},
+		{"aligned hour", time.Hour, true, "2022-03-01 10:15", "2022-03-01 11:00"},
+		{"aligned on a boundary", time.Hour, true, "2022-03-01 10:00", "2022-03-01 11:00"},
+		{"aligned 15 minutes", 15 * time.Minute, true, "2022-03-01 10:16", "2022-03-01 10:30"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := NewInterval(tt.every, tt.aligned).Next(mustTime(t, tt.after))
+			if want := mustTime(t, tt.want); !got.Equal(want) {
+				t.Errorf("Next(%s) = %s, want %s", tt.after, got, want)
+			}
+		})
+	}
+}
+
+func TestWithSplay(t *testing.T) {
+	base := NewInterval(time.Hour, true)
+	splayed := WithSplay(base, 10*time.Minute)
+	after := mustTime(t, "2022-03-01 10:15")
+	want := base.Next(after)
+
+	for i := 0; i < 100; i++ {
+		got := splayed.Next(after)
+		if got.Before(want) || !got.Before(want.Add(10*time.Minute)) {
+			t.Fatalf("Next() = %s, want within 10m after %s", got, want)
+		}
+	}
+
+	if WithSplay(base, 0) != base {
+		t.Error("WithSplay(0) should return the schedule unchanged")
+	}
+}
+
+func TestWindow(t *testing.T) {
+	tests := []struct {
+		name     string
+		window   string
+		at       string
+		contains bool
+		end      string
+	}{
+		{"inside", "02:00-04:00", "2022-03-01 03:00", true, "2022-03-01 04:00"},
+		{"at the start", "02:00-04:00", "2022-03-01 02:00", true, "2022-03-01 04:00"},
+		{"at the end", "02:00-04:00", "2022-03-01 04:00", false, ""},
+		{"before", "02:00-04:00", "2022-03-01 01:59", false, ""},
+		{"over midnight, evening", "22:00-06:00", "2022-03-01 23:00", true, "2022-03-02 06:00"},
+		{"over midnight, morning", "22:00-06:00", "2022-03-02 05:00", true, "2022-03-02 06:00"},
+		{"over midnight, outside", "22:00-06:00", "2022-03-01 12:00", false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			window, err := ParseWindow(tt.window)
+			if err != nil {
+				t.Fatalf("ParseWindow(%q): %v", tt.window, err)
+			}
+
+			at := mustTime(t, tt.at)
+			if got := window.Contains(at); got != tt.contains {
+				t.Fatalf("Contains(%s) = %v, want %v", tt.at, got, tt.contains)
+			}
+
+			if tt.contains {
+				if got, want := window.End(at), mustTime(t, tt.end); !got.Equal(want) {
+					t.Errorf("End(%s) = %s, want %s", tt.at, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseWindowErrors(t *testing.T) {
+	for _, window := range []string{"", "02:00", "2-4", "02:00-25:00", "02:00-04:00-06:00"} {
+		if _, err := ParseWindow(window); err == nil {
+			t.Errorf("ParseWindow(%q) succeeded, want an error", window)
+		}
+	}
+}
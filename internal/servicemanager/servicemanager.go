@@ -1,32 +1,53 @@
 package servicemanager
 
 import (
-	"os/exec"
+	"context"
+	"os"
+	"sync"
+	"time"
 
-	"github.com/zawachte/morgue/pkg/influx"
+	"github.com/pkg/errors"
+	"github.com/zawachte/morgue/internal/systemd"
 	"github.com/zawachte/morgue/pkg/influxd"
 	"github.com/zawachte/morgue/pkg/telegraf"
+	"github.com/zawachte/morgue/pkg/victoriametrics"
 	"go.uber.org/zap"
 )
 
 type ServiceManager interface {
 	RunInfluxD() error
-	RunTelegraf(string) error
+	RunVictoriaMetrics(victoriametrics.RunParams) error
+	RunTelegraf(telegraf.TelegrafConfig) error
+	RestartTelegraf(telegraf.TelegrafConfig) error
+	// StopInfluxD and StopVictoriaMetrics stop a database a previous morgue
+	// left running, so its files stop changing.
+	StopInfluxD() error
+	StopVictoriaMetrics() error
 }
 
 type ServiceManagerParams struct {
 	InfluxDLocation  string
 	TelegrafLocation string
-	Logger           zap.Logger
+	// Reset wipes any existing influxd state before starting it.
+	Reset bool
+	// Bus is how units are managed in service mode. It defaults to a
+	// connection to the systemd of the host.
+	Bus    systemd.Bus
+	Logger zap.Logger
 }
 
 func NewServiceManager(serviceMode bool, params ServiceManagerParams) ServiceManager {
 	if serviceMode {
-		return &systemDServiceManager{params.Logger}
+		return &systemDServiceManager{
+			systemd: systemd.New(systemd.Params{Bus: params.Bus}),
+			reset:   params.Reset,
+			logger:  params.Logger,
+		}
 	}
 	return &embeddedServiceManager{
 		influxDLocation:  params.InfluxDLocation,
 		telegrafLocation: params.TelegrafLocation,
+		reset:            params.Reset,
 		logger:           params.Logger,
 	}
 }
@@ -34,10 +55,22 @@ func NewServiceManager(serviceMode bool, params ServiceManagerParams) ServiceMan
 type embeddedServiceManager struct {
 	influxDLocation  string
 	telegrafLocation string
+	reset            bool
 	logger           zap.Logger
+
+	telegrafLock  sync.Mutex
+	telegrafAbort chan error
+	telegrafDone  chan struct{}
 }
 
 func (esm *embeddedServiceManager) RunInfluxD() error {
+	if esm.reset {
+		err := influxd.CleanupConfigFile()
+		if err != nil {
+			return err
+		}
+	}
+
 	abortCh := make(chan error, 1)
 	go func() {
 		err := influxd.RunInfluxD(abortCh, esm.influxDLocation)
@@ -49,15 +82,37 @@ func (esm *embeddedServiceManager) RunInfluxD() error {
 	return nil
 }
 
-func (esm *embeddedServiceManager) RunTelegraf(token string) error {
+func (esm *embeddedServiceManager) RunVictoriaMetrics(params victoriametrics.RunParams) error {
+	if esm.reset {
+		err := os.RemoveAll(params.DataPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	abortCh := make(chan error, 1)
+	go func() {
+		err := victoriametrics.Run(abortCh, params)
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	return nil
+}
+
+func (esm *embeddedServiceManager) RunTelegraf(config telegraf.TelegrafConfig) error {
+	esm.telegrafLock.Lock()
+	defer esm.telegrafLock.Unlock()
+
 	abortCh := make(chan error, 1)
+	doneCh := make(chan struct{})
+	esm.telegrafAbort = abortCh
+	esm.telegrafDone = doneCh
+
 	go func() {
-		err := telegraf.RunTelegraf(abortCh, telegraf.TelegrafConfig{
-			Token:        token,
-			Urls:         []string{"http://127.0.0.1:8086"},
-			Organization: influx.DefaultOrgName,
-			Bucket:       influx.DefaultBucketName,
-		}, esm.telegrafLocation)
+		defer close(doneCh)
+		err := telegraf.RunTelegraf(abortCh, config, esm.telegrafLocation)
 		if err != nil {
 			panic(err)
 		}
@@ -66,20 +121,69 @@ func (esm *embeddedServiceManager) RunTelegraf(token string) error {
 	return nil
 }
 
+// StopInfluxD does nothing, an embedded influxd stopped with the morgue that
+// ran it.
+func (esm *embeddedServiceManager) StopInfluxD() error {
+	return nil
+}
+
+// StopVictoriaMetrics does nothing, an embedded victoria-metrics stopped with
+// the morgue that ran it.
+func (esm *embeddedServiceManager) StopVictoriaMetrics() error {
+	return nil
+}
+
+// RestartTelegraf stops the running telegraf and waits for it to exit before
+// starting it again with the new config.
+func (esm *embeddedServiceManager) RestartTelegraf(config telegraf.TelegrafConfig) error {
+	esm.telegrafLock.Lock()
+	abortCh := esm.telegrafAbort
+	doneCh := esm.telegrafDone
+	esm.telegrafLock.Unlock()
+
+	if abortCh != nil {
+		abortCh <- nil
+		<-doneCh
+	}
+
+	return esm.RunTelegraf(config)
+}
+
+// unitTimeout bounds how long a unit may take to become active.
+const unitTimeout = 2 * time.Minute
+
+// systemDServiceManager runs influxd, victoriametrics and telegraf as the
+// systemd units their packages install, managed over D-Bus.
 type systemDServiceManager struct {
-	logger zap.Logger
+	systemd systemd.Systemd
+	reset   bool
+	logger  zap.Logger
 }
 
 func (esm *systemDServiceManager) RunInfluxD() error {
+	if esm.reset {
+		err := esm.resetInfluxD()
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), unitTimeout)
+	defer cancel()
+
+	return esm.systemd.ReloadOrRestart(ctx, "influxd")
+}
+
+func (esm *systemDServiceManager) resetInfluxD() error {
 	err := influxd.CleanupConfigFile()
 	if err != nil {
 		return err
 	}
 
-	cmd := exec.Command("sudo", "systemctl", "stop", "influxd")
-	_, err = cmd.CombinedOutput()
+	// the files can't be deleted safely while influxd still writes them
+	err = esm.StopInfluxD()
 	if err != nil {
-		esm.logger.Warn("couldn't stop influxd")
+		return errors.Wrap(err, "unable to reset influxd")
 	}
 
 	filesToDelete := []string{
@@ -88,38 +192,69 @@ func (esm *systemDServiceManager) RunInfluxD() error {
 		"/var/lib/influxdb/influxd.sqlite"}
 
 	for _, file := range filesToDelete {
-		cmd = exec.Command("sudo", "rm", "-r", file)
-		output, err := cmd.CombinedOutput()
+		err := os.RemoveAll(file)
 		if err != nil {
-			esm.logger.Sugar().Warnw("couldn't delete", "file", file, "output", string(output), "error", err.Error())
+			return errors.Wrap(err, "unable to reset influxd")
 		}
 	}
 
-	cmd = exec.Command("sudo", "systemctl", "reload-or-restart", "influxd")
-	_, err = cmd.CombinedOutput()
-	if err != nil {
-		return err
+	return nil
+}
+
+// RunVictoriaMetrics restarts the victoriametrics unit, which runs with the
+// data path and retention its package configures.
+func (esm *systemDServiceManager) RunVictoriaMetrics(params victoriametrics.RunParams) error {
+	if esm.reset {
+		err := esm.StopVictoriaMetrics()
+		if err != nil {
+			return errors.Wrap(err, "unable to reset victoriametrics")
+		}
+
+		err = os.RemoveAll(params.DataPath)
+		if err != nil {
+			return errors.Wrap(err, "unable to reset victoriametrics")
+		}
 	}
 
-	return nil
+	ctx, cancel := context.WithTimeout(context.Background(), unitTimeout)
+	defer cancel()
+
+	return esm.systemd.ReloadOrRestart(ctx, "victoriametrics")
 }
 
-func (esm *systemDServiceManager) RunTelegraf(token string) error {
+func (esm *systemDServiceManager) StopInfluxD() error {
+	return esm.stop("influxd")
+}
 
-	err := telegraf.WriteTelegrafConfig(telegraf.TelegrafConfig{
-		Token:        token,
-		Urls:         []string{"http://127.0.0.1:8086"},
-		Organization: influx.DefaultOrgName,
-		Bucket:       influx.DefaultBucketName,
-	}, "/etc/telegraf/telegraf.conf")
-	if err != nil {
+func (esm *systemDServiceManager) StopVictoriaMetrics() error {
+	return esm.stop("victoriametrics")
+}
+
+// stop stops unit, a unit that isn't installed has nothing running.
+func (esm *systemDServiceManager) stop(unit string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), unitTimeout)
+	defer cancel()
+
+	err := esm.systemd.Stop(ctx, unit)
+	if systemd.IsNoSuchUnit(err) {
 		return nil
 	}
 
-	cmd := exec.Command("sudo", "systemctl", "reload-or-restart", "telegraf")
-	_, err = cmd.CombinedOutput()
+	return err
+}
+
+func (esm *systemDServiceManager) RunTelegraf(config telegraf.TelegrafConfig) error {
+	err := telegraf.WriteTelegrafConfig(config, "/etc/telegraf/telegraf.conf")
 	if err != nil {
-		return nil
+		return err
 	}
-	return nil
+
+	ctx, cancel := context.WithTimeout(context.Background(), unitTimeout)
+	defer cancel()
+
+	return esm.systemd.ReloadOrRestart(ctx, "telegraf")
+}
+
+func (esm *systemDServiceManager) RestartTelegraf(config telegraf.TelegrafConfig) error {
+	return esm.RunTelegraf(config)
 }
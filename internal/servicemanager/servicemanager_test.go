@@ -0,0 +1,136 @@
+package servicemanager
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zawachte/morgue/internal/systemd"
+	"github.com/zawachte/morgue/internal/systemd/fakebus"
+	"github.com/zawachte/morgue/pkg/victoriametrics"
+	"go.uber.org/zap"
+)
+
+func newTestServiceManager(bus *fakebus.Bus, reset bool) *systemDServiceManager {
+	bus.Journal = fakebus.NewJournal()
+
+	return &systemDServiceManager{
+		systemd: systemd.New(systemd.Params{
+			Bus:          bus,
+			Journal:      bus.Journal,
+			PollInterval: time.Millisecond,
+		}),
+		reset:  reset,
+		logger: *zap.NewNop(),
+	}
+}
+
+func TestRunInfluxD(t *testing.T) {
+	tests := []struct {
+		name    string
+		unit    fakebus.Unit
+		wantErr string
+	}{
+		{"starts", fakebus.Unit{}, ""},
+		{"fails", fakebus.Unit{Fail: true, Result: "exit-code", Log: []string{"error: bolt path is not writable"}}, "journal:\nerror: bolt path is not writable"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bus := fakebus.New()
+			bus.SetUnit("influxd.service", tt.unit)
+			esm := newTestServiceManager(bus, false)
+
+			err := esm.RunInfluxD()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("RunInfluxD() = %v, want an error containing %q", err, tt.wantErr)
+			}
+
+			if len(bus.Jobs) != 1 || bus.Jobs[0] != "reload-or-restart influxd.service" {
+				t.Errorf("jobs are %q, want one reload-or-restart", bus.Jobs)
+			}
+		})
+	}
+}
+
+func TestStop(t *testing.T) {
+	tests := []struct {
+		name      string
+		installed bool
+	}{
+		{"running", true},
+		{"not installed", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bus := fakebus.New()
+			if tt.installed {
+				bus.SetUnit("influxd.service", fakebus.Unit{ActiveState: "active", SubState: "running"})
+				bus.SetUnit("victoriametrics.service", fakebus.Unit{ActiveState: "active", SubState: "running"})
+			}
+			esm := newTestServiceManager(bus, false)
+
+			if err := esm.StopInfluxD(); err != nil {
+				t.Errorf("StopInfluxD() = %v, want nil", err)
+			}
+			if err := esm.StopVictoriaMetrics(); err != nil {
+				t.Errorf("StopVictoriaMetrics() = %v, want nil", err)
+			}
+
+			for _, name := range []string{"influxd.service", "victoriametrics.service"} {
+				if unit, ok := bus.Unit(name); ok && unit.ActiveState != "inactive" {
+					t.Errorf("%s is %s, want inactive", name, unit.ActiveState)
+				}
+			}
+		})
+	}
+}
+
+func TestRunVictoriaMetricsReset(t *testing.T) {
+	tests := []struct {
+		name      string
+		installed bool
+		wantErr   bool
+	}{
+		{"installed", true, false},
+		// the data is still reset, starting the missing unit fails
+		{"not installed", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dataPath := filepath.Join(t.TempDir(), "victoria-metrics")
+			if err := os.MkdirAll(filepath.Join(dataPath, "data"), 0700); err != nil {
+				t.Fatal(err)
+			}
+
+			bus := fakebus.New()
+			if tt.installed {
+				bus.SetUnit("victoriametrics.service", fakebus.Unit{ActiveState: "active", SubState: "running"})
+			}
+			esm := newTestServiceManager(bus, true)
+
+			err := esm.RunVictoriaMetrics(victoriametrics.RunParams{DataPath: dataPath})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RunVictoriaMetrics() = %v, want error %v", err, tt.wantErr)
+			}
+			if _, err := os.Stat(dataPath); !os.IsNotExist(err) {
+				t.Errorf("data path wasn't reset: %v", err)
+			}
+
+			if tt.installed {
+				want := []string{"stop victoriametrics.service", "reload-or-restart victoriametrics.service"}
+				if strings.Join(bus.Jobs, ",") != strings.Join(want, ",") {
+					t.Errorf("jobs are %q, want %q", bus.Jobs, want)
+				}
+			}
+		})
+	}
+}
@@ -1,41 +1,69 @@
 package storagedriver
 
 import (
-	"bytes"
+	"bufio"
+	"io"
 	"net/http"
 	"os"
 	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"go.uber.org/zap"
 )
 
+// BackupNameLayout is the time layout of backup names, the uploaded tar is
+// named after the backup with a .tar suffix.
+const BackupNameLayout = "20060102T150405Z"
+
 type StorageDriver interface {
 	GetLocalStorageLocation() string
 	UploadTar(string) error
+	// UploadReader uploads everything read from r as key.
+	UploadReader(key string, r io.Reader) error
+	// List returns the uploaded backups, oldest first.
+	List() ([]Backup, error)
+	Delete(key string) error
+	// Prune removes uploaded backups taken before olderThan.
+	Prune(olderThan time.Time) error
 }
 
-type localStorageDriver struct {
-	localStorageLocation string
-	logger               zap.Logger
+// Backup is an uploaded backup, its key is relative to the key prefix.
+type Backup struct {
+	Key  string
+	Time time.Time
+	Size int64
 }
 
-func (l *localStorageDriver) GetLocalStorageLocation() string {
-	return l.localStorageLocation
-}
+// backupTime returns when the backup an object is named after was taken.
+// Streamed backups may carry more extensions than .tar.
+func backupTime(key string) (time.Time, bool) {
+	name := path.Base(key)
+	if !strings.Contains(name, ".tar") {
+		return time.Time{}, false
+	}
 
-func (l *localStorageDriver) UploadTar(directoryName string) error {
-	// noop for local
-	return nil
+	t, err := time.Parse(BackupNameLayout, strings.SplitN(name, ".", 2)[0])
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return t, true
 }
 
 type s3StorageDriver struct {
 	localStorageLocation string
+	keyPrefix            string
 	region               string
 	bucket               string
 	awsSession           *session.Session
+	limiter              Limiter
 	logger               zap.Logger
 }
 
@@ -54,35 +82,136 @@ func (l *s3StorageDriver) UploadTar(directoryName string) error {
 	}
 	defer file.Close()
 
-	fileInfo, _ := file.Stat()
-	var size int64 = fileInfo.Size()
-	buffer := make([]byte, size)
-	file.Read(buffer)
+	return l.UploadReader(directoryName, file)
+}
+
+func (l *s3StorageDriver) UploadReader(key string, r io.Reader) error {
+	reader := bufio.NewReader(r)
+	// the error is io.EOF for streams shorter than what is sniffed
+	head, _ := reader.Peek(512)
 
-	_, err = s3.New(l.awsSession).PutObject(&s3.PutObjectInput{
+	// the uploader sends parts as they are read, so throttling the reader
+	// throttles the upload
+	_, err := s3manager.NewUploader(l.awsSession).Upload(&s3manager.UploadInput{
 		Bucket:             aws.String(l.bucket),
-		Key:                aws.String(directoryName),
-		Body:               bytes.NewReader(buffer),
-		ContentLength:      aws.Int64(size),
-		ContentType:        aws.String(http.DetectContentType(buffer)),
+		Key:                aws.String(path.Join(l.keyPrefix, key)),
+		Body:               l.limiter.Reader(reader),
+		ContentType:        aws.String(http.DetectContentType(head)),
 		ContentDisposition: aws.String("attachment"),
 	})
 
 	return err
 }
 
+func (l *s3StorageDriver) prefix() string {
+	if l.keyPrefix == "" {
+		return ""
+	}
+
+	return l.keyPrefix + "/"
+}
+
+func (l *s3StorageDriver) List() ([]Backup, error) {
+	backups := []Backup{}
+	err := s3.New(l.awsSession).ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket:    aws.String(l.bucket),
+		Prefix:    aws.String(l.prefix()),
+		Delimiter: aws.String("/"),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			taken, ok := backupTime(aws.StringValue(object.Key))
+			if ok {
+				backups = append(backups, Backup{
+					Key:  strings.TrimPrefix(aws.StringValue(object.Key), l.prefix()),
+					Time: taken,
+					Size: aws.Int64Value(object.Size),
+				})
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Time.Before(backups[j].Time)
+	})
+
+	return backups, nil
+}
+
+func (l *s3StorageDriver) Delete(key string) error {
+	_, err := s3.New(l.awsSession).DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(l.bucket),
+		Key:    aws.String(path.Join(l.keyPrefix, key)),
+	})
+
+	return err
+}
+
+// Prune only deletes objects below the key prefix that are named like a
+// backup, so other objects in a shared bucket are left alone.
+func (l *s3StorageDriver) Prune(olderThan time.Time) error {
+	backups, err := l.List()
+	if err != nil {
+		return err
+	}
+
+	expired := []*s3.ObjectIdentifier{}
+	for _, backup := range backups {
+		if backup.Time.Before(olderThan) {
+			expired = append(expired, &s3.ObjectIdentifier{
+				Key: aws.String(path.Join(l.keyPrefix, backup.Key)),
+			})
+		}
+	}
+
+	client := s3.New(l.awsSession)
+
+	// DeleteObjects takes at most 1000 keys per request
+	for len(expired) > 0 {
+		batch := expired
+		if len(batch) > 1000 {
+			batch = batch[:1000]
+		}
+		expired = expired[len(batch):]
+
+		_, err = client.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: aws.String(l.bucket),
+			Delete: &s3.Delete{
+				Objects: batch,
+				Quiet:   aws.Bool(true),
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 type S3StorageDriverParams struct {
 	Region string
 	Bucket string
 }
 
 type StorageDriverParams struct {
-	LocalStorageLocation  string
-	S3StorageDriverParams *S3StorageDriverParams
-	Logger                zap.Logger
+	LocalStorageLocation     string
+	KeyPrefix                string
+	S3StorageDriverParams    *S3StorageDriverParams
+	LocalStorageDriverParams LocalStorageDriverParams
+	Limiter                  Limiter
+	Logger                   zap.Logger
 }
 
 func NewStorageDriver(params StorageDriverParams) (StorageDriver, error) {
+	limiter := params.Limiter
+	if limiter == nil {
+		limiter = NewLimiter(LimiterParams{})
+	}
+
 	if params.S3StorageDriverParams != nil {
 		sess, err := session.NewSession(&aws.Config{
 			Region: aws.String(params.S3StorageDriverParams.Region)})
@@ -94,12 +223,24 @@ func NewStorageDriver(params StorageDriverParams) (StorageDriver, error) {
 			region:               params.S3StorageDriverParams.Region,
 			bucket:               params.S3StorageDriverParams.Bucket,
 			localStorageLocation: params.LocalStorageLocation,
+			keyPrefix:            params.KeyPrefix,
 			awsSession:           sess,
+			limiter:              limiter,
+			logger:               params.Logger,
 		}, nil
 	}
 
+	archivePath := params.LocalStorageDriverParams.ArchivePath
+	if archivePath == "" {
+		archivePath = filepath.Join(params.LocalStorageLocation, DefaultArchiveDirectory)
+	}
+
 	return &localStorageDriver{
 		localStorageLocation: params.LocalStorageLocation,
+		archivePath:          archivePath,
+		keyPrefix:            params.KeyPrefix,
+		requireMount:         params.LocalStorageDriverParams.RequireMount,
+		limiter:              limiter,
 		logger:               params.Logger,
 	}, nil
 }
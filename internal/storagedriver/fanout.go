@@ -0,0 +1,345 @@
+package storagedriver
+
+import (
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+const (
+	// SuccessAll requires every required target to accept a backup.
+	SuccessAll = "all"
+	// SuccessAny requires at least one required target to accept a backup.
+	SuccessAny = "any"
+	// SuccessQuorum requires more than half of the required targets to
+	// accept a backup.
+	SuccessQuorum = "quorum"
+)
+
+// retryDelay is multiplied by the attempt number between upload retries.
+var retryDelay = 5 * time.Second
+
+var (
+	uploadsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "morgue_storage_uploads_total",
+		Help: "Backup uploads per storage target and result.",
+	}, []string{"target", "result"})
+
+	uploadDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "morgue_storage_upload_duration_seconds",
+		Help:    "Time spent uploading a backup to a storage target, including retries.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+	}, []string{"target"})
+
+	lastSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "morgue_storage_last_success_timestamp_seconds",
+		Help: "Unix time of the last backup a storage target accepted.",
+	}, []string{"target"})
+)
+
+// Target is one destination of a fan-out driver.
+type Target struct {
+	Name   string
+	Driver StorageDriver
+	// Retention prunes backups of this target older than it after every
+	// successful upload, 0 keeps them forever.
+	Retention time.Duration
+	// Retries is how many more times a failed upload is attempted.
+	Retries int
+	// Optional targets are uploaded to but don't count towards the success
+	// policy.
+	Optional bool
+}
+
+type FanOutParams struct {
+	LocalStorageLocation string
+	Targets              []Target
+	// Success is one of SuccessAll, SuccessAny or SuccessQuorum.
+	Success string
+	// MeteredCheck defers uploads while the link is expensive, nil never
+	// defers them.
+	MeteredCheck         MeteredCheck
+	MeteredCheckInterval time.Duration
+	Logger               zap.Logger
+}
+
+type fanOutDriver struct {
+	localStorageLocation string
+	targets              []Target
+	success              string
+	meteredCheck         MeteredCheck
+	meteredCheckInterval time.Duration
+	logger               zap.Logger
+}
+
+// NewFanOutDriver returns a driver that uploads every backup to all targets
+// at once.
+func NewFanOutDriver(params FanOutParams) StorageDriver {
+	success := params.Success
+	if success == "" {
+		success = SuccessAll
+	}
+
+	return &fanOutDriver{
+		localStorageLocation: params.LocalStorageLocation,
+		targets:              params.Targets,
+		success:              success,
+		meteredCheck:         params.MeteredCheck,
+		meteredCheckInterval: params.MeteredCheckInterval,
+		logger:               params.Logger,
+	}
+}
+
+func (f *fanOutDriver) GetLocalStorageLocation() string {
+	return f.localStorageLocation
+}
+
+// waitForUnmetered blocks while the metered check reports an expensive link.
+// A failing check doesn't hold uploads back.
+func (f *fanOutDriver) waitForUnmetered() {
+	if f.meteredCheck == nil {
+		return
+	}
+
+	deferred := false
+	for {
+		reason, err := f.meteredCheck.Metered()
+		if err != nil {
+			f.logger.Sugar().Warnw("metered check failed, uploading anyway", "error", err.Error())
+			return
+		}
+
+		if reason == "" {
+			if deferred {
+				f.logger.Info("link is no longer metered, resuming upload")
+			}
+			return
+		}
+
+		if !deferred {
+			f.logger.Sugar().Infow("deferring upload", "reason", reason)
+			deferred = true
+		}
+		time.Sleep(f.meteredCheckInterval)
+	}
+}
+
+func (f *fanOutDriver) UploadTar(directoryName string) error {
+	f.waitForUnmetered()
+
+	errs := make([]error, len(f.targets))
+
+	var wg sync.WaitGroup
+	for i, target := range f.targets {
+		wg.Add(1)
+		go func(i int, target Target) {
+			defer wg.Done()
+			errs[i] = f.upload(target, target.Retries, func() error {
+				return target.Driver.UploadTar(directoryName)
+			})
+		}(i, target)
+	}
+	wg.Wait()
+
+	return f.result(errs)
+}
+
+// UploadReader copies r to every target at once. A stream can't be replayed,
+// so failed targets are not retried, and a target that fails stops receiving
+// data without holding back the others.
+func (f *fanOutDriver) UploadReader(key string, r io.Reader) error {
+	f.waitForUnmetered()
+
+	errs := make([]error, len(f.targets))
+	writers := make([]*io.PipeWriter, len(f.targets))
+
+	var wg sync.WaitGroup
+	for i, target := range f.targets {
+		pr, pw := io.Pipe()
+		writers[i] = pw
+
+		wg.Add(1)
+		go func(i int, target Target, pr *io.PipeReader) {
+			defer wg.Done()
+			errs[i] = f.upload(target, 0, func() error {
+				return target.Driver.UploadReader(key, pr)
+			})
+			// unblocks the copy below if the target stopped reading early
+			pr.CloseWithError(errs[i])
+		}(i, target, pr)
+	}
+
+	readErr := copyToPipes(r, writers)
+	for _, pw := range writers {
+		pw.CloseWithError(readErr)
+	}
+	wg.Wait()
+
+	if readErr != nil {
+		return readErr
+	}
+
+	return f.result(errs)
+}
+
+// copyToPipes copies r to every writer until a writer fails, after which it
+// only feeds the remaining ones.
+func copyToPipes(r io.Reader, writers []*io.PipeWriter) error {
+	alive := make([]bool, len(writers))
+	for i := range alive {
+		alive[i] = true
+	}
+
+	buffer := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buffer)
+		if n > 0 {
+			for i, pw := range writers {
+				if alive[i] {
+					if _, writeErr := pw.Write(buffer[:n]); writeErr != nil {
+						alive[i] = false
+					}
+				}
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// result applies the success policy to the upload errors of the targets.
+func (f *fanOutDriver) result(errs []error) error {
+	required, accepted := 0, 0
+	var firstErr error
+	for i, target := range f.targets {
+		if errs[i] != nil {
+			f.logger.Sugar().Warnw("upload failed", "target", target.Name, "optional", target.Optional, "error", errs[i].Error())
+		}
+
+		if target.Optional {
+			continue
+		}
+
+		required++
+		if errs[i] == nil {
+			accepted++
+		} else if firstErr == nil {
+			firstErr = errors.Wrapf(errs[i], "target %s", target.Name)
+		}
+	}
+
+	if required == 0 || f.succeeded(required, accepted) {
+		return nil
+	}
+
+	return errors.Wrapf(firstErr, "%d of %d storage targets accepted the backup, policy %s", accepted, required, f.success)
+}
+
+func (f *fanOutDriver) succeeded(required, accepted int) bool {
+	switch f.success {
+	case SuccessAny:
+		return accepted > 0
+	case SuccessQuorum:
+		return accepted > required/2
+	default:
+		return accepted == required
+	}
+}
+
+// upload retries a target until it accepts the backup, then prunes it.
+func (f *fanOutDriver) upload(target Target, retries int, upload func() error) error {
+	start := time.Now()
+
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * retryDelay)
+		}
+
+		err = upload()
+		if err == nil {
+			break
+		}
+	}
+
+	uploadDuration.WithLabelValues(target.Name).Observe(time.Since(start).Seconds())
+	if err != nil {
+		uploadsTotal.WithLabelValues(target.Name, "failure").Inc()
+		return err
+	}
+
+	uploadsTotal.WithLabelValues(target.Name, "success").Inc()
+	lastSuccess.WithLabelValues(target.Name).SetToCurrentTime()
+
+	if target.Retention > 0 {
+		pruneErr := target.Driver.Prune(time.Now().Add(-target.Retention))
+		if pruneErr != nil {
+			f.logger.Sugar().Warnw("unable to prune old backups", "target", target.Name, "error", pruneErr.Error())
+		}
+	}
+
+	return nil
+}
+
+// List returns the backups found on any target.
+func (f *fanOutDriver) List() ([]Backup, error) {
+	seen := map[string]bool{}
+	backups := []Backup{}
+	for _, target := range f.targets {
+		targetBackups, err := target.Driver.List()
+		if err != nil {
+			return nil, errors.Wrapf(err, "target %s", target.Name)
+		}
+
+		for _, backup := range targetBackups {
+			if !seen[backup.Key] {
+				seen[backup.Key] = true
+				backups = append(backups, backup)
+			}
+		}
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Time.Before(backups[j].Time)
+	})
+
+	return backups, nil
+}
+
+// Delete removes a backup from every target that has it.
+func (f *fanOutDriver) Delete(key string) error {
+	var firstErr error
+	for _, target := range f.targets {
+		err := target.Driver.Delete(key)
+		if err != nil && !os.IsNotExist(err) && firstErr == nil {
+			firstErr = errors.Wrapf(err, "target %s", target.Name)
+		}
+	}
+
+	return firstErr
+}
+
+// Prune removes backups taken before olderThan from every target.
+func (f *fanOutDriver) Prune(olderThan time.Time) error {
+	var firstErr error
+	for _, target := range f.targets {
+		err := target.Driver.Prune(olderThan)
+		if err != nil && firstErr == nil {
+			firstErr = errors.Wrapf(err, "target %s", target.Name)
+		}
+	}
+
+	return firstErr
+}
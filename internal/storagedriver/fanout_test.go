@@ -0,0 +1,351 @@
+package storagedriver
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// fakeTarget fails its first failures uploads, or all of them when failures
+// is negative.
+type fakeTarget struct {
+	failures int
+
+	lock     sync.Mutex
+	attempts int
+	uploaded map[string][]byte
+	pruned   []time.Time
+}
+
+func (f *fakeTarget) fail() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.attempts++
+	if f.failures < 0 || f.attempts <= f.failures {
+		return errors.New("target unavailable")
+	}
+
+	return nil
+}
+
+func (f *fakeTarget) GetLocalStorageLocation() string {
+	return ""
+}
+
+func (f *fakeTarget) UploadTar(directoryName string) error {
+	return f.UploadReader(directoryName, strings.NewReader("tar"))
+}
+
+func (f *fakeTarget) UploadReader(key string, r io.Reader) error {
+	if err := f.fail(); err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.uploaded == nil {
+		f.uploaded = map[string][]byte{}
+	}
+	f.uploaded[key] = data
+
+	return nil
+}
+
+func (f *fakeTarget) List() ([]Backup, error) {
+	return nil, nil
+}
+
+func (f *fakeTarget) Delete(key string) error {
+	return nil
+}
+
+func (f *fakeTarget) Prune(olderThan time.Time) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.pruned = append(f.pruned, olderThan)
+
+	return nil
+}
+
+// noRetryDelay makes retries immediate for the duration of a test.
+func noRetryDelay(t *testing.T) {
+	t.Helper()
+
+	delay := retryDelay
+	retryDelay = 0
+	t.Cleanup(func() { retryDelay = delay })
+}
+
+func TestFanOutPolicy(t *testing.T) {
+	type target struct {
+		fails    bool
+		optional bool
+	}
+
+	tests := []struct {
+		name    string
+		success string
+		targets []target
+		wantErr bool
+	}{
+		{"all accepted", SuccessAll, []target{{}, {}}, false},
+		{"all, one failed", SuccessAll, []target{{}, {fails: true}}, true},
+		{"all, optional failed", SuccessAll, []target{{}, {fails: true, optional: true}}, false},
+		{"default is all", "", []target{{}, {fails: true}}, true},
+		{"any, one accepted", SuccessAny, []target{{fails: true}, {}}, false},
+		{"any, none accepted", SuccessAny, []target{{fails: true}, {fails: true}}, true},
+		{"any, only optional accepted", SuccessAny, []target{{fails: true}, {optional: true}}, true},
+		{"quorum of three", SuccessQuorum, []target{{}, {}, {fails: true}}, false},
+		{"quorum, half accepted", SuccessQuorum, []target{{}, {fails: true}}, true},
+		{"quorum ignores optional", SuccessQuorum, []target{{}, {}, {fails: true}, {fails: true, optional: true}}, false},
+		{"only optional targets", SuccessAll, []target{{fails: true, optional: true}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			targets := []Target{}
+			for i, target := range tt.targets {
+				failures := 0
+				if target.fails {
+					failures = -1
+				}
+				targets = append(targets, Target{
+					Name:     string(rune('a' + i)),
+					Driver:   &fakeTarget{failures: failures},
+					Optional: target.optional,
+				})
+			}
+
+			driver := NewFanOutDriver(FanOutParams{
+				Targets: targets,
+				Success: tt.success,
+				Logger:  *zap.NewNop(),
+			})
+
+			err := driver.UploadTar("20240301T120000Z.tar")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("UploadTar() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFanOutRetries(t *testing.T) {
+	noRetryDelay(t)
+
+	tests := []struct {
+		name         string
+		failures     int
+		retries      int
+		wantAttempts int
+		wantErr      bool
+	}{
+		{"first attempt", 0, 2, 1, false},
+		{"succeeds on retry", 2, 2, 3, false},
+		{"out of retries", 3, 2, 3, true},
+		{"no retries", 1, 0, 1, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := &fakeTarget{failures: tt.failures}
+			driver := NewFanOutDriver(FanOutParams{
+				Targets: []Target{{
+					Name:      "a",
+					Driver:    target,
+					Retries:   tt.retries,
+					Retention: time.Hour,
+				}},
+				Logger: *zap.NewNop(),
+			})
+
+			err := driver.UploadTar("20240301T120000Z.tar")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("UploadTar() = %v, want error %v", err, tt.wantErr)
+			}
+			if target.attempts != tt.wantAttempts {
+				t.Errorf("target was attempted %d times, want %d", target.attempts, tt.wantAttempts)
+			}
+
+			// only a target that accepted the backup is pruned
+			if wantPruned := !tt.wantErr; (len(target.pruned) == 1) != wantPruned {
+				t.Errorf("target was pruned %d times, want pruned %v", len(target.pruned), wantPruned)
+			}
+		})
+	}
+}
+
+func TestFanOutUploadReader(t *testing.T) {
+	noRetryDelay(t)
+
+	failing := &fakeTarget{failures: 1}
+	targets := []*fakeTarget{{}, failing, {}}
+	driver := NewFanOutDriver(FanOutParams{
+		Targets: []Target{
+			{Name: "a", Driver: targets[0]},
+			{Name: "b", Driver: targets[1], Retries: 2, Optional: true},
+			{Name: "c", Driver: targets[2]},
+		},
+		Logger: *zap.NewNop(),
+	})
+
+	data := bytes.Repeat([]byte("morgue"), 100000)
+	if err := driver.UploadReader("20240301T120000Z.tar.gz", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, target := range targets {
+		if target == failing {
+			// a stream can't be replayed
+			if target.attempts != 1 {
+				t.Errorf("failed target was attempted %d times, want 1", target.attempts)
+			}
+			continue
+		}
+
+		if !bytes.Equal(target.uploaded["20240301T120000Z.tar.gz"], data) {
+			t.Errorf("target %d received %d bytes, want %d", i, len(target.uploaded["20240301T120000Z.tar.gz"]), len(data))
+		}
+	}
+}
+
+// brokenReader returns part of a stream, then fails.
+type brokenReader struct {
+	sent bool
+}
+
+func (b *brokenReader) Read(p []byte) (int, error) {
+	if b.sent {
+		return 0, errors.New("connection reset")
+	}
+	b.sent = true
+
+	return copy(p, "partial"), nil
+}
+
+func newTestLocalDriver(t *testing.T) (StorageDriver, string) {
+	t.Helper()
+
+	archivePath := t.TempDir()
+	driver, err := NewStorageDriver(StorageDriverParams{
+		LocalStorageLocation:     t.TempDir(),
+		KeyPrefix:                "host",
+		LocalStorageDriverParams: LocalStorageDriverParams{ArchivePath: archivePath},
+		Logger:                   *zap.NewNop(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return driver, filepath.Join(archivePath, "host")
+}
+
+func TestLocalUploadReader(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		reader  io.Reader
+		want    string
+		wantErr bool
+	}{
+		{"complete", "20240301T120000Z.tar", strings.NewReader("backup"), "backup", false},
+		{"broken stream", "20240301T120000Z.tar", &brokenReader{}, "", true},
+		{"key outside the archive", "../20240301T120000Z.tar", strings.NewReader("backup"), "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			driver, directory := newTestLocalDriver(t)
+
+			err := driver.UploadReader(tt.key, tt.reader)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UploadReader() = %v, want error %v", err, tt.wantErr)
+			}
+
+			// a failed upload leaves neither the archive nor its temporary file
+			entries, err := ioutil.ReadDir(directory)
+			if err != nil && !os.IsNotExist(err) {
+				t.Fatal(err)
+			}
+			names := []string{}
+			for _, entry := range entries {
+				names = append(names, entry.Name())
+			}
+
+			if tt.wantErr {
+				if len(names) != 0 {
+					t.Errorf("archive holds %q after a failed upload, want nothing", names)
+				}
+				return
+			}
+
+			if len(names) != 1 || names[0] != tt.key {
+				t.Fatalf("archive holds %q, want only %s", names, tt.key)
+			}
+			data, err := ioutil.ReadFile(filepath.Join(directory, tt.key))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.want {
+				t.Errorf("archive holds %q, want %q", data, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocalPrune(t *testing.T) {
+	driver, directory := newTestLocalDriver(t)
+
+	keys := []string{
+		"20240301T100000Z.tar",
+		"20240301T110000Z.blackbox.tar",
+		"20240301T120000Z.tar.gz",
+		"20240301T130000Z.tar",
+	}
+	for _, key := range keys {
+		if err := driver.UploadReader(key, strings.NewReader(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// files not named like a backup are left alone
+	if err := ioutil.WriteFile(filepath.Join(directory, "notes.txt"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := driver.Prune(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+
+	backups, err := driver.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, backup := range backups {
+		got = append(got, backup.Key)
+	}
+	if want := keys[2:]; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("backups after prune are %q, want %q", got, want)
+	}
+
+	if _, err := os.Stat(filepath.Join(directory, "notes.txt")); err != nil {
+		t.Errorf("prune removed a file that isn't a backup: %v", err)
+	}
+}
@@ -0,0 +1,220 @@
+package storagedriver
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// DefaultArchiveDirectory is where the local driver keeps archives, below the
+// backup path, when no archive path is configured.
+const DefaultArchiveDirectory = "archive"
+
+// LocalStorageDriverParams configure the driver used when no
+// S3StorageDriverParams are set.
+type LocalStorageDriverParams struct {
+	// ArchivePath is the directory archives are kept in, below a
+	// subdirectory named after the key prefix.
+	ArchivePath string
+	// RequireMount refuses to write unless ArchivePath is a mount point, so
+	// an unplugged USB drive or NFS share doesn't fill the root filesystem.
+	RequireMount bool
+}
+
+type localStorageDriver struct {
+	localStorageLocation string
+	archivePath          string
+	keyPrefix            string
+	requireMount         bool
+	limiter              Limiter
+	logger               zap.Logger
+}
+
+func (l *localStorageDriver) GetLocalStorageLocation() string {
+	return l.localStorageLocation
+}
+
+// directory returns the per host directory of the archive, creating it.
+func (l *localStorageDriver) directory() (string, error) {
+	if l.requireMount {
+		mounted, err := isMountPoint(l.archivePath)
+		if err != nil {
+			return "", err
+		}
+		if !mounted {
+			return "", fmt.Errorf("%s is not a mount point", l.archivePath)
+		}
+	}
+
+	directory := filepath.Join(l.archivePath, l.keyPrefix)
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return "", err
+	}
+
+	return directory, nil
+}
+
+func (l *localStorageDriver) UploadTar(directoryName string) error {
+	file, err := os.Open(path.Join(l.localStorageLocation, directoryName))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// copy rather than rename, other targets may still be reading the tar
+	return l.UploadReader(directoryName, file)
+}
+
+// UploadReader writes r to a temporary file next to the archive, syncs it and
+// renames it into place, so the archive never holds a partial backup.
+func (l *localStorageDriver) UploadReader(key string, r io.Reader) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	directory, err := l.directory()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(directory, "."+key+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, l.limiter.Reader(r)); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), filepath.Join(directory, key)); err != nil {
+		return err
+	}
+
+	return syncDirectory(directory)
+}
+
+func (l *localStorageDriver) List() ([]Backup, error) {
+	directory, err := l.directory()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	backups := []Backup{}
+	for _, entry := range entries {
+		if !entry.Mode().IsRegular() {
+			continue
+		}
+
+		taken, ok := backupTime(entry.Name())
+		if !ok {
+			continue
+		}
+
+		backups = append(backups, Backup{
+			Key:  entry.Name(),
+			Time: taken,
+			Size: entry.Size(),
+		})
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Time.Before(backups[j].Time)
+	})
+
+	return backups, nil
+}
+
+func (l *localStorageDriver) Delete(key string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	directory, err := l.directory()
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(filepath.Join(directory, key)); err != nil {
+		return err
+	}
+
+	return syncDirectory(directory)
+}
+
+func (l *localStorageDriver) Prune(olderThan time.Time) error {
+	backups, err := l.List()
+	if err != nil {
+		return err
+	}
+
+	for _, backup := range backups {
+		if !backup.Time.Before(olderThan) {
+			continue
+		}
+
+		if err := l.Delete(backup.Key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkKey makes sure a key names a file directly inside the archive.
+func checkKey(key string) error {
+	if key == "" || key != filepath.Base(key) || key == "." || key == ".." {
+		return fmt.Errorf("invalid backup key %q", key)
+	}
+
+	return nil
+}
+
+// syncDirectory makes a rename or removal in directory durable.
+func syncDirectory(directory string) error {
+	dir, err := os.Open(directory)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
+// isMountPoint reports whether directory is on a different device than its
+// parent, or is the root.
+func isMountPoint(directory string) (bool, error) {
+	var stat, parent syscall.Stat_t
+	if err := syscall.Stat(directory, &stat); err != nil {
+		return false, err
+	}
+
+	if err := syscall.Stat(filepath.Join(directory, ".."), &parent); err != nil {
+		return false, err
+	}
+
+	return stat.Dev != parent.Dev || stat.Ino == parent.Ino, nil
+}
@@ -0,0 +1,120 @@
+package storagedriver
+
+import (
+	"context"
+	"os/exec"
+	"time"
+
+	godbus "github.com/godbus/dbus/v5"
+	"github.com/pkg/errors"
+)
+
+// checkTimeout bounds the metered check command and the NetworkManager query.
+const checkTimeout = 30 * time.Second
+
+// nmName is both the bus name and the interface of NetworkManager.
+const (
+	nmName = "org.freedesktop.NetworkManager"
+	nmPath = "/org/freedesktop/NetworkManager"
+)
+
+// NetworkManager's NMMetered values that mean the connection is metered.
+const (
+	nmMeteredYes      = 1
+	nmMeteredGuessYes = 3
+)
+
+// MeteredCheck tells whether uploads should wait for a cheaper link.
+type MeteredCheck interface {
+	// Metered returns why the link is expensive, or an empty string when
+	// uploads may go ahead.
+	Metered() (string, error)
+}
+
+type MeteredCheckParams struct {
+	// NetworkManager defers uploads while NetworkManager reports the primary
+	// connection as metered.
+	NetworkManager bool
+	// Command is run with sh -c, exiting with status 0 means the link is
+	// expensive.
+	Command string
+}
+
+type meteredCheck struct {
+	networkManager bool
+	command        string
+}
+
+func NewMeteredCheck(params MeteredCheckParams) MeteredCheck {
+	return &meteredCheck{
+		networkManager: params.NetworkManager,
+		command:        params.Command,
+	}
+}
+
+func (m *meteredCheck) Metered() (string, error) {
+	if m.networkManager {
+		metered, err := networkManagerMetered()
+		if err != nil {
+			return "", errors.Wrap(err, "unable to query NetworkManager")
+		}
+		if metered {
+			return "NetworkManager reports a metered connection", nil
+		}
+	}
+
+	if m.command != "" {
+		expensive, err := runCheckCommand(m.command)
+		if err != nil {
+			return "", errors.Wrap(err, "unable to run metered check command")
+		}
+		if expensive {
+			return "check command reports an expensive link", nil
+		}
+	}
+
+	return "", nil
+}
+
+func networkManagerMetered() (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+
+	conn, err := godbus.ConnectSystemBus(godbus.WithContext(ctx))
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	var property godbus.Variant
+	err = conn.Object(nmName, nmPath).
+		CallWithContext(ctx, "org.freedesktop.DBus.Properties.Get", 0, nmName, "Metered").
+		Store(&property)
+	if err != nil {
+		return false, err
+	}
+
+	value, ok := property.Value().(uint32)
+	if !ok {
+		return false, errors.Errorf("unexpected Metered property %s", property)
+	}
+
+	return value == nmMeteredYes || value == nmMeteredGuessYes, nil
+}
+
+func runCheckCommand(command string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+
+	err := exec.CommandContext(ctx, "sh", "-c", command).Run()
+	if err == nil {
+		return true, nil
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && ctx.Err() == nil {
+		return false, nil
+	}
+
+	return false, err
+}
@@ -0,0 +1,134 @@
+package storagedriver
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/zawachte/morgue/internal/schedule"
+)
+
+// maxChunk bounds a single throttled read so low limits don't stall on one
+// large read.
+const maxChunk = 32 * 1024
+
+// Limiter caps the upload bandwidth of the storage drivers.
+type Limiter interface {
+	// Wait blocks until n more bytes may be sent.
+	Wait(n int)
+	// Reader returns r throttled by the limiter.
+	Reader(r io.Reader) io.Reader
+}
+
+// LimitWindow applies a different limit during a daily time window.
+type LimitWindow struct {
+	Window         schedule.Window
+	BytesPerSecond int64
+}
+
+type LimiterParams struct {
+	// BytesPerSecond is the limit outside of the windows, 0 is unlimited.
+	BytesPerSecond int64
+	// Windows are checked in order, the first one containing the current time
+	// sets the limit.
+	Windows []LimitWindow
+}
+
+type limiter struct {
+	bytesPerSecond int64
+	windows        []LimitWindow
+
+	// now and sleep are replaced by the tests
+	now   func() time.Time
+	sleep func(time.Duration)
+
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a token bucket limiter that allows bursts of up to one
+// second worth of bytes. Limiters are safe to share between uploads, which
+// then split the bandwidth.
+func NewLimiter(params LimiterParams) Limiter {
+	return &limiter{
+		bytesPerSecond: params.BytesPerSecond,
+		windows:        params.Windows,
+		now:            time.Now,
+		sleep:          time.Sleep,
+	}
+}
+
+func (l *limiter) rate(t time.Time) int64 {
+	for _, window := range l.windows {
+		if window.Window.Contains(t) {
+			return window.BytesPerSecond
+		}
+	}
+
+	return l.bytesPerSecond
+}
+
+func (l *limiter) Wait(n int) {
+	if delay := l.reserve(n); delay > 0 {
+		l.sleep(delay)
+	}
+}
+
+// reserve takes n tokens and returns how long to wait for them. Tokens go
+// negative while in debt, so concurrent uploads wait for each other's bytes
+// without holding the lock.
+func (l *limiter) reserve(n int) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := l.now()
+	rate := l.rate(now)
+	if rate <= 0 {
+		l.last = time.Time{}
+		return 0
+	}
+
+	if l.last.IsZero() {
+		l.tokens = float64(rate)
+	} else {
+		l.tokens += now.Sub(l.last).Seconds() * float64(rate)
+	}
+	if l.tokens > float64(rate) {
+		l.tokens = float64(rate)
+	}
+
+	l.tokens -= float64(n)
+	l.last = now
+
+	if l.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-l.tokens / float64(rate) * float64(time.Second))
+}
+
+func (l *limiter) Reader(r io.Reader) io.Reader {
+	return &throttledReader{
+		reader:  r,
+		limiter: l,
+	}
+}
+
+type throttledReader struct {
+	reader  io.Reader
+	limiter Limiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > maxChunk {
+		p = p[:maxChunk]
+	}
+
+	n, err := t.reader.Read(p)
+	if n > 0 {
+		t.limiter.Wait(n)
+	}
+
+	return n, err
+}
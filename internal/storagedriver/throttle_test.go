@@ -0,0 +1,223 @@
+package storagedriver
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zawachte/morgue/internal/schedule"
+)
+
+// fakeClock stands in for time.Now and time.Sleep, sleeping advances it.
+type fakeClock struct {
+	lock   sync.Mutex
+	now    time.Time
+	slept  []time.Duration
+	frozen bool
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.slept = append(c.slept, d)
+	if !c.frozen {
+		c.now = c.now.Add(d)
+	}
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+func newTestLimiter(t *testing.T, params LimiterParams, clock *fakeClock) *limiter {
+	t.Helper()
+
+	l := NewLimiter(params).(*limiter)
+	l.now = clock.Now
+	l.sleep = clock.Sleep
+
+	return l
+}
+
+func window(t *testing.T, w string) schedule.Window {
+	t.Helper()
+
+	parsed, err := schedule.ParseWindow(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return parsed
+}
+
+func at(hour, min int) time.Time {
+	return time.Date(2024, 3, 1, hour, min, 0, 0, time.Local)
+}
+
+func TestLimiterRate(t *testing.T) {
+	tests := []struct {
+		name string
+		at   time.Time
+		want int64
+	}{
+		{"outside the windows", at(7, 59), 1000},
+		{"in a window", at(8, 0), 100},
+		{"end of a window", at(18, 0), 1000},
+		{"second of overlapping windows", at(17, 0), 500},
+		{"first of overlapping windows", at(16, 30), 100},
+		{"window spanning midnight, evening", at(23, 0), 0},
+		{"window spanning midnight, morning", at(1, 59), 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestLimiter(t, LimiterParams{
+				BytesPerSecond: 1000,
+				Windows: []LimitWindow{
+					{Window: window(t, "08:00-17:00"), BytesPerSecond: 100},
+					{Window: window(t, "16:00-18:00"), BytesPerSecond: 500},
+					{Window: window(t, "22:00-02:00"), BytesPerSecond: 0},
+				},
+			}, &fakeClock{})
+
+			if got := l.rate(tt.at); got != tt.want {
+				t.Errorf("rate(%s) = %d, want %d", tt.at.Format("15:04"), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimiterWait(t *testing.T) {
+	type step struct {
+		// advance moves the clock before the wait
+		advance time.Duration
+		n       int
+		want    time.Duration
+	}
+
+	tests := []struct {
+		name  string
+		start time.Time
+		steps []step
+	}{
+		{"unlimited", at(23, 0), []step{
+			{0, 1 << 20, 0},
+			{0, 1 << 20, 0},
+		}},
+		{"burst of one second", at(12, 0), []step{
+			{0, 100, 0},
+			{0, 50, 500 * time.Millisecond},
+		}},
+		{"refills over time", at(12, 0), []step{
+			{0, 100, 0},
+			{500 * time.Millisecond, 50, 0},
+			{0, 50, 500 * time.Millisecond},
+		}},
+		{"idle doesn't grow the burst", at(12, 0), []step{
+			{0, 1, 0},
+			{time.Minute, 100, 0},
+			{0, 100, time.Second},
+		}},
+		{"outside the window", at(18, 0), []step{
+			{0, 1000, 0},
+			{0, 500, 500 * time.Millisecond},
+		}},
+		{"window opens", at(21, 59), []step{
+			{0, 1000, 0},
+			{time.Minute, 1 << 20, 0},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &fakeClock{now: tt.start}
+			l := newTestLimiter(t, LimiterParams{
+				BytesPerSecond: 1000,
+				Windows: []LimitWindow{
+					{Window: window(t, "08:00-17:00"), BytesPerSecond: 100},
+					{Window: window(t, "22:00-02:00"), BytesPerSecond: 0},
+				},
+			}, clock)
+
+			for i, step := range tt.steps {
+				clock.Advance(step.advance)
+				clock.slept = nil
+
+				l.Wait(step.n)
+
+				got := time.Duration(0)
+				for _, d := range clock.slept {
+					got += d
+				}
+				if got != step.want {
+					t.Errorf("step %d: Wait(%d) slept %v, want %v", i, step.n, got, step.want)
+				}
+			}
+		})
+	}
+}
+
+func TestLimiterConcurrentWaitsQueue(t *testing.T) {
+	// nobody's sleep advances the clock, like uploads waiting side by side
+	clock := &fakeClock{now: at(12, 0), frozen: true}
+	l := newTestLimiter(t, LimiterParams{BytesPerSecond: 1000}, clock)
+
+	l.Wait(1000)
+	want := []time.Duration{500 * time.Millisecond, time.Second, 1500 * time.Millisecond}
+	for i, w := range want {
+		if got := l.reserve(500); got != w {
+			t.Errorf("wait %d is %v, want %v", i, got, w)
+		}
+	}
+}
+
+// recordingLimiter records the waits of a throttled reader.
+type recordingLimiter struct {
+	waits []int
+}
+
+func (r *recordingLimiter) Wait(n int) {
+	r.waits = append(r.waits, n)
+}
+
+func (r *recordingLimiter) Reader(reader io.Reader) io.Reader {
+	return &throttledReader{reader: reader, limiter: r}
+}
+
+func TestReaderChunks(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 3*maxChunk+1)
+	limiter := &recordingLimiter{}
+
+	got, err := ioutil.ReadAll(limiter.Reader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes, want %d", len(got), len(data))
+	}
+
+	total := 0
+	for _, n := range limiter.waits {
+		if n > maxChunk {
+			t.Errorf("waited for %d bytes at once, want at most %d", n, maxChunk)
+		}
+		total += n
+	}
+	if total != len(data) {
+		t.Errorf("waited for %d bytes, want %d", total, len(data))
+	}
+}
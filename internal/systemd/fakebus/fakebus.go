@@ -0,0 +1,220 @@
+// Package fakebus provides an in-memory systemd, so code managing units can
+// be exercised without a system bus.
+package fakebus
+
+import (
+	"context"
+	"strconv"
+	"sync"
+
+	godbus "github.com/godbus/dbus/v5"
+	"github.com/pkg/errors"
+)
+
+// noSuchUnit is the error systemd returns for jobs on units it doesn't have.
+const noSuchUnit = "org.freedesktop.systemd1.NoSuchUnit"
+
+// Unit is the state of a fake unit.
+type Unit struct {
+	LoadState   string
+	ActiveState string
+	SubState    string
+	Result      string
+	// Fail makes jobs that start the unit fail with Result.
+	Fail bool
+	// Activating keeps the unit activating after a job starts it, like a
+	// unit that never finishes starting.
+	Activating bool
+	// Log is written to the journal of the bus every time the unit starts.
+	Log []string
+}
+
+// Bus implements systemd.Bus on units held in memory. Jobs finish right
+// away, starting a unit makes it active unless it is set to fail.
+type Bus struct {
+	// Journal, when set, receives the Log of units that start.
+	Journal *Journal
+
+	lock  sync.Mutex
+	units map[string]*Unit
+	// Jobs records the jobs queued, like "start influxd.service".
+	Jobs []string
+	// Reloads counts how often the unit files were reloaded.
+	Reloads int
+}
+
+func New() *Bus {
+	return &Bus{units: map[string]*Unit{}}
+}
+
+// SetUnit adds or replaces a unit.
+func (b *Bus) SetUnit(name string, unit Unit) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if unit.LoadState == "" {
+		unit.LoadState = "loaded"
+	}
+	if unit.ActiveState == "" {
+		unit.ActiveState = "inactive"
+		unit.SubState = "dead"
+	}
+	b.units[name] = &unit
+}
+
+// Unit returns the state of a unit, false when it doesn't exist.
+func (b *Bus) Unit(name string) (Unit, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	unit, ok := b.units[name]
+	if !ok {
+		return Unit{}, false
+	}
+
+	return *unit, true
+}
+
+func (b *Bus) StartUnitContext(ctx context.Context, name string, mode string, ch chan<- string) (int, error) {
+	return b.job(name, "start", true, ch)
+}
+
+func (b *Bus) StopUnitContext(ctx context.Context, name string, mode string, ch chan<- string) (int, error) {
+	return b.job(name, "stop", false, ch)
+}
+
+func (b *Bus) RestartUnitContext(ctx context.Context, name string, mode string, ch chan<- string) (int, error) {
+	return b.job(name, "restart", true, ch)
+}
+
+func (b *Bus) ReloadOrRestartUnitContext(ctx context.Context, name string, mode string, ch chan<- string) (int, error) {
+	return b.job(name, "reload-or-restart", true, ch)
+}
+
+// job applies a job to a unit and reports its result like systemd does.
+func (b *Bus) job(name, verb string, start bool, ch chan<- string) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	unit, ok := b.units[name]
+	if !ok {
+		return 0, godbus.Error{Name: noSuchUnit, Body: []interface{}{"Unit " + name + " not found."}}
+	}
+
+	b.Jobs = append(b.Jobs, verb+" "+name)
+	id := len(b.Jobs)
+
+	if start && b.Journal != nil {
+		for _, line := range unit.Log {
+			b.Journal.Log(name, line)
+		}
+	}
+
+	result := "done"
+	switch {
+	case !start:
+		unit.ActiveState, unit.SubState = "inactive", "dead"
+	case unit.Fail:
+		unit.ActiveState, unit.SubState = "failed", "failed"
+		result = "failed"
+	case unit.Activating:
+		unit.ActiveState, unit.SubState = "activating", "start"
+	default:
+		unit.ActiveState, unit.SubState, unit.Result = "active", "running", "success"
+	}
+
+	if ch != nil {
+		ch <- result
+	}
+
+	return id, nil
+}
+
+func (b *Bus) GetUnitPropertiesContext(ctx context.Context, unit string) (map[string]interface{}, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	u, ok := b.units[unit]
+	if !ok {
+		return map[string]interface{}{
+			"LoadState":   "not-found",
+			"ActiveState": "inactive",
+			"SubState":    "dead",
+		}, nil
+	}
+
+	return map[string]interface{}{
+		"LoadState":   u.LoadState,
+		"ActiveState": u.ActiveState,
+		"SubState":    u.SubState,
+	}, nil
+}
+
+func (b *Bus) GetUnitTypePropertiesContext(ctx context.Context, unit string, unitType string) (map[string]interface{}, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	u, ok := b.units[unit]
+	if !ok {
+		return nil, errors.Errorf("Unit %s not found.", unit)
+	}
+
+	return map[string]interface{}{"Result": u.Result}, nil
+}
+
+func (b *Bus) ReloadContext(ctx context.Context) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.Reloads++
+
+	return nil
+}
+
+func (b *Bus) Close() {}
+
+// Journal implements systemd.Journal on lines held in memory. Cursors are
+// line counts.
+type Journal struct {
+	lock  sync.Mutex
+	lines map[string][]string
+}
+
+func NewJournal() *Journal {
+	return &Journal{lines: map[string][]string{}}
+}
+
+// Log appends a line to the journal of unit.
+func (j *Journal) Log(unit, line string) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	j.lines[unit] = append(j.lines[unit], line)
+}
+
+func (j *Journal) Cursor(ctx context.Context, unit string) (string, error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	return strconv.Itoa(len(j.lines[unit])), nil
+}
+
+func (j *Journal) Since(ctx context.Context, unit, cursor string, lines int) ([]string, error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	start, err := strconv.Atoi(cursor)
+	if err != nil {
+		return nil, errors.Errorf("invalid cursor %q", cursor)
+	}
+
+	logged := j.lines[unit]
+	if start > len(logged) {
+		start = len(logged)
+	}
+	if len(logged)-start > lines {
+		start = len(logged) - lines
+	}
+
+	return append([]string{}, logged[start:]...), nil
+}
@@ -0,0 +1,63 @@
+package systemd
+
+import (
+	"context"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Journal reads the journal of a unit. Cursors mark a position in it.
+type Journal interface {
+	// Cursor returns the cursor of the last entry of unit, empty when it
+	// has none.
+	Cursor(ctx context.Context, unit string) (string, error)
+	// Since returns up to lines messages unit logged after cursor.
+	Since(ctx context.Context, unit, cursor string, lines int) ([]string, error)
+}
+
+// journalctl reads the journal through journalctl, the journal has no D-Bus
+// api. Reading the journal of system units needs root or the
+// systemd-journal group.
+type journalctl struct{}
+
+func NewJournalctl() Journal {
+	return journalctl{}
+}
+
+const cursorPrefix = "-- cursor: "
+
+func (journalctl) Cursor(ctx context.Context, unit string) (string, error) {
+	/* #nosec */
+	output, err := exec.CommandContext(ctx, "journalctl", "--unit="+unit, "--lines=1", "--show-cursor", "--quiet", "--output=cat").Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to read the journal of %s", unit)
+	}
+
+	for _, line := range strings.Split(string(output), "\n") {
+		if strings.HasPrefix(line, cursorPrefix) {
+			return strings.TrimPrefix(line, cursorPrefix), nil
+		}
+	}
+
+	return "", nil
+}
+
+func (journalctl) Since(ctx context.Context, unit, cursor string, lines int) ([]string, error) {
+	/* #nosec */
+	output, err := exec.CommandContext(ctx, "journalctl", "--unit="+unit, "--after-cursor="+cursor, "--lines="+strconv.Itoa(lines), "--quiet", "--no-pager", "--output=cat").Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read the journal of %s", unit)
+	}
+
+	messages := []string{}
+	for _, line := range strings.Split(strings.TrimRight(string(output), "\n"), "\n") {
+		if line != "" {
+			messages = append(messages, line)
+		}
+	}
+
+	return messages, nil
+}
@@ -0,0 +1,351 @@
+package systemd
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/dbus"
+	godbus "github.com/godbus/dbus/v5"
+	"github.com/pkg/errors"
+)
+
+const (
+	// UnitPath is where drop-ins for installed units are written.
+	UnitPath = "/etc/systemd/system"
+
+	// modeReplace replaces queued jobs of the unit, like systemctl does.
+	modeReplace = "replace"
+	jobDone     = "done"
+
+	// journalLines is how many lines of a failed unit's journal an error
+	// carries.
+	journalLines = 10
+
+	// NoSuchUnit is the D-Bus error systemd returns for jobs on units that
+	// aren't installed.
+	NoSuchUnit = "org.freedesktop.systemd1.NoSuchUnit"
+)
+
+// IsNoSuchUnit reports whether err is systemd not finding the unit of a job.
+func IsNoSuchUnit(err error) bool {
+	var dbusErr godbus.Error
+	if errors.As(err, &dbusErr) {
+		return dbusErr.Name == NoSuchUnit
+	}
+
+	var dbusErrPtr *godbus.Error
+	if errors.As(err, &dbusErrPtr) {
+		return dbusErrPtr.Name == NoSuchUnit
+	}
+
+	return false
+}
+
+// Bus is the part of the systemd D-Bus api morgue uses. A
+// *github.com/coreos/go-systemd/v22/dbus.Conn implements it, fakebus.Bus
+// stands in for it in tests.
+type Bus interface {
+	StartUnitContext(ctx context.Context, name string, mode string, ch chan<- string) (int, error)
+	StopUnitContext(ctx context.Context, name string, mode string, ch chan<- string) (int, error)
+	RestartUnitContext(ctx context.Context, name string, mode string, ch chan<- string) (int, error)
+	ReloadOrRestartUnitContext(ctx context.Context, name string, mode string, ch chan<- string) (int, error)
+	GetUnitPropertiesContext(ctx context.Context, unit string) (map[string]interface{}, error)
+	GetUnitTypePropertiesContext(ctx context.Context, unit string, unitType string) (map[string]interface{}, error)
+	ReloadContext(ctx context.Context) error
+	Close()
+}
+
+// NewSystemBus connects to systemd. As root it talks to systemd directly
+// through its private socket, which needs neither sudo nor a running
+// dbus-daemon. Otherwise it goes through the system bus, where polkit decides
+// what morgue may do.
+func NewSystemBus(ctx context.Context) (Bus, error) {
+	if os.Geteuid() == 0 {
+		conn, err := dbus.NewSystemdConnectionContext(ctx)
+		if err == nil {
+			return conn, nil
+		}
+	}
+
+	conn, err := dbus.NewSystemConnectionContext(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to connect to systemd")
+	}
+
+	return conn, nil
+}
+
+// UnitState holds the state properties of a unit.
+type UnitState struct {
+	LoadState   string
+	ActiveState string
+	SubState    string
+	// Result tells why a failed unit failed, like exit-code or timeout.
+	Result string
+}
+
+func (s UnitState) String() string {
+	state := fmt.Sprintf("%s (%s)", s.ActiveState, s.SubState)
+	if s.Result != "" && s.Result != "success" {
+		state += ", result " + s.Result
+	}
+
+	return state
+}
+
+// Systemd manages units. Starting, restarting and reloading wait for the
+// unit to become active, and errors carry the journal lines the unit logged
+// meanwhile.
+type Systemd interface {
+	Start(ctx context.Context, unit string) error
+	Stop(ctx context.Context, unit string) error
+	Restart(ctx context.Context, unit string) error
+	// ReloadOrRestart reloads the unit if it supports it, restarts it
+	// otherwise and starts it when it isn't running.
+	ReloadOrRestart(ctx context.Context, unit string) error
+	State(ctx context.Context, unit string) (UnitState, error)
+	// WaitActive blocks until the unit is active, failing as soon as it
+	// can't get there.
+	WaitActive(ctx context.Context, unit string) error
+	// InstallDropIn writes content to <unit>.d/<name>.conf and reloads
+	// systemd when it changed.
+	InstallDropIn(ctx context.Context, unit, name, content string) error
+	// JournalCursor returns the cursor of the last journal entry of unit.
+	JournalCursor(ctx context.Context, unit string) (string, error)
+}
+
+type Params struct {
+	// Bus defaults to a connection made by NewSystemBus on first use, so
+	// hosts without systemd only fail when they use it.
+	Bus Bus
+	// Journal defaults to reading the journal with journalctl.
+	Journal Journal
+	// UnitPath defaults to UnitPath.
+	UnitPath     string
+	PollInterval time.Duration
+}
+
+type systemd struct {
+	journal      Journal
+	unitPath     string
+	pollInterval time.Duration
+
+	lock sync.Mutex
+	conn Bus
+}
+
+func New(params Params) Systemd {
+	s := &systemd{
+		conn:         params.Bus,
+		journal:      params.Journal,
+		unitPath:     params.UnitPath,
+		pollInterval: params.PollInterval,
+	}
+
+	if s.journal == nil {
+		s.journal = NewJournalctl()
+	}
+	if s.unitPath == "" {
+		s.unitPath = UnitPath
+	}
+	if s.pollInterval <= 0 {
+		s.pollInterval = 500 * time.Millisecond
+	}
+
+	return s
+}
+
+func (s *systemd) bus(ctx context.Context) (Bus, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.conn == nil {
+		conn, err := NewSystemBus(ctx)
+		if err != nil {
+			return nil, err
+		}
+		s.conn = conn
+	}
+
+	return s.conn, nil
+}
+
+// unitName adds the .service suffix systemctl assumes for plain names.
+func unitName(unit string) string {
+	if strings.Contains(unit, ".") {
+		return unit
+	}
+
+	return unit + ".service"
+}
+
+type jobFunc func(ctx context.Context, name string, mode string, ch chan<- string) (int, error)
+
+func (s *systemd) Start(ctx context.Context, unit string) error {
+	return s.run(ctx, unit, "start", true, func(bus Bus) jobFunc { return bus.StartUnitContext })
+}
+
+func (s *systemd) Stop(ctx context.Context, unit string) error {
+	return s.run(ctx, unit, "stop", false, func(bus Bus) jobFunc { return bus.StopUnitContext })
+}
+
+func (s *systemd) Restart(ctx context.Context, unit string) error {
+	return s.run(ctx, unit, "restart", true, func(bus Bus) jobFunc { return bus.RestartUnitContext })
+}
+
+func (s *systemd) ReloadOrRestart(ctx context.Context, unit string) error {
+	return s.run(ctx, unit, "reload or restart", true, func(bus Bus) jobFunc { return bus.ReloadOrRestartUnitContext })
+}
+
+// run queues a job for unit and waits for it to finish, and for the unit to
+// become active when waitActive is set.
+func (s *systemd) run(ctx context.Context, unit, verb string, waitActive bool, job func(Bus) jobFunc) error {
+	unit = unitName(unit)
+
+	bus, err := s.bus(ctx)
+	if err != nil {
+		return err
+	}
+
+	// without a cursor a failure is reported without the journal
+	cursor, _ := s.journal.Cursor(ctx, unit)
+
+	ch := make(chan string, 1)
+	if _, err := job(bus)(ctx, unit, modeReplace, ch); err != nil {
+		return errors.Wrapf(err, "unable to %s %s", verb, unit)
+	}
+
+	select {
+	case result := <-ch:
+		if result != jobDone {
+			err := errors.Errorf("unable to %s %s: job %s", verb, unit, result)
+			if state, stateErr := s.State(ctx, unit); stateErr == nil {
+				err = errors.Errorf("unable to %s %s: job %s, unit is %s", verb, unit, result, state)
+			}
+			return s.failure(ctx, unit, cursor, err)
+		}
+	case <-ctx.Done():
+		return errors.Wrapf(ctx.Err(), "unable to %s %s", verb, unit)
+	}
+
+	if !waitActive {
+		return nil
+	}
+
+	if err := s.WaitActive(ctx, unit); err != nil {
+		return s.failure(ctx, unit, cursor, err)
+	}
+
+	return nil
+}
+
+// failure adds what unit logged after cursor to err.
+func (s *systemd) failure(ctx context.Context, unit, cursor string, err error) error {
+	if cursor == "" {
+		return err
+	}
+
+	lines, journalErr := s.journal.Since(ctx, unit, cursor, journalLines)
+	if journalErr != nil || len(lines) == 0 {
+		return err
+	}
+
+	return errors.Errorf("%s, journal:\n%s", err.Error(), strings.Join(lines, "\n"))
+}
+
+func (s *systemd) State(ctx context.Context, unit string) (UnitState, error) {
+	unit = unitName(unit)
+
+	bus, err := s.bus(ctx)
+	if err != nil {
+		return UnitState{}, err
+	}
+
+	properties, err := bus.GetUnitPropertiesContext(ctx, unit)
+	if err != nil {
+		return UnitState{}, errors.Wrapf(err, "unable to read the state of %s", unit)
+	}
+
+	state := UnitState{}
+	state.LoadState, _ = properties["LoadState"].(string)
+	state.ActiveState, _ = properties["ActiveState"].(string)
+	state.SubState, _ = properties["SubState"].(string)
+
+	// Result is a property of the service, not the unit
+	if strings.HasSuffix(unit, ".service") {
+		serviceProperties, err := bus.GetUnitTypePropertiesContext(ctx, unit, "Service")
+		if err == nil {
+			state.Result, _ = serviceProperties["Result"].(string)
+		}
+	}
+
+	return state, nil
+}
+
+func (s *systemd) WaitActive(ctx context.Context, unit string) error {
+	unit = unitName(unit)
+
+	for {
+		state, err := s.State(ctx, unit)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case state.LoadState == "not-found":
+			return errors.Errorf("unit %s not found", unit)
+		case state.ActiveState == "active":
+			return nil
+		case state.ActiveState == "failed", state.ActiveState == "inactive":
+			return errors.Errorf("unit %s is %s", unit, state)
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "unit %s didn't become active, it is %s", unit, state)
+		case <-time.After(s.pollInterval):
+		}
+	}
+}
+
+func (s *systemd) InstallDropIn(ctx context.Context, unit, name, content string) error {
+	unit = unitName(unit)
+	dir := filepath.Join(s.unitPath, unit+".d")
+	path := filepath.Join(dir, name+".conf")
+
+	existing, err := ioutil.ReadFile(path)
+	if err == nil && string(existing) == content {
+		return nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrapf(err, "unable to install drop-in for %s", unit)
+	}
+
+	// systemd may read the drop-in at any time, so it is replaced whole
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(content), 0644); err != nil {
+		return errors.Wrapf(err, "unable to install drop-in for %s", unit)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return errors.Wrapf(err, "unable to install drop-in for %s", unit)
+	}
+
+	bus, err := s.bus(ctx)
+	if err != nil {
+		return err
+	}
+
+	return errors.Wrap(bus.ReloadContext(ctx), "unable to reload systemd")
+}
+
+func (s *systemd) JournalCursor(ctx context.Context, unit string) (string, error) {
+	return s.journal.Cursor(ctx, unitName(unit))
+}
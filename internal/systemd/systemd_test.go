@@ -0,0 +1,224 @@
+package systemd
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	godbus "github.com/godbus/dbus/v5"
+	"github.com/pkg/errors"
+	"github.com/zawachte/morgue/internal/systemd/fakebus"
+)
+
+func newTestSystemd(t *testing.T, bus *fakebus.Bus) Systemd {
+	t.Helper()
+
+	bus.Journal = fakebus.NewJournal()
+
+	return New(Params{
+		Bus:          bus,
+		Journal:      bus.Journal,
+		UnitPath:     t.TempDir(),
+		PollInterval: time.Millisecond,
+	})
+}
+
+func TestJobs(t *testing.T) {
+	operations := []struct {
+		name string
+		verb string
+		run  func(Systemd, context.Context, string) error
+	}{
+		{"start", "start", Systemd.Start},
+		{"restart", "restart", Systemd.Restart},
+		{"reload or restart", "reload or restart", Systemd.ReloadOrRestart},
+	}
+
+	tests := []struct {
+		name    string
+		unit    fakebus.Unit
+		wantErr []string
+	}{
+		{
+			name: "becomes active",
+			unit: fakebus.Unit{Log: []string{"I! started"}},
+		},
+		{
+			name: "fails with journal",
+			unit: fakebus.Unit{Fail: true, Result: "exit-code", Log: []string{"E! bad config", "E! exiting"}},
+			wantErr: []string{
+				"telegraf.service: job failed, unit is failed (failed), result exit-code",
+				"journal:\nE! bad config\nE! exiting",
+			},
+		},
+		{
+			name:    "fails without journal",
+			unit:    fakebus.Unit{Fail: true, Result: "timeout"},
+			wantErr: []string{"telegraf.service: job failed, unit is failed (failed), result timeout"},
+		},
+	}
+
+	for _, op := range operations {
+		for _, tt := range tests {
+			t.Run(op.name+" "+tt.name, func(t *testing.T) {
+				bus := fakebus.New()
+				bus.SetUnit("telegraf.service", tt.unit)
+				s := newTestSystemd(t, bus)
+
+				// lines logged before the job aren't part of its failure
+				bus.Journal.Log("telegraf.service", "E! earlier run")
+
+				err := op.run(s, context.Background(), "telegraf")
+				if len(tt.wantErr) == 0 {
+					if err != nil {
+						t.Fatalf("%s failed: %v", op.name, err)
+					}
+					unit, _ := bus.Unit("telegraf.service")
+					if unit.ActiveState != "active" {
+						t.Errorf("unit is %s after %s, want active", unit.ActiveState, op.name)
+					}
+					return
+				}
+
+				if err == nil {
+					t.Fatalf("%s succeeded, want an error", op.name)
+				}
+				if !strings.HasPrefix(err.Error(), "unable to "+op.verb+" ") {
+					t.Errorf("error %q doesn't name the operation %q", err, op.verb)
+				}
+				for _, want := range tt.wantErr {
+					if !strings.Contains(err.Error(), want) {
+						t.Errorf("error %q doesn't contain %q", err, want)
+					}
+				}
+				if strings.Contains(err.Error(), "earlier run") {
+					t.Errorf("error %q contains lines logged before the job", err)
+				}
+			})
+		}
+	}
+}
+
+func TestWaitActiveTimeout(t *testing.T) {
+	bus := fakebus.New()
+	bus.SetUnit("influxd.service", fakebus.Unit{Activating: true})
+	s := newTestSystemd(t, bus)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	err := s.Start(ctx, "influxd")
+	if err == nil {
+		t.Fatal("Start of a unit stuck activating succeeded, want an error")
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error %q isn't the deadline", err)
+	}
+	if !strings.Contains(err.Error(), "didn't become active, it is activating (start)") {
+		t.Errorf("error %q doesn't report the state", err)
+	}
+}
+
+func TestWaitActive(t *testing.T) {
+	tests := []struct {
+		name    string
+		unit    *fakebus.Unit
+		wantErr string
+	}{
+		{"active", &fakebus.Unit{ActiveState: "active", SubState: "running"}, ""},
+		{"failed", &fakebus.Unit{ActiveState: "failed", SubState: "failed", Result: "core-dump"}, "unit influxd.service is failed (failed), result core-dump"},
+		{"inactive", &fakebus.Unit{}, "unit influxd.service is inactive (dead)"},
+		{"not found", nil, "unit influxd.service not found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bus := fakebus.New()
+			if tt.unit != nil {
+				bus.SetUnit("influxd.service", *tt.unit)
+			}
+			s := newTestSystemd(t, bus)
+
+			err := s.WaitActive(context.Background(), "influxd")
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("WaitActive failed: %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("WaitActive() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestStop(t *testing.T) {
+	bus := fakebus.New()
+	bus.SetUnit("influxd.service", fakebus.Unit{ActiveState: "active", SubState: "running"})
+	s := newTestSystemd(t, bus)
+
+	if err := s.Stop(context.Background(), "influxd"); err != nil {
+		t.Fatal(err)
+	}
+	unit, _ := bus.Unit("influxd.service")
+	if unit.ActiveState != "inactive" {
+		t.Errorf("unit is %s after stop, want inactive", unit.ActiveState)
+	}
+
+	err := s.Stop(context.Background(), "victoriametrics")
+	if !IsNoSuchUnit(err) {
+		t.Errorf("Stop of a missing unit = %v, want NoSuchUnit", err)
+	}
+}
+
+func TestIsNoSuchUnit(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"other error", errors.New("unit not found"), false},
+		{"other dbus error", godbus.Error{Name: "org.freedesktop.DBus.Error.AccessDenied"}, false},
+		{"no such unit", godbus.Error{Name: NoSuchUnit}, true},
+		{"no such unit pointer", &godbus.Error{Name: NoSuchUnit}, true},
+		{"wrapped", errors.Wrap(godbus.Error{Name: NoSuchUnit}, "unable to stop influxd.service"), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsNoSuchUnit(tt.err); got != tt.want {
+				t.Errorf("IsNoSuchUnit(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInstallDropIn(t *testing.T) {
+	bus := fakebus.New()
+	unitPath := t.TempDir()
+	s := New(Params{Bus: bus, Journal: fakebus.NewJournal(), UnitPath: unitPath})
+
+	content := "[Service]\nNice=10\n"
+	for i := 0; i < 2; i++ {
+		if err := s.InstallDropIn(context.Background(), "telegraf", "morgue", content); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(unitPath, "telegraf.service.d", "morgue.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != content {
+		t.Errorf("drop-in is %q, want %q", data, content)
+	}
+	// an unchanged drop-in doesn't reload systemd again
+	if bus.Reloads != 1 {
+		t.Errorf("systemd was reloaded %d times, want once", bus.Reloads)
+	}
+}
@@ -0,0 +1,264 @@
+package triggers
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/zawachte/morgue/internal/tsdb"
+	"go.uber.org/zap"
+)
+
+const (
+	ResourceCPU    = "cpu"
+	ResourceMemory = "memory"
+	ResourceIO     = "io"
+)
+
+// procRoot is where /proc/pressure and /proc/loadavg are read from.
+var procRoot = "/proc"
+
+// Trigger reports whether a condition that warrants an emergency backup holds.
+type Trigger interface {
+	Name() string
+	// Check returns a description of the condition when it holds, and an
+	// empty string otherwise.
+	Check() (string, error)
+}
+
+// NewPressureTrigger fires when the "some" avg10 pressure stall percentage of
+// a resource reaches the threshold.
+func NewPressureTrigger(resource string, threshold float64) Trigger {
+	return &pressureTrigger{
+		resource:  resource,
+		threshold: threshold,
+	}
+}
+
+type pressureTrigger struct {
+	resource  string
+	threshold float64
+}
+
+func (p *pressureTrigger) Name() string {
+	return p.resource + "_pressure"
+}
+
+func (p *pressureTrigger) Check() (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(procRoot, "pressure", p.resource))
+	if err != nil {
+		return "", err
+	}
+
+	avg10, err := parsePressure(string(data))
+	if err != nil {
+		return "", err
+	}
+
+	if avg10 < p.threshold {
+		return "", nil
+	}
+
+	return fmt.Sprintf("%s pressure avg10 %.2f%% reached %.2f%%", p.resource, avg10, p.threshold), nil
+}
+
+// parsePressure returns the avg10 of the "some" line of a /proc/pressure file.
+func parsePressure(data string) (float64, error) {
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] != "some" {
+			continue
+		}
+
+		for _, field := range fields[1:] {
+			if strings.HasPrefix(field, "avg10=") {
+				return strconv.ParseFloat(strings.TrimPrefix(field, "avg10="), 64)
+			}
+		}
+	}
+
+	return 0, fmt.Errorf("no some avg10 value in pressure file")
+}
+
+// NewDiskTrigger fires when the filesystem holding path is at least
+// usedPercent full.
+func NewDiskTrigger(path string, usedPercent float64) Trigger {
+	return &diskTrigger{
+		path:        path,
+		usedPercent: usedPercent,
+	}
+}
+
+type diskTrigger struct {
+	path        string
+	usedPercent float64
+}
+
+func (d *diskTrigger) Name() string {
+	return "disk_usage"
+}
+
+func (d *diskTrigger) Check() (string, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(d.path, &stat); err != nil {
+		return "", err
+	}
+
+	if stat.Blocks == 0 {
+		return "", nil
+	}
+
+	used := 100 * float64(stat.Blocks-stat.Bfree) / float64(stat.Blocks)
+	if used < d.usedPercent {
+		return "", nil
+	}
+
+	return fmt.Sprintf("%s is %.1f%% full", d.path, used), nil
+}
+
+// NewLoadTrigger fires once the one minute load average per cpu has stayed at
+// or above threshold for the given duration.
+func NewLoadTrigger(threshold float64, duration time.Duration) Trigger {
+	return &loadTrigger{
+		threshold: threshold,
+		duration:  duration,
+	}
+}
+
+type loadTrigger struct {
+	threshold float64
+	duration  time.Duration
+	highSince time.Time
+}
+
+func (l *loadTrigger) Name() string {
+	return "load"
+}
+
+func (l *loadTrigger) Check() (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(procRoot, "loadavg"))
+	if err != nil {
+		return "", err
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("empty loadavg")
+	}
+
+	load1, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return "", err
+	}
+
+	perCPU := load1 / float64(runtime.NumCPU())
+	if perCPU < l.threshold {
+		l.highSince = time.Time{}
+		return "", nil
+	}
+
+	if l.highSince.IsZero() {
+		l.highSince = time.Now()
+	}
+
+	if time.Since(l.highSince) < l.duration {
+		return "", nil
+	}
+
+	return fmt.Sprintf("load per cpu %.2f above %.2f for %s", perCPU, l.threshold, l.duration), nil
+}
+
+// NewQueryTrigger fires when the query returns any rows. The query is in the
+// language of the database, flux for influxdb2 and MetricsQL for
+// victoria-metrics.
+func NewQueryTrigger(name, query string, db tsdb.TSDB) Trigger {
+	return &queryTrigger{
+		name:  name,
+		query: query,
+		db:    db,
+	}
+}
+
+type queryTrigger struct {
+	name  string
+	query string
+	db    tsdb.TSDB
+}
+
+func (q *queryTrigger) Name() string {
+	return "query_" + q.name
+}
+
+func (q *queryTrigger) Check() (string, error) {
+	rows, err := q.db.Query(q.query)
+	if err != nil {
+		return "", err
+	}
+
+	if len(rows) == 0 {
+		return "", nil
+	}
+
+	return fmt.Sprintf("query %s returned %d rows", q.name, len(rows)), nil
+}
+
+type WatcherParams struct {
+	Triggers      []Trigger
+	CheckInterval time.Duration
+	// OnFire is called with the trigger name and condition whenever a
+	// trigger holds.
+	OnFire func(name, reason string)
+	Logger zap.Logger
+}
+
+type Watcher interface {
+	Run(context.Context)
+}
+
+type watcher struct {
+	triggers      []Trigger
+	checkInterval time.Duration
+	onFire        func(name, reason string)
+	logger        zap.Logger
+}
+
+func NewWatcher(params WatcherParams) Watcher {
+	return &watcher{
+		triggers:      params.Triggers,
+		checkInterval: params.CheckInterval,
+		onFire:        params.OnFire,
+		logger:        params.Logger,
+	}
+}
+
+// Run checks every trigger each interval until ctx is done.
+func (w *watcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.checkInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, trigger := range w.triggers {
+			reason, err := trigger.Check()
+			if err != nil {
+				w.logger.Sugar().Warnw("trigger check failed", "trigger", trigger.Name(), "error", err.Error())
+				continue
+			}
+
+			if reason != "" {
+				w.onFire(trigger.Name(), reason)
+			}
+		}
+	}
+}
@@ -0,0 +1,433 @@
+package tsdb
+
+import (
+	"context"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/zawachte/morgue/internal/credentials"
+	"github.com/zawachte/morgue/internal/servicemanager"
+	"github.com/zawachte/morgue/pkg/diskspace"
+	"github.com/zawachte/morgue/pkg/influx"
+	"github.com/zawachte/morgue/pkg/influx_cli"
+	"github.com/zawachte/morgue/pkg/influxd"
+	"github.com/zawachte/morgue/pkg/telegraf"
+	"go.uber.org/zap"
+)
+
+// ExternalInfluxDB2Params point at an existing influxd that morgue neither
+// runs nor onboards.
+type ExternalInfluxDB2Params struct {
+	URL   string
+	Token string
+	Org   string
+	// Bucket is the bucket telegraf and morgue write to.
+	Bucket string
+}
+
+type InfluxDB2Params struct {
+	ServiceManager  servicemanager.ServiceManager
+	ServiceMode     bool
+	CredentialsPath string
+	// Retention of the metrics bucket created on onboarding.
+	Retention time.Duration
+	// External skips running and onboarding influxd when set.
+	External *ExternalInfluxDB2Params
+	Logger   zap.Logger
+}
+
+type influxDB2 struct {
+	svcManager      servicemanager.ServiceManager
+	serviceMode     bool
+	credentialsPath string
+	retention       time.Duration
+	external        *ExternalInfluxDB2Params
+	logger          zap.Logger
+	// token authenticates every client, Setup sets it for a local influxd
+	// and RotateToken replaces it
+	tokenLock sync.Mutex
+	token     string
+}
+
+func NewInfluxDB2(params InfluxDB2Params) TSDB {
+	i := &influxDB2{
+		svcManager:      params.ServiceManager,
+		serviceMode:     params.ServiceMode,
+		credentialsPath: params.CredentialsPath,
+		retention:       params.Retention,
+		external:        params.External,
+		logger:          params.Logger,
+	}
+
+	if params.External != nil {
+		i.token = params.External.Token
+	}
+
+	return i
+}
+
+func (i *influxDB2) url() string {
+	if i.external != nil {
+		return i.external.URL
+	}
+
+	return influxd.LocalURL
+}
+
+func (i *influxDB2) org() string {
+	if i.external != nil {
+		return i.external.Org
+	}
+
+	return influx.DefaultOrgName
+}
+
+func (i *influxDB2) bucket() string {
+	if i.external != nil {
+		return i.external.Bucket
+	}
+
+	return influx.DefaultBucketName
+}
+
+// InfluxClient returns a client authenticated with the token Setup found,
+// or with the local CLI config before that.
+func (i *influxDB2) InfluxClient() (influx_cli.Client, error) {
+	i.tokenLock.Lock()
+	token := i.token
+	i.tokenLock.Unlock()
+
+	if token == "" {
+		return influx_cli.NewClient()
+	}
+
+	return influx_cli.NewClientWithParams(influx_cli.ClientParams{
+		Host:  i.url(),
+		Token: token,
+		Org:   i.org(),
+	})
+}
+
+func (i *influxDB2) setToken(token string) {
+	i.tokenLock.Lock()
+	defer i.tokenLock.Unlock()
+
+	i.token = token
+}
+
+func (i *influxDB2) Start() error {
+	if i.external != nil {
+		i.logger.Sugar().Infow("using external influxd", "url", i.external.URL)
+		return nil
+	}
+
+	return i.svcManager.RunInfluxD()
+}
+
+func (i *influxDB2) Ready(ctx context.Context) error {
+	return waitUntil(ctx, func() bool {
+		return influxd.Healthy(i.url())
+	})
+}
+
+// Setup reuses the credentials of an already onboarded influxd and only
+// onboards a fresh one when none exists.
+func (i *influxDB2) Setup() error {
+	if i.external != nil {
+		return nil
+	}
+
+	influxCli, err := influx_cli.NewClient()
+	if err != nil {
+		return err
+	}
+
+	onboarded, err := influxCli.IsOnboarded()
+	if err != nil {
+		return err
+	}
+
+	provisioned, err := credentials.Load(credentials.SystemdPath())
+	if err != nil {
+		return err
+	}
+	if provisioned != nil {
+		provisioned.SetDefaults(influx.DefaultUsername, influx.DefaultOrgName, influx.DefaultBucketName)
+	}
+
+	if onboarded {
+		creds := provisioned
+		if creds == nil {
+			creds, err = credentials.Load(i.credentialsPath)
+			if err != nil {
+				return err
+			}
+		}
+
+		token := influxCli.GetActiveToken()
+		if creds != nil && creds.Token != "" {
+			token = creds.Token
+		}
+		if token == "" {
+			return errors.New("influx is already set up but no token was found, rerun with --reset to re-onboard")
+		}
+		i.setToken(token)
+
+		i.logger.Info("reusing existing influx setup")
+		return nil
+	}
+
+	creds := provisioned
+	if creds == nil {
+		creds, err = credentials.Generate(influx.DefaultUsername, influx.DefaultOrgName, influx.DefaultBucketName)
+		if err != nil {
+			return err
+		}
+
+		// persist before onboarding so the credentials are never lost
+		err = credentials.Save(i.credentialsPath, creds)
+		if err != nil {
+			return errors.Wrap(err, "unable to save credentials")
+		}
+	}
+
+	// a stale CLI config would make onboarding refuse to write its own
+	err = influx_cli.RemoveConfig()
+	if err != nil {
+		return err
+	}
+
+	err = influxCli.SetupInflux(influx_cli.SetupInfluxParams{
+		Username:  creds.Username,
+		Password:  creds.Password,
+		AuthToken: creds.Token,
+		Org:       creds.Org,
+		Bucket:    creds.Bucket,
+		Retention: i.retention.String(),
+	})
+	if err != nil {
+		return err
+	}
+	i.setToken(creds.Token)
+
+	return nil
+}
+
+// RotateToken rotates the operator token morgue onboarded influxd with.
+// Credentials provisioned by systemd can't be rewritten, and the token of an
+// external influxd is managed outside morgue.
+func (i *influxDB2) RotateToken() error {
+	if i.external != nil {
+		return errors.New("the token of an external influxd is managed outside morgue")
+	}
+
+	provisioned, err := credentials.Load(credentials.SystemdPath())
+	if err != nil {
+		return err
+	}
+	if provisioned != nil {
+		return errors.New("credentials provisioned by systemd can't be rotated by morgue")
+	}
+
+	influxCli, err := i.InfluxClient()
+	if err != nil {
+		return err
+	}
+
+	creds, err := credentials.Rotate(i.credentialsPath, influxCli)
+	if creds != nil {
+		i.setToken(creds.Token)
+	}
+
+	return err
+}
+
+// Backup backs up the buckets into Path. Several buckets are each backed up
+// into a subdirectory named after them, since influx backup only takes one
+// bucket.
+func (i *influxDB2) Backup(params BackupParams) error {
+	influxCli, err := i.InfluxClient()
+	if err != nil {
+		return err
+	}
+
+	if len(params.Buckets) <= 1 {
+		backupParams := influx_cli.BackupInfluxParams{
+			Org:  i.org(),
+			Path: params.Path,
+		}
+		if len(params.Buckets) == 1 {
+			backupParams.Bucket = params.Buckets[0]
+		}
+
+		return influxCli.BackupInflux(backupParams)
+	}
+
+	for _, bucket := range params.Buckets {
+		err := influxCli.BackupInflux(influx_cli.BackupInfluxParams{
+			Org:    i.org(),
+			Bucket: bucket,
+			Path:   path.Join(params.Path, bucket),
+		})
+		if err != nil {
+			return errors.Wrapf(err, "unable to back up bucket %s", bucket)
+		}
+	}
+
+	return nil
+}
+
+// Restore restores a backup, or each bucket of one split into
+// subdirectories.
+func (i *influxDB2) Restore(params RestoreParams) error {
+	influxCli, err := i.InfluxClient()
+	if err != nil {
+		return err
+	}
+
+	entries, err := ioutil.ReadDir(params.Path)
+	if err != nil {
+		return err
+	}
+
+	directories := []string{}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".manifest") {
+			return influxCli.RestoreInflux(influx_cli.RestoreInfluxParams{
+				Path: params.Path,
+				Full: params.Full,
+			})
+		}
+		if entry.IsDir() {
+			directories = append(directories, entry.Name())
+		}
+	}
+
+	if len(directories) == 0 {
+		return errors.Errorf("no influx backup found in %s", params.Path)
+	}
+
+	for _, bucket := range directories {
+		err := influxCli.RestoreInflux(influx_cli.RestoreInfluxParams{
+			Org:    i.org(),
+			Bucket: bucket,
+			Path:   filepath.Join(params.Path, bucket),
+		})
+		if err != nil {
+			return errors.Wrapf(err, "unable to restore bucket %s", bucket)
+		}
+	}
+
+	return nil
+}
+
+func (i *influxDB2) Write(lines []string) error {
+	influxCli, err := i.InfluxClient()
+	if err != nil {
+		return err
+	}
+
+	return influxCli.Write(influx_cli.WriteParams{
+		Org:    i.org(),
+		Bucket: i.bucket(),
+		Lines:  lines,
+	})
+}
+
+func (i *influxDB2) Query(query string) ([]map[string]string, error) {
+	influxCli, err := i.InfluxClient()
+	if err != nil {
+		return nil, err
+	}
+
+	return influxCli.Query(influx_cli.QueryParams{
+		Org:   i.org(),
+		Query: query,
+	})
+}
+
+// Telegraf creates a token that can only write to the buckets telegraf
+// writes to, so a leaked telegraf config can't be used to wipe the database.
+// Backups keep using the operator token since influxd requires it for them.
+func (i *influxDB2) Telegraf(config telegraf.TelegrafConfig) (telegraf.TelegrafConfig, error) {
+	influxCli, err := i.InfluxClient()
+	if err != nil {
+		return telegraf.TelegrafConfig{}, err
+	}
+
+	buckets := []string{i.bucket()}
+	if config.Logs.Source != "" {
+		buckets = append(buckets, config.Logs.Bucket)
+	}
+
+	token, err := influxCli.EnsureAuthorization(influx_cli.AuthorizationParams{
+		Description: influx.TelegrafAuthorizationDescription,
+		Org:         i.org(),
+		Buckets:     buckets,
+		Write:       true,
+	})
+	if err != nil {
+		return telegraf.TelegrafConfig{}, errors.Wrap(err, "unable to create telegraf token")
+	}
+
+	config.Output = telegraf.OutputInfluxDBV2
+	config.Token = token
+	config.Urls = []string{i.url()}
+	config.Organization = i.org()
+	config.Bucket = i.bucket()
+
+	return config, nil
+}
+
+func (i *influxDB2) enginePath() (string, error) {
+	if i.serviceMode {
+		return influxd.SystemdEnginePath, nil
+	}
+
+	return influxd.EnginePath()
+}
+
+func (i *influxDB2) DataSize() (uint64, error) {
+	// the data of an external influxd may not be on this host
+	if i.external != nil {
+		return 0, nil
+	}
+
+	enginePath, err := i.enginePath()
+	if err != nil {
+		return 0, err
+	}
+
+	return diskspace.DirSize(enginePath)
+}
+
+// CopyData copies the engine next to the metadata stores, which hold the
+// buckets and tokens the engine's data belongs to.
+func (i *influxDB2) CopyData(path string) error {
+	if i.external != nil {
+		return ErrNoLocalData
+	}
+
+	// influxd would keep compacting the files while they are copied
+	err := i.svcManager.StopInfluxD()
+	if err != nil {
+		return errors.Wrap(err, "unable to stop influxd")
+	}
+
+	enginePath, err := i.enginePath()
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(enginePath)
+	return copyPaths([]string{
+		enginePath,
+		filepath.Join(dir, "influxd.bolt"),
+		filepath.Join(dir, "influxd.sqlite"),
+	}, path)
+}
@@ -0,0 +1,334 @@
+package tsdb
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/zawachte/morgue/pkg/diskspace"
+	"github.com/zawachte/morgue/pkg/telegraf"
+	"go.uber.org/zap"
+)
+
+const (
+	// LiteSystemdDataPath is where the lite store keeps its segments in
+	// service mode.
+	LiteSystemdDataPath = "/var/lib/morgue/lite"
+	// segmentExtension marks the line protocol segments of the lite store.
+	segmentExtension = ".lp"
+	// segmentTimeFormat names segments after their start, so they sort in
+	// the order they were written.
+	segmentTimeFormat = "20060102T150405Z"
+)
+
+// LiteDataPath returns where the lite store keeps its segments when morgue
+// runs as the current user.
+func LiteDataPath() (string, error) {
+	dirname, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dirname, ".morgue", "lite"), nil
+}
+
+// LiteParams configure the store of lite mode. Instead of running a
+// database it appends points to line protocol segment files, one per
+// SegmentDuration, and deletes segments older than Retention.
+type LiteParams struct {
+	DataPath        string
+	Retention       time.Duration
+	SegmentDuration time.Duration
+	// Reset deletes all stored segments on Start.
+	Reset  bool
+	Logger zap.Logger
+}
+
+type lite struct {
+	dataPath        string
+	retention       time.Duration
+	segmentDuration time.Duration
+	reset           bool
+	logger          zap.Logger
+
+	lock         sync.Mutex
+	segment      *os.File
+	segmentStart time.Time
+}
+
+func NewLite(params LiteParams) TSDB {
+	return &lite{
+		dataPath:        params.DataPath,
+		retention:       params.Retention,
+		segmentDuration: params.SegmentDuration,
+		reset:           params.Reset,
+		logger:          params.Logger,
+	}
+}
+
+func (l *lite) Start() error {
+	if l.reset {
+		if err := os.RemoveAll(l.dataPath); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(l.dataPath, 0700); err != nil {
+		return err
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.expire(time.Now())
+}
+
+// Ready returns right away, the store runs inside morgue.
+func (l *lite) Ready(context.Context) error {
+	return nil
+}
+
+func (l *lite) Setup() error {
+	return nil
+}
+
+// Backup links the finished segments to Path and copies the one still
+// being appended to, so the backup doesn't grow while it is archived.
+func (l *lite) Backup(params BackupParams) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.segment != nil {
+		if err := l.segment.Sync(); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(params.Path, 0700); err != nil {
+		return err
+	}
+
+	names, err := l.segments()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		source := filepath.Join(l.dataPath, name)
+		target := filepath.Join(params.Path, name)
+
+		if l.segment == nil || source != l.segment.Name() {
+			if os.Link(source, target) == nil {
+				continue
+			}
+		}
+
+		if err := copyFile(source, target, 0600); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Restore appends the segments of a backup to the stored ones. Points are
+// identified by series and time, so points in both are only kept once when
+// the segments are read back into a database.
+func (l *lite) Restore(params RestoreParams) error {
+	entries, err := ioutil.ReadDir(params.Path)
+	if err != nil {
+		return err
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	// the next Write reopens the current segment
+	if err := l.closeSegment(); err != nil {
+		return err
+	}
+
+	if params.Full {
+		names, err := l.segments()
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			if err := os.Remove(filepath.Join(l.dataPath, name)); err != nil {
+				return err
+			}
+		}
+	}
+
+	restored := 0
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), segmentExtension) {
+			continue
+		}
+
+		err := appendFile(filepath.Join(params.Path, entry.Name()), filepath.Join(l.dataPath, entry.Name()))
+		if err != nil {
+			return errors.Wrapf(err, "unable to restore segment %s", entry.Name())
+		}
+		restored++
+	}
+
+	if restored == 0 {
+		return errors.Errorf("no lite segments found in %s", params.Path)
+	}
+
+	return nil
+}
+
+// Write appends lines to the current segment and syncs it, so points
+// survive a crash right after they were collected.
+func (l *lite) Write(lines []string) error {
+	if len(lines) == 0 {
+		return nil
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	if l.segment == nil || !now.Before(l.segmentStart.Add(l.segmentDuration)) {
+		if err := l.openSegment(now); err != nil {
+			return err
+		}
+	}
+
+	if _, err := l.segment.WriteString(strings.Join(lines, "\n") + "\n"); err != nil {
+		return err
+	}
+
+	return l.segment.Sync()
+}
+
+func (l *lite) Query(string) ([]map[string]string, error) {
+	return nil, errors.New("lite mode doesn't support queries")
+}
+
+func (l *lite) Telegraf(telegraf.TelegrafConfig) (telegraf.TelegrafConfig, error) {
+	return telegraf.TelegrafConfig{}, errors.New("lite mode collects metrics without telegraf")
+}
+
+func (l *lite) DataSize() (uint64, error) {
+	return diskspace.DirSize(l.dataPath)
+}
+
+func (l *lite) CopyData(path string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return copyPaths([]string{l.dataPath}, path)
+}
+
+// openSegment switches to the segment now falls into and expires old ones.
+func (l *lite) openSegment(now time.Time) error {
+	if err := l.closeSegment(); err != nil {
+		return err
+	}
+
+	start := now.UTC().Truncate(l.segmentDuration)
+	name := filepath.Join(l.dataPath, start.Format(segmentTimeFormat)+segmentExtension)
+
+	segment, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	l.segment = segment
+	l.segmentStart = start
+
+	return l.expire(now)
+}
+
+func (l *lite) closeSegment() error {
+	if l.segment == nil {
+		return nil
+	}
+
+	err := l.segment.Close()
+	l.segment = nil
+
+	return err
+}
+
+// expire deletes the segments that only hold points older than the
+// retention.
+func (l *lite) expire(now time.Time) error {
+	if l.retention <= 0 {
+		return nil
+	}
+
+	names, err := l.segments()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		start, err := time.Parse(segmentTimeFormat, strings.TrimSuffix(name, segmentExtension))
+		if err != nil {
+			l.logger.Sugar().Warnw("skipping unexpected file in lite data path", "name", name)
+			continue
+		}
+
+		if start.Add(l.segmentDuration).Before(now.Add(-l.retention)) {
+			if err := os.Remove(filepath.Join(l.dataPath, name)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// segments returns the names of the stored segments, oldest first.
+func (l *lite) segments() ([]string, error) {
+	entries, err := ioutil.ReadDir(l.dataPath)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), segmentExtension) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func appendFile(source, target string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,127 @@
+package tsdb
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/zawachte/morgue/pkg/influx_cli"
+	"github.com/zawachte/morgue/pkg/telegraf"
+)
+
+const (
+	BackendInfluxDB2       = "influxdb2"
+	BackendVictoriaMetrics = "victoriametrics"
+	// BackendLite stores points in local segment files, for hosts that
+	// can't run a database or telegraf.
+	BackendLite = "lite"
+)
+
+// TSDB is the database morgue collects metrics into and backs up.
+type TSDB interface {
+	// Start runs the database, unless morgue doesn't manage it.
+	Start() error
+	// Ready blocks until the database answers requests.
+	Ready(context.Context) error
+	// Setup onboards a fresh database, or reuses an existing setup.
+	Setup() error
+	// Backup writes a backup to a new directory at BackupParams.Path.
+	Backup(BackupParams) error
+	// Restore loads a backup made by Backup.
+	Restore(RestoreParams) error
+	// Write adds points in line protocol with nanosecond timestamps to the
+	// metrics bucket.
+	Write(lines []string) error
+	// Query runs a query in the database's own language, flux or MetricsQL,
+	// and returns one map per result row, keyed by column name.
+	Query(query string) ([]map[string]string, error)
+	// Telegraf points the output of a telegraf config at the database,
+	// creating whatever telegraf needs to write to it.
+	Telegraf(telegraf.TelegrafConfig) (telegraf.TelegrafConfig, error)
+	// DataSize returns how much disk the stored data takes, 0 when it isn't
+	// on this host.
+	DataSize() (uint64, error)
+	// CopyData copies the stored data files as they are to a new directory
+	// at path, without needing the database to run. A database left running
+	// is stopped first, Start runs it again. It returns ErrNoLocalData when
+	// the data isn't on this host.
+	CopyData(path string) error
+}
+
+// InfluxDB2 is implemented by the influxdb2 backend, for what only
+// influxdb2 has, like buckets and streamed backups.
+type InfluxDB2 interface {
+	// InfluxClient returns a client for the influxd morgue backs up.
+	InfluxClient() (influx_cli.Client, error)
+	// RotateToken replaces the token in the credentials file with a new one
+	// and revokes the old one.
+	RotateToken() error
+}
+
+// ErrNoLocalData is returned by CopyData when there is nothing to copy.
+var ErrNoLocalData = errors.New("no data stored on this host")
+
+type BackupParams struct {
+	Path string
+	// Buckets limits the backup to the named buckets, empty backs up all of
+	// them. Only influxdb2 has buckets.
+	Buckets []string
+}
+
+type RestoreParams struct {
+	Path string
+	// Full replaces everything in the database with the backup, otherwise
+	// only the data in the backup is restored.
+	Full bool
+}
+
+// copyPaths copies the files and directories in sources that exist into
+// target.
+func copyPaths(sources []string, target string) error {
+	copied := 0
+	for _, source := range sources {
+		info, err := os.Stat(source)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := os.MkdirAll(target, 0700); err != nil {
+			return err
+		}
+
+		destination := filepath.Join(target, filepath.Base(source))
+		if info.IsDir() {
+			err = copyTree(source, destination, false)
+		} else {
+			err = copyFile(source, destination, info.Mode())
+		}
+		if err != nil {
+			return err
+		}
+		copied++
+	}
+
+	if copied == 0 {
+		return ErrNoLocalData
+	}
+
+	return nil
+}
+
+// waitUntil polls healthy until it holds or ctx is done.
+func waitUntil(ctx context.Context, healthy func() bool) error {
+	for !healthy() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+
+	return nil
+}
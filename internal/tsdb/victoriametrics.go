@@ -0,0 +1,200 @@
+package tsdb
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/zawachte/morgue/internal/servicemanager"
+	"github.com/zawachte/morgue/pkg/diskspace"
+	"github.com/zawachte/morgue/pkg/influx"
+	"github.com/zawachte/morgue/pkg/telegraf"
+	"github.com/zawachte/morgue/pkg/victoriametrics"
+	"go.uber.org/zap"
+)
+
+// VictoriaMetricsParams configure a single node victoria-metrics. It needs
+// far less memory than influxd, which suits small edge devices.
+type VictoriaMetricsParams struct {
+	ServiceManager servicemanager.ServiceManager
+	Location       string
+	// DataPath must match the -storageDataPath of the running
+	// victoria-metrics, snapshots are copied from below it.
+	DataPath  string
+	Retention time.Duration
+	Logger    zap.Logger
+}
+
+type victoriaMetrics struct {
+	svcManager servicemanager.ServiceManager
+	runParams  victoriametrics.RunParams
+	client     victoriametrics.Client
+	logger     zap.Logger
+}
+
+func NewVictoriaMetrics(params VictoriaMetricsParams) TSDB {
+	return &victoriaMetrics{
+		svcManager: params.ServiceManager,
+		runParams: victoriametrics.RunParams{
+			Location:  params.Location,
+			DataPath:  params.DataPath,
+			Retention: params.Retention,
+		},
+		client: victoriametrics.NewClient(victoriametrics.LocalURL),
+		logger: params.Logger,
+	}
+}
+
+func (v *victoriaMetrics) Start() error {
+	return v.svcManager.RunVictoriaMetrics(v.runParams)
+}
+
+func (v *victoriaMetrics) Ready(ctx context.Context) error {
+	return waitUntil(ctx, func() bool {
+		return victoriametrics.Healthy(victoriametrics.LocalURL)
+	})
+}
+
+// Setup does nothing, victoria-metrics takes writes without onboarding.
+func (v *victoriaMetrics) Setup() error {
+	return nil
+}
+
+// Backup takes a snapshot and links or copies it to Path. Snapshot files
+// never change, so hard links are safe while they save the staging space.
+func (v *victoriaMetrics) Backup(params BackupParams) error {
+	name, err := v.client.CreateSnapshot()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err := v.client.DeleteSnapshot(name); err != nil {
+			v.logger.Warn(err.Error())
+		}
+	}()
+
+	return copyTree(victoriametrics.SnapshotPath(v.runParams.DataPath, name), params.Path, true)
+}
+
+// Restore replaces the data with the backup. victoria-metrics must be
+// stopped while it runs.
+func (v *victoriaMetrics) Restore(params RestoreParams) error {
+	if victoriametrics.Healthy(victoriametrics.LocalURL) {
+		return errors.New("stop victoria-metrics before restoring a backup")
+	}
+
+	entries, err := ioutil.ReadDir(v.runParams.DataPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(v.runParams.DataPath, entry.Name())); err != nil {
+			return err
+		}
+	}
+
+	return copyTree(params.Path, v.runParams.DataPath, false)
+}
+
+func (v *victoriaMetrics) Write(lines []string) error {
+	return v.client.Write(influx.DefaultBucketName, lines)
+}
+
+func (v *victoriaMetrics) Query(query string) ([]map[string]string, error) {
+	return v.client.Query(query)
+}
+
+// Telegraf writes through the influx 1.x api of victoria-metrics, which adds
+// the database name as the db label.
+func (v *victoriaMetrics) Telegraf(config telegraf.TelegrafConfig) (telegraf.TelegrafConfig, error) {
+	config.Output = telegraf.OutputInfluxDB
+	config.Urls = []string{victoriametrics.LocalURL}
+	config.Bucket = influx.DefaultBucketName
+
+	return config, nil
+}
+
+func (v *victoriaMetrics) DataSize() (uint64, error) {
+	return diskspace.DirSize(v.runParams.DataPath)
+}
+
+func (v *victoriaMetrics) CopyData(path string) error {
+	// victoria-metrics would keep merging parts while they are copied
+	err := v.svcManager.StopVictoriaMetrics()
+	if err != nil {
+		return errors.Wrap(err, "unable to stop victoria-metrics")
+	}
+
+	return copyPaths([]string{v.runParams.DataPath}, path)
+}
+
+// copyTree copies the directory source to target, following symlinks, which
+// victoria-metrics snapshots are made of. With link set files are hard
+// linked when source and target share a filesystem.
+func copyTree(source, target string, link bool) error {
+	entries, err := ioutil.ReadDir(source)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(target, 0700); err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		sourcePath := filepath.Join(source, entry.Name())
+		targetPath := filepath.Join(target, entry.Name())
+
+		info, err := os.Stat(sourcePath)
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			if err := copyTree(sourcePath, targetPath, link); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// link the file itself, a link to a symlink would dangle
+		if link {
+			resolved, err := filepath.EvalSymlinks(sourcePath)
+			if err == nil && os.Link(resolved, targetPath) == nil {
+				continue
+			}
+		}
+
+		if err := copyFile(sourcePath, targetPath, info.Mode()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func copyFile(source, target string, mode os.FileMode) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
@@ -4,83 +4,109 @@ import (
 	"context"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"flag"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/pflag"
+	"github.com/zawachte/morgue/internal/config"
+	"github.com/zawachte/morgue/internal/control"
 	"github.com/zawachte/morgue/internal/runner"
+	"github.com/zawachte/morgue/pkg/telegraf"
 	"go.uber.org/zap"
 )
 
+const (
+	metricsAddress = ":2112"
+	// metricsURL is where telegraf scrapes morgue's own metrics from.
+	metricsURL = "http://127.0.0.1:2112/metrics"
+	// shutdownTimeout stays below the 90s systemd waits before killing
+	// morgue.
+	shutdownTimeout = 60 * time.Second
+)
+
 func main() {
-	var retention time.Duration
-	var backupFrequency time.Duration
-	var metricsScrapeFrequency time.Duration
-	var unixSocket string
-	var backupPath string
-	var telegrafLocation string
-	var influxDLocation string
-	var storageDriver string
-	var awsRegion string
-	var awsBucketName string
-	var serviceMode bool
+	var configPath string
+	cfg := config.Config{}
 
 	fs := pflag.CommandLine
-	fs.BoolVar(&serviceMode,
+	fs.StringVar(&configPath,
+		"config",
+		"",
+		"path of a morgue config file (.toml or .yaml), flags and MORGUE_* env vars override its values",
+	)
+	fs.StringVar(&cfg.TSDB,
+		"tsdb",
+		"influxdb2",
+		"time series database to collect into [influxdb2, victoriametrics, lite]",
+	)
+	fs.BoolVar(&cfg.ServiceMode,
 		"service-mode",
 		false,
 		"switch to configure telegraf and influxd as systemd services",
 	)
-	fs.DurationVar(&retention,
+	fs.BoolVar(&cfg.Reset,
+		"reset",
+		false,
+		"wipe existing influxd data and re-onboard on startup",
+	)
+	fs.DurationVar((*time.Duration)(&cfg.InfluxD.Retention),
 		"retention",
 		6*time.Hour,
 		"retention time for stored metrics",
 	)
-	fs.DurationVar(&backupFrequency,
+	fs.DurationVar((*time.Duration)(&cfg.Backup.Frequency),
 		"backup-frequency",
 		time.Hour,
 		"period for creating database backups",
 	)
-	fs.DurationVar(&metricsScrapeFrequency,
+	fs.DurationVar((*time.Duration)(&cfg.Telegraf.ScrapeFrequency),
 		"metrics-scrape-frequency",
 		time.Second*20,
-		"period for creating database backups",
+		"interval at which telegraf collects metrics",
 	)
-	fs.StringVar(&unixSocket,
+	fs.StringVar(&cfg.UnixSocket,
 		"unix-socket",
 		"morgue.sock",
-		"unix socket path",
+		"path of the control api socket, empty disables it",
 	)
 
-	fs.StringVar(&backupPath,
+	fs.StringVar(&cfg.Backup.Path,
 		"backup-path",
 		".",
 		"path for database backups",
 	)
 
-	fs.StringVar(&telegrafLocation,
+	fs.StringVar(&cfg.CredentialsFile,
+		"credentials-file",
+		"",
+		"path of the file holding the generated influx credentials, defaults to $STATE_DIRECTORY/credentials.toml, /var/lib/morgue/credentials.toml in service mode and ~/.morgue/credentials.toml otherwise",
+	)
+
+	fs.StringVar(&cfg.Telegraf.Location,
 		"telegraf-location",
 		"/usr/local/bin/telegraf",
 		"location of the telegraf binary",
 	)
-	fs.StringVar(&influxDLocation,
+	fs.StringVar(&cfg.InfluxD.Location,
 		"influxd-location",
 		"/usr/local/bin/influxd",
 		"location of the influxd binary",
 	)
-	fs.StringVar(&storageDriver,
+	fs.StringVar(&cfg.Storage.Driver,
 		"storage-driver",
 		"local",
 		"type of storage driver [local, aws]",
 	)
-	fs.StringVar(&awsRegion,
+	fs.StringVar(&cfg.Storage.AWS.Region,
 		"aws-region",
 		"us-east-1",
 		"aws region",
 	)
-	fs.StringVar(&awsBucketName,
+	fs.StringVar(&cfg.Storage.AWS.Bucket,
 		"aws-s3-bucket",
 		"",
 		"name of the s3 bucket",
@@ -94,36 +120,281 @@ func main() {
 		os.Exit(1)
 	}
 
-	runnerParams := runner.RunnerParams{
-		BackupFrequency:  backupFrequency,
-		BackupPath:       backupPath,
-		Retention:        retention,
-		InfluxDLocation:  influxDLocation,
-		TelegrafLocation: telegrafLocation,
-		Logger:           *logger,
-		ServiceMode:      serviceMode,
-	}
-
-	if storageDriver == "aws" {
-		runnerParams.AWSParams = &runner.AWSParams{
-			Region:       awsRegion,
-			S3BucketName: awsBucketName,
-		}
+	if configPath == "" {
+		configPath = os.Getenv("MORGUE_CONFIG")
 	}
 
-	run, err := runner.NewRunner(runnerParams)
+	err = config.Apply(fs, configPath, &cfg)
 	if err != nil {
 		logger.Error(err.Error())
 		os.Exit(1)
 	}
 
-	err = run.Run(context.Background())
+	run, err := runner.NewRunner(newRunnerParams(cfg, logger))
 	if err != nil {
 		logger.Error(err.Error())
 		os.Exit(1)
 	}
 
+	// signals are caught before starting, so a reload or stop sent while
+	// morgue starts neither kills it nor skips the shutdown. A reload waits
+	// in hupCh until the start finished.
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	stopCh := make(chan os.Signal, 1)
+	signal.Notify(stopCh, syscall.SIGTERM, syscall.SIGINT)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan os.Signal, 1)
+	go func() {
+		sig := <-stopCh
+		stopped <- sig
+		cancel()
+	}()
+
+	err = run.Run(ctx)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	go reloadOnSighup(hupCh, fs, configPath, &cfg, run, logger)
+	go shutdownOnSignal(stopped, run, logger)
+
+	if cfg.UnixSocket != "" {
+		go serveControl(ctx, cfg.UnixSocket, run, logger)
+	}
+
 	// TODO add metrics
 	http.Handle("/metrics", promhttp.Handler())
-	http.ListenAndServe(":2112", nil)
+	http.ListenAndServe(metricsAddress, nil)
+}
+
+func newRunnerParams(cfg config.Config, logger *zap.Logger) runner.RunnerParams {
+	runnerParams := runner.RunnerParams{
+		TSDB:                 cfg.TSDB,
+		BackupFrequency:      time.Duration(cfg.Backup.Frequency),
+		BackupSchedule:       cfg.Backup.Schedule,
+		BackupAlign:          cfg.Backup.Align,
+		BackupSplay:          time.Duration(cfg.Backup.Splay),
+		MaintenanceWindows:   cfg.Backup.MaintenanceWindows,
+		BackupPath:           cfg.Backup.Path,
+		DiskReservePercent:   float64(cfg.Backup.ReservePercent),
+		LowSpaceAction:       cfg.Backup.LowSpace,
+		BackupStreaming:      cfg.Backup.Streaming,
+		BackupCompression:    cfg.Backup.Compression,
+		BackupEncryptCommand: cfg.Backup.EncryptCommand,
+		CredentialsPath:      cfg.CredentialsFile,
+		Retention:            time.Duration(cfg.InfluxD.Retention),
+		InfluxDLocation:      cfg.InfluxD.Location,
+		TelegrafLocation:     cfg.Telegraf.Location,
+		TelegrafAgent: telegraf.AgentConfig{
+			Interval:          time.Duration(cfg.Telegraf.ScrapeFrequency),
+			RoundInterval:     cfg.Telegraf.Agent.RoundInterval,
+			MetricBatchSize:   cfg.Telegraf.Agent.MetricBatchSize,
+			MetricBufferLimit: cfg.Telegraf.Agent.MetricBufferLimit,
+			CollectionJitter:  time.Duration(cfg.Telegraf.Agent.CollectionJitter),
+			FlushInterval:     time.Duration(cfg.Telegraf.Agent.FlushInterval),
+			FlushJitter:       time.Duration(cfg.Telegraf.Agent.FlushJitter),
+			Precision:         time.Duration(cfg.Telegraf.Agent.Precision),
+			Hostname:          cfg.Telegraf.Agent.Hostname,
+			OmitHostname:      cfg.Telegraf.Agent.OmitHostname,
+		},
+		TelegrafPlugins: telegraf.Plugins{
+			Inputs:         cfg.Telegraf.Inputs,
+			Processors:     cfg.Telegraf.Processors,
+			Aggregators:    cfg.Telegraf.Aggregators,
+			DisabledInputs: cfg.Telegraf.DisabledInputs,
+		},
+		Logger:      *logger,
+		ServiceMode: cfg.ServiceMode,
+		Reset:       cfg.Reset,
+	}
+
+	prometheusUrls := append([]string{}, cfg.Prometheus.Urls...)
+	if cfg.Prometheus.ScrapeSelf {
+		prometheusUrls = append(prometheusUrls, metricsURL)
+	}
+
+	runnerParams.PrometheusInput = telegraf.PrometheusInput{
+		Urls:                    prometheusUrls,
+		TargetsFile:             cfg.Prometheus.TargetsFile,
+		MonitorKubernetesPods:   cfg.Prometheus.KubernetesPods,
+		KubernetesNodeIP:        cfg.Prometheus.KubernetesNodeIP,
+		KubernetesLabelSelector: cfg.Prometheus.KubernetesLabelSelector,
+	}
+
+	runnerParams.LogsInput = telegraf.LogsInput{
+		Source:       cfg.Logs.Source,
+		SyslogServer: cfg.Logs.SyslogServer,
+		Bucket:       cfg.Logs.Bucket,
+	}
+	runnerParams.LogsRetention = time.Duration(cfg.Logs.Retention)
+
+	runnerParams.VictoriaMetrics = runner.VictoriaMetricsParams{
+		Location:  cfg.VictoriaMetrics.Location,
+		DataPath:  cfg.VictoriaMetrics.DataPath,
+		Retention: time.Duration(cfg.VictoriaMetrics.Retention),
+	}
+
+	if cfg.Recovery.Enabled {
+		runnerParams.Recovery = &runner.RecoveryParams{
+			MarkerPath: cfg.Recovery.MarkerPath,
+		}
+	}
+
+	if cfg.BlackBox.Enabled {
+		runnerParams.BlackBox = &runner.BlackBoxParams{
+			Path:           cfg.BlackBox.Path,
+			Size:           cfg.BlackBox.SizeBytes,
+			Interval:       time.Duration(cfg.BlackBox.Interval),
+			Window:         time.Duration(cfg.BlackBox.Window),
+			DisabledInputs: cfg.BlackBox.DisabledInputs,
+		}
+	}
+
+	runnerParams.Lite = runner.LiteParams{
+		DataPath:        cfg.Lite.DataPath,
+		Retention:       time.Duration(cfg.Lite.Retention),
+		SegmentDuration: time.Duration(cfg.Lite.SegmentDuration),
+	}
+
+	if cfg.InfluxD.Mode == "external" {
+		runnerParams.External = &runner.ExternalInfluxParams{
+			URL:            cfg.InfluxD.External.URL,
+			Token:          cfg.InfluxD.External.Token,
+			TokenFile:      cfg.InfluxD.External.TokenFile,
+			Org:            cfg.InfluxD.External.Org,
+			Buckets:        cfg.InfluxD.External.Buckets,
+			ManageTelegraf: cfg.InfluxD.External.ManageTelegraf,
+		}
+	}
+
+	for _, bucket := range cfg.Buckets {
+		runnerParams.Buckets = append(runnerParams.Buckets, runner.BucketParams{
+			Name:            bucket.Name,
+			Retention:       time.Duration(bucket.Retention),
+			ExcludeBackup:   bucket.Backup == "exclude",
+			BackupFrequency: time.Duration(bucket.BackupFrequency),
+		})
+	}
+
+	if cfg.KernelEvents.Enabled {
+		runnerParams.KernelEventsSource = cfg.KernelEvents.Source
+		runnerParams.BackupOnKernelEvent = cfg.KernelEvents.BackupOnSevere
+	}
+
+	runnerParams.Triggers = runner.TriggerParams{
+		CheckInterval:   time.Duration(cfg.Triggers.CheckInterval),
+		Cooldown:        time.Duration(cfg.Triggers.Cooldown),
+		CPUPressure:     float64(cfg.Triggers.CPUPressure),
+		MemoryPressure:  float64(cfg.Triggers.MemoryPressure),
+		IOPressure:      float64(cfg.Triggers.IOPressure),
+		DiskPath:        cfg.Triggers.DiskPath,
+		DiskUsedPercent: float64(cfg.Triggers.DiskUsedPercent),
+		LoadPerCPU:      float64(cfg.Triggers.LoadPerCPU),
+		LoadDuration:    time.Duration(cfg.Triggers.LoadDuration),
+		Queries:         cfg.Triggers.Flux,
+	}
+
+	runnerParams.StorageSuccess = cfg.Storage.Success
+	runnerParams.UploadBytesPerSecond = cfg.Storage.Bandwidth.BytesPerSecond
+	for _, window := range cfg.Storage.Bandwidth.Windows {
+		runnerParams.UploadLimitWindows = append(runnerParams.UploadLimitWindows, runner.UploadLimitWindow{
+			Window:         window.Window,
+			BytesPerSecond: window.BytesPerSecond,
+		})
+	}
+	runnerParams.DeferOnMetered = cfg.Storage.Metered.NetworkManager
+	runnerParams.MeteredCheckCommand = cfg.Storage.Metered.CheckCommand
+	runnerParams.MeteredCheckInterval = time.Duration(cfg.Storage.Metered.CheckInterval)
+
+	targets := cfg.Storage.Targets
+	if len(targets) == 0 {
+		targets = []config.StorageTargetConfig{{
+			Name:   cfg.Storage.Driver,
+			Driver: cfg.Storage.Driver,
+			AWS:    cfg.Storage.AWS,
+			Local:  cfg.Storage.Local,
+		}}
+	}
+
+	for _, target := range targets {
+		storageTarget := runner.StorageTarget{
+			Name:         target.Name,
+			LocalPath:    target.Local.Path,
+			RequireMount: target.Local.RequireMount,
+			Retention:    time.Duration(target.Retention),
+			Retries:      target.Retries,
+			Optional:     target.OnFailure == "ignore",
+		}
+
+		if target.Driver == "aws" {
+			storageTarget.AWSParams = &runner.AWSParams{
+				Region:       target.AWS.Region,
+				S3BucketName: target.AWS.Bucket,
+			}
+		}
+
+		runnerParams.StorageTargets = append(runnerParams.StorageTargets, storageTarget)
+	}
+
+	return runnerParams
+}
+
+// reloadOnSighup re-reads the config file on every SIGHUP and applies it to
+// the running runner. An invalid config keeps the current one in place.
+func reloadOnSighup(sigCh <-chan os.Signal, fs *pflag.FlagSet, configPath string, cfg *config.Config, run runner.Runner, logger *zap.Logger) {
+	for range sigCh {
+		logger.Info("reloading config")
+		previous := *cfg
+
+		err := config.Apply(fs, configPath, cfg)
+		if err != nil {
+			logger.Error(err.Error())
+			continue
+		}
+
+		err = run.Reload(newRunnerParams(*cfg, logger))
+		if err != nil {
+			*cfg = previous
+			logger.Error(err.Error())
+			continue
+		}
+
+		logger.Info("config reloaded")
+	}
+}
+
+// serveControl serves the control api until morgue stops. Without it morgue
+// keeps running, only the api is missing.
+func serveControl(ctx context.Context, path string, run runner.Runner, logger *zap.Logger) {
+	server := control.NewServer(control.ServerParams{
+		Path:       path,
+		Controller: run,
+		Logger:     *logger,
+	})
+
+	err := server.Serve(ctx)
+	if err != nil {
+		logger.Error(err.Error())
+	}
+}
+
+// shutdownOnSignal gives the runner up to shutdownTimeout to upload what it
+// must before morgue exits on SIGTERM or SIGINT.
+func shutdownOnSignal(sigCh <-chan os.Signal, run runner.Runner, logger *zap.Logger) {
+	sig := <-sigCh
+	logger.Sugar().Infow("shutting down", "signal", sig.String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	err := run.Shutdown(ctx)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	os.Exit(0)
 }
@@ -0,0 +1,36 @@
+package diskspace
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Usage returns the bytes available to unprivileged users and the total size
+// of the filesystem holding path.
+func Usage(path string) (available, total uint64, err error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, 0, err
+	}
+
+	return stat.Bavail * uint64(stat.Bsize), stat.Blocks * uint64(stat.Bsize), nil
+}
+
+// DirSize returns the size of all regular files below path.
+func DirSize(path string) (uint64, error) {
+	var size uint64
+	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.Mode().IsRegular() {
+			size += uint64(info.Size())
+		}
+
+		return nil
+	})
+
+	return size, err
+}
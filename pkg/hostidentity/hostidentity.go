@@ -0,0 +1,83 @@
+package hostidentity
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	TagNode       = "node"
+	TagCloud      = "cloud"
+	TagInstanceID = "instance_id"
+
+	CloudAWS = "aws"
+	CloudGCP = "gcp"
+)
+
+// files the identity is read from. Only local files are used so detection
+// works without network access to the metadata services.
+var (
+	dmiSysVendor      = "/sys/class/dmi/id/sys_vendor"
+	dmiProductName    = "/sys/class/dmi/id/product_name"
+	dmiProductUUID    = "/sys/class/dmi/id/product_uuid"
+	dmiBoardAssetTag  = "/sys/class/dmi/id/board_asset_tag"
+	cloudInitInstance = "/var/lib/cloud/data/instance-id"
+)
+
+// Detect returns tags identifying this machine: the hostname and, when running
+// on EC2 or GCP, the cloud and instance id.
+func Detect() map[string]string {
+	tags := map[string]string{}
+
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		tags[TagNode] = hostname
+	}
+
+	cloud := detectCloud()
+	if cloud == "" {
+		return tags
+	}
+	tags[TagCloud] = cloud
+
+	if instanceID := detectInstanceID(cloud); instanceID != "" {
+		tags[TagInstanceID] = instanceID
+	}
+
+	return tags
+}
+
+func detectCloud() string {
+	vendor := readFile(dmiSysVendor)
+	product := readFile(dmiProductName)
+
+	switch {
+	case vendor == "Amazon EC2",
+		strings.HasPrefix(strings.ToLower(readFile(dmiProductUUID)), "ec2"):
+		return CloudAWS
+	case product == "Google Compute Engine", vendor == "Google":
+		return CloudGCP
+	}
+
+	return ""
+}
+
+func detectInstanceID(cloud string) string {
+	// nitro instances expose the instance id as the board asset tag
+	if cloud == CloudAWS {
+		if tag := readFile(dmiBoardAssetTag); strings.HasPrefix(tag, "i-") {
+			return tag
+		}
+	}
+
+	return readFile(cloudInitInstance)
+}
+
+func readFile(path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(data))
+}
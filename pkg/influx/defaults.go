@@ -2,6 +2,9 @@ package influx
 
 const (
 	DefaultBucketName = "metrics"
+	LogsBucketName    = "logs"
 	DefaultOrgName    = "morgue"
 	DefaultUsername   = "morgue_admin"
+
+	TelegrafAuthorizationDescription = "morgue telegraf"
 )
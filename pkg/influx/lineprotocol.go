@@ -0,0 +1,84 @@
+package influx
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	tagEscaper         = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+	stringEscaper      = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+)
+
+// Line encodes a point in line protocol with a nanosecond timestamp. Tags and
+// fields are sorted by key. Field values may be strings, bools, ints, uints or
+// floats.
+func Line(measurement string, tags map[string]string, fields map[string]interface{}, t time.Time) string {
+	var b strings.Builder
+	b.WriteString(measurementEscaper.Replace(measurement))
+
+	for _, key := range sortedKeys(tags) {
+		if tags[key] == "" {
+			continue
+		}
+		b.WriteString(",")
+		b.WriteString(tagEscaper.Replace(key))
+		b.WriteString("=")
+		b.WriteString(tagEscaper.Replace(tags[key]))
+	}
+
+	fieldKeys := make([]string, 0, len(fields))
+	for key := range fields {
+		fieldKeys = append(fieldKeys, key)
+	}
+	sort.Strings(fieldKeys)
+
+	for i, key := range fieldKeys {
+		if i == 0 {
+			b.WriteString(" ")
+		} else {
+			b.WriteString(",")
+		}
+		b.WriteString(tagEscaper.Replace(key))
+		b.WriteString("=")
+		b.WriteString(fieldValue(fields[key]))
+	}
+
+	b.WriteString(" ")
+	b.WriteString(strconv.FormatInt(t.UnixNano(), 10))
+
+	return b.String()
+}
+
+func fieldValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return `"` + stringEscaper.Replace(v) + `"`
+	case bool:
+		return strconv.FormatBool(v)
+	case int:
+		return strconv.Itoa(v) + "i"
+	case int64:
+		return strconv.FormatInt(v, 10) + "i"
+	case uint64:
+		return strconv.FormatUint(v, 10) + "u"
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return `"` + stringEscaper.Replace(fmt.Sprint(v)) + `"`
+	}
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
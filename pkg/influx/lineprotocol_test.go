@@ -0,0 +1,62 @@
+package influx
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLine(t *testing.T) {
+	at := time.Unix(0, 1500000000000000000)
+
+	tests := []struct {
+		name        string
+		measurement string
+		tags        map[string]string
+		fields      map[string]interface{}
+		want        string
+	}{
+		{
+			name:        "sorted tags and fields",
+			measurement: "cpu",
+			tags:        map[string]string{"host": "a", "cpu": "cpu0"},
+			fields:      map[string]interface{}{"usage_user": 1.5, "usage_idle": 98.5},
+			want:        "cpu,cpu=cpu0,host=a usage_idle=98.5,usage_user=1.5 1500000000000000000",
+		},
+		{
+			name:        "field types",
+			measurement: "m",
+			fields: map[string]interface{}{
+				"b": true,
+				"f": 0.25,
+				"i": 3,
+				"l": int64(-4),
+				"s": "text",
+				"u": uint64(5),
+			},
+			want: `m b=true,f=0.25,i=3i,l=-4i,s="text",u=5u 1500000000000000000`,
+		},
+		{
+			name:        "empty tags are left out",
+			measurement: "m",
+			tags:        map[string]string{"host": "", "node": "n1"},
+			fields:      map[string]interface{}{"v": 1},
+			want:        "m,node=n1 v=1i 1500000000000000000",
+		},
+		{
+			name:        "escaping",
+			measurement: "my measurement,x",
+			tags:        map[string]string{"path": "/mnt/a b", "k=v": "c,d"},
+			fields:      map[string]interface{}{"message": `say "hi" \ bye`},
+			want:        `my\ measurement\,x,k\=v=c\,d,path=/mnt/a\ b message="say \"hi\" \\ bye" 1500000000000000000`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Line(tt.measurement, tt.tags, tt.fields, at)
+			if got != tt.want {
+				t.Errorf("Line() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,340 @@
+package influx_cli
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"os"
+	"time"
+
+	influxapi "github.com/influxdata/influx-cli/v2/api"
+)
+
+// The manifest below mirrors the one written by `influx backup`, so streamed
+// backups can be restored with `influx restore` once unpacked.
+
+const (
+	manifestVersion = 2
+	// gzipCompression is how `influx backup` marks gzipped files.
+	gzipCompression = 1
+)
+
+type manifest struct {
+	Version int                   `json:"manifestVersion"`
+	KV      manifestFileEntry     `json:"kv"`
+	SQL     *manifestFileEntry    `json:"sql,omitempty"`
+	Buckets []manifestBucketEntry `json:"buckets"`
+}
+
+type manifestFileEntry struct {
+	FileName    string `json:"fileName"`
+	Size        int64  `json:"size"`
+	Compression int    `json:"compression"`
+}
+
+type manifestBucketEntry struct {
+	OrganizationID         string                    `json:"organizationID"`
+	OrganizationName       string                    `json:"organizationName"`
+	BucketID               string                    `json:"bucketID"`
+	BucketName             string                    `json:"bucketName"`
+	Description            *string                   `json:"description,omitempty"`
+	DefaultRetentionPolicy string                    `json:"defaultRetentionPolicy"`
+	RetentionPolicies      []manifestRetentionPolicy `json:"retentionPolicies"`
+}
+
+type manifestRetentionPolicy struct {
+	Name               string                 `json:"name"`
+	ReplicaN           int32                  `json:"replicaN"`
+	Duration           int64                  `json:"duration"`
+	ShardGroupDuration int64                  `json:"shardGroupDuration"`
+	ShardGroups        []manifestShardGroup   `json:"shardGroups"`
+	Subscriptions      []manifestSubscription `json:"subscriptions"`
+}
+
+type manifestShardGroup struct {
+	ID          int64                `json:"id"`
+	StartTime   time.Time            `json:"startTime"`
+	EndTime     time.Time            `json:"endTime"`
+	DeletedAt   *time.Time           `json:"deletedAt,omitempty"`
+	TruncatedAt *time.Time           `json:"truncatedAt,omitempty"`
+	Shards      []manifestShardEntry `json:"shards"`
+}
+
+type manifestShardEntry struct {
+	ID          int64             `json:"id"`
+	ShardOwners []shardOwnerEntry `json:"shardOwners"`
+	manifestFileEntry
+}
+
+type shardOwnerEntry struct {
+	NodeID int64 `json:"nodeID"`
+}
+
+type manifestSubscription struct {
+	Name         string   `json:"name"`
+	Mode         string   `json:"mode"`
+	Destinations []string `json:"destinations"`
+}
+
+type StreamBackupParams struct {
+	Org string
+	// Buckets limits the backup to the named buckets, empty backs up all of
+	// them.
+	Buckets []string
+	// Name prefixes every file of the backup.
+	Name string
+	// SpoolPath holds one file of the backup at a time, since its size must
+	// be known before it is handed to WriteFile.
+	SpoolPath string
+	// WriteFile is called with every file of the backup in turn.
+	WriteFile func(name string, size int64, r io.Reader) error
+}
+
+// StreamBackup backs up influxd like BackupInflux, handing the files to
+// WriteFile instead of writing them to a directory. It needs influxd 2.1 or
+// later.
+func (c *client) StreamBackup(inputParams StreamBackupParams) error {
+	ctx := context.Background()
+
+	m := manifest{Version: manifestVersion}
+
+	buckets, err := c.streamMetadata(ctx, inputParams, &m)
+	if err != nil {
+		return fmt.Errorf("failed to back up metadata: %w", err)
+	}
+
+	for _, bucket := range buckets {
+		if inputParams.Org != "" && bucket.OrganizationName != inputParams.Org {
+			continue
+		}
+		if len(inputParams.Buckets) > 0 && !contains(inputParams.Buckets, bucket.BucketName) {
+			continue
+		}
+
+		entry, err := c.streamBucket(ctx, inputParams, bucket)
+		if err != nil {
+			return fmt.Errorf("failed to back up bucket %s: %w", bucket.BucketName, err)
+		}
+		m.Buckets = append(m.Buckets, entry)
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return inputParams.WriteFile(inputParams.Name+".manifest", int64(len(data)), bytes.NewReader(data))
+}
+
+func (c *client) streamMetadata(ctx context.Context, inputParams StreamBackupParams, m *manifest) ([]influxapi.BucketMetadataManifest, error) {
+	rawResp, err := c.apiClient.BackupApi.GetBackupMetadata(ctx).AcceptEncoding("gzip").Execute()
+	if err != nil {
+		return nil, fmt.Errorf("failed to download metadata snapshot, streaming backups need influxd 2.1 or later: %w", err)
+	}
+	defer rawResp.Body.Close()
+
+	_, contentParams, err := mime.ParseMediaType(rawResp.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := influxapi.GunzipIfNeeded(rawResp)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	buckets := []influxapi.BucketMetadataManifest{}
+	mr := multipart.NewReader(body, contentParams["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		_, partParams, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+		if err != nil {
+			return nil, err
+		}
+
+		switch name := partParams["name"]; name {
+		case "kv":
+			m.KV, err = spool(inputParams, inputParams.Name+".bolt.gz", part, true)
+			if err != nil {
+				return nil, err
+			}
+		case "sql":
+			entry, err := spool(inputParams, inputParams.Name+".sqlite.gz", part, true)
+			if err != nil {
+				return nil, err
+			}
+			m.SQL = &entry
+		case "buckets":
+			if err := json.NewDecoder(part).Decode(&buckets); err != nil {
+				return nil, fmt.Errorf("failed to decode bucket manifest from backup: %w", err)
+			}
+		default:
+			return nil, fmt.Errorf("response contained unexpected part %q", name)
+		}
+	}
+
+	return buckets, nil
+}
+
+func (c *client) streamBucket(ctx context.Context, inputParams StreamBackupParams, bucket influxapi.BucketMetadataManifest) (manifestBucketEntry, error) {
+	entry := manifestBucketEntry{
+		OrganizationID:         bucket.OrganizationID,
+		OrganizationName:       bucket.OrganizationName,
+		BucketID:               bucket.BucketID,
+		BucketName:             bucket.BucketName,
+		Description:            bucket.Description,
+		DefaultRetentionPolicy: bucket.DefaultRetentionPolicy,
+	}
+
+	for _, rp := range bucket.RetentionPolicies {
+		policy := manifestRetentionPolicy{
+			Name:               rp.Name,
+			ReplicaN:           rp.ReplicaN,
+			Duration:           rp.Duration,
+			ShardGroupDuration: rp.ShardGroupDuration,
+			ShardGroups:        []manifestShardGroup{},
+			Subscriptions:      []manifestSubscription{},
+		}
+
+		for _, sg := range rp.ShardGroups {
+			group := manifestShardGroup{
+				ID:          sg.Id,
+				StartTime:   sg.StartTime,
+				EndTime:     sg.EndTime,
+				DeletedAt:   sg.DeletedAt,
+				TruncatedAt: sg.TruncatedAt,
+				Shards:      []manifestShardEntry{},
+			}
+
+			for _, shard := range sg.Shards {
+				file, ok, err := c.streamShard(ctx, inputParams, shard.Id)
+				if err != nil {
+					return manifestBucketEntry{}, err
+				}
+				// the shard was deleted during the backup
+				if !ok {
+					continue
+				}
+
+				shardEntry := manifestShardEntry{
+					ID:                shard.Id,
+					manifestFileEntry: file,
+				}
+				for _, owner := range shard.ShardOwners {
+					shardEntry.ShardOwners = append(shardEntry.ShardOwners, shardOwnerEntry{NodeID: owner.NodeID})
+				}
+				group.Shards = append(group.Shards, shardEntry)
+			}
+
+			policy.ShardGroups = append(policy.ShardGroups, group)
+		}
+
+		for _, s := range rp.Subscriptions {
+			policy.Subscriptions = append(policy.Subscriptions, manifestSubscription{
+				Name:         s.Name,
+				Mode:         s.Mode,
+				Destinations: s.Destinations,
+			})
+		}
+
+		entry.RetentionPolicies = append(entry.RetentionPolicies, policy)
+	}
+
+	return entry, nil
+}
+
+func (c *client) streamShard(ctx context.Context, inputParams StreamBackupParams, shardID int64) (manifestFileEntry, bool, error) {
+	res, err := c.apiClient.BackupApi.GetBackupShardId(ctx, shardID).AcceptEncoding("gzip").Execute()
+	if err != nil {
+		if apiError, ok := err.(influxapi.ApiError); ok && apiError.ErrorCode() == influxapi.ERRORCODE_NOT_FOUND {
+			return manifestFileEntry{}, false, nil
+		}
+		return manifestFileEntry{}, false, err
+	}
+	defer res.Body.Close()
+
+	name := fmt.Sprintf("%s.%d.tar.gz", inputParams.Name, shardID)
+	entry, err := spool(inputParams, name, res.Body, res.Header.Get("Content-Encoding") != "gzip")
+	if err != nil {
+		return manifestFileEntry{}, false, fmt.Errorf("failed to download snapshot of shard %d: %w", shardID, err)
+	}
+
+	return entry, true, nil
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// spool writes r to a temporary file below SpoolPath, gzipping it if asked,
+// and hands the file to WriteFile once its size is known.
+func spool(inputParams StreamBackupParams, name string, r io.Reader, compress bool) (manifestFileEntry, error) {
+	err := os.MkdirAll(inputParams.SpoolPath, 0700)
+	if err != nil {
+		return manifestFileEntry{}, err
+	}
+
+	file, err := ioutil.TempFile(inputParams.SpoolPath, "spool-")
+	if err != nil {
+		return manifestFileEntry{}, err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	var w io.Writer = file
+	var gzw *gzip.Writer
+	if compress {
+		gzw = gzip.NewWriter(file)
+		w = gzw
+	}
+
+	_, err = io.Copy(w, r)
+	if err != nil {
+		return manifestFileEntry{}, err
+	}
+
+	if gzw != nil {
+		if err := gzw.Close(); err != nil {
+			return manifestFileEntry{}, err
+		}
+	}
+
+	size, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return manifestFileEntry{}, err
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return manifestFileEntry{}, err
+	}
+
+	err = inputParams.WriteFile(name, size, file)
+	if err != nil {
+		return manifestFileEntry{}, err
+	}
+
+	return manifestFileEntry{
+		FileName:    name,
+		Size:        size,
+		Compression: gzipCompression,
+	}, nil
+}
@@ -2,13 +2,19 @@ package influx_cli
 
 import (
 	"context"
+	"encoding/csv"
 	"fmt"
+	"io"
 	"net/url"
+	"os"
 	"runtime"
+	"strings"
+	"time"
 
 	influxapi "github.com/influxdata/influx-cli/v2/api"
 	"github.com/influxdata/influx-cli/v2/clients"
 	"github.com/influxdata/influx-cli/v2/clients/backup"
+	"github.com/influxdata/influx-cli/v2/clients/restore"
 	"github.com/influxdata/influx-cli/v2/clients/setup"
 	"github.com/influxdata/influx-cli/v2/config"
 
@@ -47,6 +53,10 @@ func newApiClient(configSvc config.Service, injectToken bool) (*influxapi.APICli
 		return nil, err
 	}
 
+	return newApiClientFromConfig(cfg, injectToken)
+}
+
+func newApiClientFromConfig(cfg config.Config, injectToken bool) (*influxapi.APIClient, error) {
 	configParams := influxapi.ConfigParams{
 		UserAgent:        fmt.Sprintf("influx/%s", runtime.GOOS),
 		AllowInsecureTLS: false,
@@ -68,9 +78,37 @@ func newApiClient(configSvc config.Service, injectToken bool) (*influxapi.APICli
 	return influxapi.NewAPIClient(apiConfig), nil
 }
 
+// RemoveConfig deletes the local CLI config store so that a fresh onboarding
+// can write its own default config.
+func RemoveConfig() error {
+	configPath, err := config.DefaultPath()
+	if err != nil {
+		return err
+	}
+
+	err = os.RemoveAll(configPath)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
 type Client interface {
+	IsOnboarded() (bool, error)
+	GetActiveToken() string
 	SetupInflux(SetupInfluxParams) error
 	BackupInflux(BackupInfluxParams) error
+	RestoreInflux(RestoreInfluxParams) error
+	StreamBackup(StreamBackupParams) error
+	EnsureAuthorization(AuthorizationParams) (string, error)
+	CopyAuthorization(token string) (string, error)
+	DeleteAuthorization(token string) error
+	EnsureBucket(BucketParams) error
+	CreateBucket(BucketParams) error
+	UpdateBucket(BucketParams) error
+	Write(WriteParams) error
+	Query(QueryParams) ([]map[string]string, error)
 }
 
 type client struct {
@@ -95,6 +133,56 @@ func NewClient() (Client, error) {
 	}, nil
 }
 
+// ClientParams point a client at an influxd that isn't set up through the
+// local CLI config, such as an existing instance morgue doesn't manage.
+type ClientParams struct {
+	Host  string
+	Token string
+	Org   string
+}
+
+// NewClientWithParams returns a client for the influxd at Host, leaving the
+// local CLI config untouched.
+func NewClientWithParams(params ClientParams) (Client, error) {
+	cfg := config.Config{
+		Name:   "morgue",
+		Host:   params.Host,
+		Token:  params.Token,
+		Org:    params.Org,
+		Active: true,
+	}
+
+	apiClient, err := newApiClientFromConfig(cfg, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return &client{
+		cli: clients.CLI{
+			StdIO:        stdio.TerminalStdio,
+			PrintAsJSON:  true,
+			ActiveConfig: cfg,
+		},
+		apiClient: apiClient,
+	}, nil
+}
+
+// IsOnboarded reports whether the influxd instance already has an initial
+// user, org and bucket.
+func (c *client) IsOnboarded() (bool, error) {
+	resp, err := c.apiClient.SetupApi.GetSetup(context.Background()).Execute()
+	if err != nil {
+		return false, err
+	}
+
+	return resp.Allowed == nil || !*resp.Allowed, nil
+}
+
+// GetActiveToken returns the token stored in the active CLI config.
+func (c *client) GetActiveToken() string {
+	return c.cli.ActiveConfig.Token
+}
+
 type SetupInfluxParams struct {
 	Username  string
 	Password  string
@@ -158,3 +246,415 @@ func (c *client) BackupInflux(inputParams BackupInfluxParams) error {
 
 	return nil
 }
+
+type RestoreInfluxParams struct {
+	Org    string
+	Bucket string
+	Path   string
+	// Full replaces all data on the server, including users and tokens,
+	// with the backup.
+	Full bool
+}
+
+func (c *client) RestoreInflux(inputParams RestoreInfluxParams) error {
+
+	client := restore.Client{
+		CLI:              c.cli,
+		HealthApi:        c.apiClient.HealthApi,
+		RestoreApi:       c.apiClient.RestoreApi,
+		BucketsApi:       c.apiClient.BucketsApi,
+		OrganizationsApi: c.apiClient.OrganizationsApi,
+		ApiConfig:        c.apiClient,
+	}
+
+	params := restore.Params{
+		Path: inputParams.Path,
+		Full: inputParams.Full,
+	}
+
+	params.BucketName = inputParams.Bucket
+	params.OrgName = inputParams.Org
+
+	err := client.Restore(context.Background(), &params)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+type AuthorizationParams struct {
+	Description string
+	Org         string
+	Buckets     []string
+	Read        bool
+	Write       bool
+}
+
+// EnsureAuthorization returns the token of the authorization matching the
+// description, creating one scoped to the buckets if none exists yet. An
+// existing authorization missing some of the permissions is replaced.
+func (c *client) EnsureAuthorization(inputParams AuthorizationParams) (string, error) {
+	ctx := context.Background()
+
+	orgID, err := c.getOrgID(ctx, inputParams.Org)
+	if err != nil {
+		return "", err
+	}
+
+	permissions := []influxapi.Permission{}
+	for _, bucket := range inputParams.Buckets {
+		bucketID, err := c.getBucketID(ctx, orgID, bucket)
+		if err != nil {
+			return "", err
+		}
+
+		resource := influxapi.PermissionResource{
+			Type:  "buckets",
+			Id:    influxapi.PtrString(bucketID),
+			OrgID: influxapi.PtrString(orgID),
+		}
+
+		if inputParams.Read {
+			permissions = append(permissions, *influxapi.NewPermission("read", resource))
+		}
+		if inputParams.Write {
+			permissions = append(permissions, *influxapi.NewPermission("write", resource))
+		}
+	}
+
+	if len(permissions) == 0 {
+		return "", fmt.Errorf("authorization %q has no permissions", inputParams.Description)
+	}
+
+	auths, err := c.apiClient.AuthorizationsApi.GetAuthorizations(ctx).OrgID(orgID).Execute()
+	if err != nil {
+		return "", err
+	}
+
+	if auths.Authorizations != nil {
+		for _, auth := range *auths.Authorizations {
+			if auth.GetDescription() != inputParams.Description || auth.GetStatus() != "active" {
+				continue
+			}
+
+			if samePermissions(auth, permissions) {
+				return auth.GetToken(), nil
+			}
+
+			err = c.apiClient.AuthorizationsApi.DeleteAuthorizationsID(ctx, auth.GetId()).Execute()
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	request := influxapi.NewAuthorizationPostRequest(orgID, permissions)
+	request.SetDescription(inputParams.Description)
+
+	auth, err := c.apiClient.AuthorizationsApi.PostAuthorizations(ctx).AuthorizationPostRequest(*request).Execute()
+	if err != nil {
+		return "", err
+	}
+
+	return auth.GetToken(), nil
+}
+
+// CopyAuthorization creates an authorization with the org, user, permissions
+// and description of the one holding token, and returns its new token.
+// influxd generates the token, it can't be chosen.
+func (c *client) CopyAuthorization(token string) (string, error) {
+	ctx := context.Background()
+
+	auth, err := c.findAuthorization(ctx, token)
+	if err != nil {
+		return "", err
+	}
+
+	request := influxapi.NewAuthorizationPostRequest(auth.OrgID, auth.Permissions)
+	if auth.UserID != nil {
+		request.SetUserID(auth.GetUserID())
+	}
+	if auth.Description != nil {
+		request.SetDescription(auth.GetDescription())
+	}
+
+	copied, err := c.apiClient.AuthorizationsApi.PostAuthorizations(ctx).AuthorizationPostRequest(*request).Execute()
+	if err != nil {
+		return "", err
+	}
+
+	return copied.GetToken(), nil
+}
+
+// DeleteAuthorization deletes the authorization holding token, so influxd
+// no longer accepts it.
+func (c *client) DeleteAuthorization(token string) error {
+	ctx := context.Background()
+
+	auth, err := c.findAuthorization(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	return c.apiClient.AuthorizationsApi.DeleteAuthorizationsID(ctx, auth.GetId()).Execute()
+}
+
+func (c *client) findAuthorization(ctx context.Context, token string) (*influxapi.Authorization, error) {
+	auths, err := c.apiClient.AuthorizationsApi.GetAuthorizations(ctx).Execute()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, auth := range auths.GetAuthorizations() {
+		if auth.GetToken() == token {
+			return &auth, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no authorization holds the token")
+}
+
+// samePermissions reports whether auth grants exactly permissions. An
+// authorization granting more is replaced, so tokens keep least privilege.
+func samePermissions(auth influxapi.Authorization, permissions []influxapi.Permission) bool {
+	return containsPermissions(auth.Permissions, permissions) &&
+		containsPermissions(permissions, auth.Permissions)
+}
+
+func containsPermissions(granted, wanted []influxapi.Permission) bool {
+	for _, w := range wanted {
+		found := false
+		for _, g := range granted {
+			if g.Action == w.Action &&
+				g.Resource.Type == w.Resource.Type &&
+				g.Resource.GetId() == w.Resource.GetId() &&
+				g.Resource.GetOrgID() == w.Resource.GetOrgID() {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+type BucketParams struct {
+	Org       string
+	Name      string
+	Retention time.Duration
+}
+
+// EnsureBucket creates the bucket, or updates its retention when it already
+// exists with a different one.
+func (c *client) EnsureBucket(inputParams BucketParams) error {
+	ctx := context.Background()
+
+	orgID, err := c.getOrgID(ctx, inputParams.Org)
+	if err != nil {
+		return err
+	}
+
+	bucket, err := c.findBucket(ctx, orgID, inputParams.Name)
+	if err != nil {
+		return err
+	}
+
+	if bucket == nil {
+		return c.CreateBucket(inputParams)
+	}
+
+	if bucketRetention(*bucket) == inputParams.Retention.Round(time.Second) {
+		return nil
+	}
+
+	return c.UpdateBucket(inputParams)
+}
+
+// CreateBucket creates a bucket, a zero retention keeps data forever.
+func (c *client) CreateBucket(inputParams BucketParams) error {
+	ctx := context.Background()
+
+	orgID, err := c.getOrgID(ctx, inputParams.Org)
+	if err != nil {
+		return err
+	}
+
+	rules := []influxapi.RetentionRule{
+		*influxapi.NewRetentionRule("expire", retentionSeconds(inputParams.Retention)),
+	}
+
+	request := influxapi.NewPostBucketRequest(orgID, inputParams.Name, rules)
+	_, err = c.apiClient.BucketsApi.PostBuckets(ctx).PostBucketRequest(*request).Execute()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// UpdateBucket sets the retention of an existing bucket.
+func (c *client) UpdateBucket(inputParams BucketParams) error {
+	ctx := context.Background()
+
+	orgID, err := c.getOrgID(ctx, inputParams.Org)
+	if err != nil {
+		return err
+	}
+
+	bucketID, err := c.getBucketID(ctx, orgID, inputParams.Name)
+	if err != nil {
+		return err
+	}
+
+	rule := influxapi.NewPatchRetentionRule("expire")
+	rule.SetEverySeconds(retentionSeconds(inputParams.Retention))
+
+	request := influxapi.NewPatchBucketRequest()
+	request.SetRetentionRules([]influxapi.PatchRetentionRule{*rule})
+
+	_, err = c.apiClient.BucketsApi.PatchBucketsID(ctx, bucketID).PatchBucketRequest(*request).Execute()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func retentionSeconds(retention time.Duration) int64 {
+	return int64(retention.Round(time.Second) / time.Second)
+}
+
+// bucketRetention returns the retention of the expire rule of a bucket, zero
+// if it keeps data forever.
+func bucketRetention(bucket influxapi.Bucket) time.Duration {
+	for _, rule := range bucket.RetentionRules {
+		if rule.GetType() == "expire" {
+			return time.Duration(rule.GetEverySeconds()) * time.Second
+		}
+	}
+
+	return 0
+}
+
+// findBucket returns the bucket named name, or nil when there is none.
+func (c *client) findBucket(ctx context.Context, orgID, name string) (*influxapi.Bucket, error) {
+	buckets, err := c.apiClient.BucketsApi.GetBuckets(ctx).OrgID(orgID).Name(name).Execute()
+	if err != nil {
+		return nil, err
+	}
+
+	if buckets.Buckets == nil || len(*buckets.Buckets) == 0 {
+		return nil, nil
+	}
+
+	return &(*buckets.Buckets)[0], nil
+}
+
+func (c *client) getOrgID(ctx context.Context, org string) (string, error) {
+	orgs, err := c.apiClient.OrganizationsApi.GetOrgs(ctx).Org(org).Execute()
+	if err != nil {
+		return "", err
+	}
+
+	if orgs.Orgs == nil || len(*orgs.Orgs) == 0 {
+		return "", fmt.Errorf("org %q not found", org)
+	}
+
+	return (*orgs.Orgs)[0].GetId(), nil
+}
+
+func (c *client) getBucketID(ctx context.Context, orgID, bucket string) (string, error) {
+	buckets, err := c.apiClient.BucketsApi.GetBuckets(ctx).OrgID(orgID).Name(bucket).Execute()
+	if err != nil {
+		return "", err
+	}
+
+	if buckets.Buckets == nil || len(*buckets.Buckets) == 0 {
+		return "", fmt.Errorf("bucket %q not found", bucket)
+	}
+
+	return (*buckets.Buckets)[0].GetId(), nil
+}
+
+type WriteParams struct {
+	Org    string
+	Bucket string
+	// Lines are points in line protocol with nanosecond timestamps.
+	Lines []string
+}
+
+func (c *client) Write(inputParams WriteParams) error {
+	body := []byte(strings.Join(inputParams.Lines, "\n"))
+
+	err := c.apiClient.WriteApi.PostWrite(context.Background()).
+		Org(inputParams.Org).
+		Bucket(inputParams.Bucket).
+		Precision(influxapi.WRITEPRECISION_NS).
+		Body(body).
+		Execute()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+type QueryParams struct {
+	Org   string
+	Query string
+}
+
+// Query runs a flux query and returns one map per result row, keyed by
+// column name.
+func (c *client) Query(inputParams QueryParams) ([]map[string]string, error) {
+	resp, err := c.apiClient.QueryApi.PostQuery(context.Background()).
+		Org(inputParams.Org).
+		Query(*influxapi.NewQuery(inputParams.Query)).
+		AcceptEncoding("gzip").
+		Execute()
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := influxapi.GunzipIfNeeded(resp)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+
+	rows := []map[string]string{}
+	var header []string
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// every table of the result starts with its own header row
+		if len(record) > 2 && record[1] == "result" && record[2] == "table" {
+			header = record
+			continue
+		}
+
+		row := map[string]string{}
+		for i, value := range record {
+			if i < len(header) && header[i] != "" {
+				row[header[i]] = value
+			}
+		}
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
@@ -5,9 +5,23 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
-	"time"
+	"strings"
 )
 
+// SystemdEnginePath is where the influxdb packages store their data.
+const SystemdEnginePath = "/var/lib/influxdb/engine"
+
+// EnginePath returns where an influxd started by the current user stores its
+// data.
+func EnginePath() (string, error) {
+	dirname, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dirname, ".influxdbv2", "engine"), nil
+}
+
 func CleanupConfigFile() error {
 	dirname, err := os.UserHomeDir()
 	if err != nil {
@@ -23,11 +37,6 @@ func CleanupConfigFile() error {
 }
 
 func RunInfluxD(abort <-chan error, influxDLocation string) error {
-	err := CleanupConfigFile()
-	if err != nil {
-		return err
-	}
-
 	/* #nosec */
 	cmd := exec.Command(influxDLocation)
 	cmd.Stdout = os.Stdout
@@ -52,16 +61,16 @@ func RunInfluxD(abort <-chan error, influxDLocation string) error {
 	}
 }
 
-func WaitForInfluxDReady() {
-	for {
-		resp, err := http.Get("http://localhost:8086/health")
-		if err != nil {
-			continue
-		}
-		if resp.StatusCode == 200 {
-			break
-		}
+// LocalURL is where an influxd run by morgue listens.
+const LocalURL = "http://127.0.0.1:8086"
 
-		time.Sleep(time.Second * 10)
+// Healthy reports whether the influxd at url answers requests.
+func Healthy(url string) bool {
+	resp, err := http.Get(strings.TrimSuffix(url, "/") + "/health")
+	if err != nil {
+		return false
 	}
+	resp.Body.Close()
+
+	return resp.StatusCode == 200
 }
@@ -7,9 +7,20 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 func Tar(source, target string) error {
+	return tarDirectory(source, target, false)
+}
+
+// TarAndRemove tars source like Tar, removing every file once it is in the
+// archive. It only needs room for the largest file on top of source.
+func TarAndRemove(source, target string) error {
+	return tarDirectory(source, target, true)
+}
+
+func tarDirectory(source, target string, remove bool) error {
 	filename := filepath.Base(source)
 	target = filepath.Join(target, fmt.Sprintf("%s.tar", filename))
 	tarfile, err := os.Create(target)
@@ -59,6 +70,37 @@ func Tar(source, target string) error {
 			}
 			defer file.Close()
 			_, err = io.Copy(tarball, file)
-			return err
+			if err != nil || !remove {
+				return err
+			}
+
+			return os.Remove(path)
 		})
 }
+
+// AddDirectory writes a directory entry to tarball.
+func AddDirectory(tarball *tar.Writer, name string) error {
+	return tarball.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     name + "/",
+		Mode:     0755,
+		ModTime:  time.Now(),
+	})
+}
+
+// AddFile writes size bytes read from r to tarball as a regular file.
+func AddFile(tarball *tar.Writer, name string, size int64, r io.Reader) error {
+	err := tarball.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0600,
+		ModTime:  time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.CopyN(tarball, r, size)
+	return err
+}
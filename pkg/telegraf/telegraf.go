@@ -1,63 +1,324 @@
 package telegraf
 
 import (
+	"bufio"
 	"bytes"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
+	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 )
 
 type TelegrafConfig struct {
+	// Output is OutputInfluxDBV2, the default, or OutputInfluxDB for
+	// databases that take the influx 1.x write api.
+	Output       string
 	Token        string
 	Urls         []string
 	Organization string
 	Bucket       string
+	GlobalTags   map[string]string
+	Agent        AgentConfig
+	Plugins      Plugins
+	Prometheus   PrometheusInput
+	Logs         LogsInput
 }
 
-func WriteTelegrafConfig(config TelegrafConfig, path string) error {
-	buf := new(bytes.Buffer)
-	top := map[string]interface{}{
-		"global_tags": map[string]interface{}{},
-		"agent": map[string]interface{}{
-			"interval":            "10s",
-			"round_interval":      true,
-			"metric_batch_size":   1000,
-			"metric_buffer_limit": 10000,
-			"collection_jitter":   "0s",
-			"flush_interval":      "10s",
-			"flush_jitter":        "0s",
-			"precision":           "0s",
-			"hostname":            "",
-			"omit_hostname":       false,
+const (
+	OutputInfluxDBV2 = "influxdb_v2"
+	OutputInfluxDB   = "influxdb"
+)
+
+const (
+	LogSourceJournald = "journald"
+	LogSourceSyslog   = "syslog"
+)
+
+// LogsInput configures telegraf to collect logs into their own bucket.
+type LogsInput struct {
+	// Source is one of LogSourceJournald or LogSourceSyslog, empty disables
+	// log collection.
+	Source string
+	// SyslogServer is the address the syslog input listens on, for example
+	// udp://127.0.0.1:6514.
+	SyslogServer string
+	Bucket       string
+}
+
+func (l LogsInput) enabled() bool {
+	return l.Source != ""
+}
+
+// measurement is the name of the measurement the logs are written to, used to
+// route them to the logs bucket.
+func (l LogsInput) measurement() string {
+	return l.Source
+}
+
+func logsInput(l LogsInput) (string, map[string]interface{}) {
+	if l.Source == LogSourceSyslog {
+		return "syslog", map[string]interface{}{
+			"server": l.SyslogServer,
+		}
+	}
+
+	return "execd", map[string]interface{}{
+		"command":            []string{"journalctl", "--follow", "--lines=0", "--output=json"},
+		"signal":             "none",
+		"data_format":        "json",
+		"name_override":      l.measurement(),
+		"tag_keys":           []string{"PRIORITY", "SYSLOG_IDENTIFIER", "_SYSTEMD_UNIT", "_TRANSPORT"},
+		"json_string_fields": []string{"MESSAGE", "_PID", "_COMM"},
+		"json_time_key":      "__REALTIME_TIMESTAMP",
+		"json_time_format":   "unix_us",
+	}
+}
+
+// addInput adds another instance of a plugin next to any already configured.
+func addInput(inputs map[string]interface{}, name string, input map[string]interface{}) {
+	existing, ok := inputs[name]
+	if !ok {
+		inputs[name] = input
+		return
+	}
+
+	switch e := existing.(type) {
+	case []interface{}:
+		inputs[name] = append(append([]interface{}{}, e...), input)
+	case []map[string]interface{}:
+		inputs[name] = append(append([]map[string]interface{}{}, e...), input)
+	default:
+		inputs[name] = []interface{}{e, input}
+	}
+}
+
+// PrometheusInput configures telegraf to scrape prometheus endpoints into the
+// same bucket as the system metrics.
+type PrometheusInput struct {
+	Urls []string
+	// TargetsFile lists further urls, one per line. It is read every time the
+	// telegraf config is written.
+	TargetsFile string
+	// MonitorKubernetesPods scrapes the pods on this node that carry the
+	// prometheus.io/scrape annotation.
+	MonitorKubernetesPods   bool
+	KubernetesNodeIP        string
+	KubernetesLabelSelector string
+}
+
+func (p PrometheusInput) enabled() bool {
+	return len(p.Urls) > 0 || p.TargetsFile != "" || p.MonitorKubernetesPods
+}
+
+// readTargetsFile returns the urls in path, skipping blank lines and lines
+// starting with #.
+func readTargetsFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	urls := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		urls = append(urls, line)
+	}
+
+	return urls, scanner.Err()
+}
+
+func prometheusInput(p PrometheusInput) (map[string]interface{}, error) {
+	urls := append([]string{}, p.Urls...)
+	if p.TargetsFile != "" {
+		targets, err := readTargetsFile(p.TargetsFile)
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, targets...)
+	}
+
+	input := map[string]interface{}{
+		"urls":           urls,
+		"metric_version": 2,
+	}
+
+	if p.MonitorKubernetesPods {
+		input["monitor_kubernetes_pods"] = true
+		input["pod_scrape_scope"] = "node"
+		if p.KubernetesNodeIP != "" {
+			input["node_ip"] = p.KubernetesNodeIP
+		}
+		if p.KubernetesLabelSelector != "" {
+			input["kubernetes_label_selector"] = p.KubernetesLabelSelector
+		}
+	}
+
+	return input, nil
+}
+
+// AgentConfig holds the settings of the telegraf [agent] section.
+type AgentConfig struct {
+	Interval          time.Duration
+	RoundInterval     bool
+	MetricBatchSize   int
+	MetricBufferLimit int
+	CollectionJitter  time.Duration
+	FlushInterval     time.Duration
+	FlushJitter       time.Duration
+	Precision         time.Duration
+	Hostname          string
+	OmitHostname      bool
+}
+
+// DefaultAgentConfig returns the agent settings morgue used before they were
+// configurable.
+func DefaultAgentConfig() AgentConfig {
+	return AgentConfig{
+		Interval:          10 * time.Second,
+		RoundInterval:     true,
+		MetricBatchSize:   1000,
+		MetricBufferLimit: 10000,
+		FlushInterval:     10 * time.Second,
+	}
+}
+
+// Plugins holds telegraf plugin sections passed through as is. Each entry maps
+// a plugin name to either one table of settings or a list of tables for
+// several instances of the same plugin.
+type Plugins struct {
+	Inputs      map[string]interface{}
+	Processors  map[string]interface{}
+	Aggregators map[string]interface{}
+	// DisabledInputs drops inputs from the defaults.
+	DisabledInputs []string
+}
+
+// DefaultInputs returns the inputs morgue collects unless told otherwise.
+func DefaultInputs() map[string]interface{} {
+	return map[string]interface{}{
+		"cpu": map[string]interface{}{
+			"percpu":           true,
+			"totalcpu":         true,
+			"collect_cpu_time": false,
+			"report_active":    false,
+			"core_tags":        false,
 		},
-		"outputs": map[string]interface{}{
-			"influxdb_v2": map[string]interface{}{
+		"disk": map[string]interface{}{
+			"ignore_fs": []string{"tmpfs", "devtmpfs", "devfs", "iso9660", "overlay", "aufs", "squashfs"},
+		},
+		"diskio":    map[string]interface{}{},
+		"kernel":    map[string]interface{}{},
+		"processes": map[string]interface{}{},
+		"swap":      map[string]interface{}{},
+		"system":    map[string]interface{}{},
+	}
+}
+
+// mergeInputs layers the user inputs over the defaults, replacing a default
+// input entirely when the user configures one of the same name.
+func mergeInputs(plugins Plugins) map[string]interface{} {
+	inputs := DefaultInputs()
+	for _, name := range plugins.DisabledInputs {
+		delete(inputs, name)
+	}
+
+	for name, input := range plugins.Inputs {
+		inputs[name] = input
+	}
+
+	return inputs
+}
+
+func WriteTelegrafConfig(config TelegrafConfig, path string) error {
+	inputs := mergeInputs(config.Plugins)
+
+	// an input configured by hand takes precedence over the generated one
+	if _, ok := inputs["prometheus"]; !ok && config.Prometheus.enabled() {
+		input, err := prometheusInput(config.Prometheus)
+		if err != nil {
+			return err
+		}
+		inputs["prometheus"] = input
+	}
+
+	output := config.Output
+	if output == "" {
+		output = OutputInfluxDBV2
+	}
+
+	metricsOutput := map[string]interface{}{
+		"urls":         config.Urls,
+		"token":        config.Token,
+		"organization": config.Organization,
+		"bucket":       config.Bucket,
+	}
+	if output == OutputInfluxDB {
+		metricsOutput = map[string]interface{}{
+			"urls":                   config.Urls,
+			"database":               config.Bucket,
+			"skip_database_creation": true,
+		}
+	}
+
+	var outputs interface{} = metricsOutput
+	if config.Logs.enabled() {
+		name, input := logsInput(config.Logs)
+		addInput(inputs, name, input)
+
+		metricsOutput["namedrop"] = []string{config.Logs.measurement()}
+		outputs = []map[string]interface{}{
+			metricsOutput,
+			{
 				"urls":         config.Urls,
 				"token":        config.Token,
 				"organization": config.Organization,
-				"bucket":       config.Bucket,
+				"bucket":       config.Logs.Bucket,
+				"namepass":     []string{config.Logs.measurement()},
 			},
+		}
+	}
+
+	globalTags := map[string]interface{}{}
+	for key, value := range config.GlobalTags {
+		globalTags[key] = value
+	}
+
+	buf := new(bytes.Buffer)
+	top := map[string]interface{}{
+		"global_tags": globalTags,
+		"agent": map[string]interface{}{
+			"interval":            config.Agent.Interval.String(),
+			"round_interval":      config.Agent.RoundInterval,
+			"metric_batch_size":   config.Agent.MetricBatchSize,
+			"metric_buffer_limit": config.Agent.MetricBufferLimit,
+			"collection_jitter":   config.Agent.CollectionJitter.String(),
+			"flush_interval":      config.Agent.FlushInterval.String(),
+			"flush_jitter":        config.Agent.FlushJitter.String(),
+			"precision":           config.Agent.Precision.String(),
+			"hostname":            config.Agent.Hostname,
+			"omit_hostname":       config.Agent.OmitHostname,
 		},
-		"inputs": map[string]interface{}{
-			"cpu": map[string]interface{}{
-				"percpu":           true,
-				"totalcpu":         true,
-				"collect_cpu_time": false,
-				"report_active":    false,
-				"core_tags":        false,
-			},
-			"disk": map[string]interface{}{
-				"ignore_fs": []string{"tmpfs", "devtmpfs", "devfs", "iso9660", "overlay", "aufs", "squashfs"},
-			},
-			"diskio":    map[string]interface{}{},
-			"kernel":    map[string]interface{}{},
-			"processes": map[string]interface{}{},
-			"swap":      map[string]interface{}{},
-			"system":    map[string]interface{}{},
+		"outputs": map[string]interface{}{
+			output: outputs,
 		},
+		"inputs": inputs,
+	}
+
+	if len(config.Plugins.Processors) > 0 {
+		top["processors"] = config.Plugins.Processors
+	}
+
+	if len(config.Plugins.Aggregators) > 0 {
+		top["aggregators"] = config.Plugins.Aggregators
 	}
 
 	if err := toml.NewEncoder(buf).Encode(top); err != nil {
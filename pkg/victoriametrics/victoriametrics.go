@@ -0,0 +1,268 @@
+package victoriametrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// LocalURL is where a victoria-metrics run by morgue listens.
+	LocalURL = "http://127.0.0.1:8428"
+	// SystemdDataPath is where the victoria-metrics packages store their
+	// data.
+	SystemdDataPath = "/var/lib/victoria-metrics"
+	// snapshotsDirectory holds the snapshots below the data path.
+	snapshotsDirectory = "snapshots"
+)
+
+// DataPath returns where a victoria-metrics started by the current user
+// stores its data.
+func DataPath() (string, error) {
+	dirname, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dirname, ".victoria-metrics"), nil
+}
+
+// RunParams configure a victoria-metrics started by morgue.
+type RunParams struct {
+	Location  string
+	DataPath  string
+	Retention time.Duration
+}
+
+// Args returns the command line of a victoria-metrics run with params.
+func Args(params RunParams) []string {
+	return []string{
+		"-storageDataPath=" + params.DataPath,
+		"-retentionPeriod=" + retentionPeriod(params.Retention),
+		"-httpListenAddr=127.0.0.1:8428",
+	}
+}
+
+// retentionPeriod formats retention in hours, the smallest unit
+// victoria-metrics takes. It keeps data for at least a day.
+func retentionPeriod(retention time.Duration) string {
+	hours := int64(retention / time.Hour)
+	if hours < 24 {
+		hours = 24
+	}
+
+	return fmt.Sprintf("%dh", hours)
+}
+
+func Run(abort <-chan error, params RunParams) error {
+	/* #nosec */
+	cmd := exec.Command(params.Location, Args(params)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-abort:
+		if errKill := cmd.Process.Kill(); errKill != nil {
+		}
+
+		return err
+	case err := <-done:
+		return err
+	}
+}
+
+// Healthy reports whether the victoria-metrics at baseURL answers requests.
+func Healthy(baseURL string) bool {
+	resp, err := http.Get(strings.TrimSuffix(baseURL, "/") + "/health")
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode == 200
+}
+
+type Client interface {
+	CreateSnapshot() (string, error)
+	DeleteSnapshot(name string) error
+	// Write adds points in influx line protocol with nanosecond timestamps,
+	// labelled with db like telegraf's influxdb output does.
+	Write(db string, lines []string) error
+	// Query runs an instant PromQL or MetricsQL query and returns one map
+	// per series, holding its labels and its _time and _value.
+	Query(query string) ([]map[string]string, error)
+}
+
+type client struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+func NewClient(baseURL string) Client {
+	return &client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: &http.Client{Timeout: time.Minute},
+	}
+}
+
+type snapshotResponse struct {
+	Status   string `json:"status"`
+	Snapshot string `json:"snapshot"`
+	Msg      string `json:"msg"`
+}
+
+// SnapshotPath returns the directory of a snapshot below the data path.
+func SnapshotPath(dataPath, name string) string {
+	return filepath.Join(dataPath, snapshotsDirectory, name)
+}
+
+// CreateSnapshot takes a snapshot of the data and returns its name.
+func (c *client) CreateSnapshot() (string, error) {
+	var resp snapshotResponse
+	err := c.post("/snapshot/create", nil, &resp)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.Status != "ok" {
+		return "", fmt.Errorf("unable to create snapshot: %s", resp.Msg)
+	}
+
+	return resp.Snapshot, nil
+}
+
+func (c *client) DeleteSnapshot(name string) error {
+	var resp snapshotResponse
+	err := c.post("/snapshot/delete?snapshot="+url.QueryEscape(name), nil, &resp)
+	if err != nil {
+		return err
+	}
+
+	if resp.Status != "ok" {
+		return fmt.Errorf("unable to delete snapshot %s: %s", name, resp.Msg)
+	}
+
+	return nil
+}
+
+func (c *client) Write(db string, lines []string) error {
+	body := []byte(strings.Join(lines, "\n"))
+	return c.post("/write?db="+url.QueryEscape(db), body, nil)
+}
+
+type queryResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error"`
+	Data   struct {
+		ResultType string          `json:"resultType"`
+		Result     json.RawMessage `json:"result"`
+	} `json:"data"`
+}
+
+type vectorSample struct {
+	Metric map[string]string `json:"metric"`
+	Value  []interface{}     `json:"value"`
+}
+
+func (c *client) Query(query string) ([]map[string]string, error) {
+	resp, err := c.httpClient.Get(c.baseURL + "/api/v1/query?query=" + url.QueryEscape(query))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var parsed queryResponse
+	if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
+		return nil, fmt.Errorf("unable to decode query response: %w", err)
+	}
+
+	if parsed.Status != "success" {
+		return nil, fmt.Errorf("query failed: %s", parsed.Error)
+	}
+
+	rows := []map[string]string{}
+	switch parsed.Data.ResultType {
+	case "vector":
+		samples := []vectorSample{}
+		if err := json.Unmarshal(parsed.Data.Result, &samples); err != nil {
+			return nil, err
+		}
+
+		for _, sample := range samples {
+			row := map[string]string{}
+			for key, value := range sample.Metric {
+				row[key] = value
+			}
+			addSample(row, sample.Value)
+			rows = append(rows, row)
+		}
+	case "scalar", "string":
+		sample := []interface{}{}
+		if err := json.Unmarshal(parsed.Data.Result, &sample); err != nil {
+			return nil, err
+		}
+
+		row := map[string]string{}
+		addSample(row, sample)
+		rows = append(rows, row)
+	default:
+		return nil, fmt.Errorf("unsupported query result type %q", parsed.Data.ResultType)
+	}
+
+	return rows, nil
+}
+
+// addSample adds the [timestamp, "value"] pair of a query result to row.
+func addSample(row map[string]string, sample []interface{}) {
+	if len(sample) != 2 {
+		return
+	}
+
+	if ts, ok := sample[0].(float64); ok {
+		sec := int64(ts)
+		row["_time"] = time.Unix(sec, int64((ts-float64(sec))*1e9)).UTC().Format(time.RFC3339Nano)
+	}
+
+	if value, ok := sample[1].(string); ok {
+		row["_value"] = value
+	}
+}
+
+func (c *client) post(path string, body []byte, out interface{}) error {
+	resp, err := c.httpClient.Post(c.baseURL+path, "text/plain", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s returned %d: %s", path, resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return json.Unmarshal(data, out)
+}